@@ -0,0 +1,104 @@
+package common
+
+// ByeReason indicates why a peer is closing a connection. It is carried as
+// the first byte of a BYE payload; BYE messages without a payload carry
+// ByeReasonNone.
+type ByeReason byte
+
+const (
+	ByeReasonNone ByeReason = iota
+	ByeReasonShutdown
+	ByeReasonQuotaExceeded
+	ByeReasonNamespaceFull
+	ByeReasonAdministrative
+)
+
+var byeReasonToString = map[ByeReason]string{
+	ByeReasonNone:           "NONE",
+	ByeReasonShutdown:       "SHUTDOWN",
+	ByeReasonQuotaExceeded:  "QUOTA_EXCEEDED",
+	ByeReasonNamespaceFull:  "NAMESPACE_FULL",
+	ByeReasonAdministrative: "ADMINISTRATIVE",
+}
+
+func (r ByeReason) String() string {
+	if s, ok := byeReasonToString[r]; ok {
+		return s
+	}
+	return "UNKNOWN"
+}
+
+// NewByeMessage returns a BYE message carrying the provided reason.
+func NewByeMessage(reason ByeReason) ClientMessage {
+	return NewClientMessage(ClientMessageBye, []byte{byte(reason)})
+}
+
+// DecodeByeReason returns the reason carried by a BYE payload.
+func DecodeByeReason(payload []byte) ByeReason {
+	if len(payload) == 0 {
+		return ByeReasonNone
+	}
+	return ByeReason(payload[0])
+}
+
+// ByeRedirectKind indicates where a peer receiving a BYE should reconnect to.
+// It is carried as the second byte of a BYE payload.
+type ByeRedirectKind byte
+
+const (
+	// ByeRedirectNone asks the peer to reconnect to its configured address.
+	ByeRedirectNone ByeRedirectKind = iota
+	// ByeRedirectAddress asks the peer to reconnect to the address carried
+	// by the redirect.
+	ByeRedirectAddress
+	// ByeRedirectAnyButMe asks the peer to reconnect to any address its
+	// configured address resolves to, except the one emitting the BYE.
+	ByeRedirectAnyButMe
+)
+
+var byeRedirectKindToString = map[ByeRedirectKind]string{
+	ByeRedirectNone:     "NONE",
+	ByeRedirectAddress:  "ADDRESS",
+	ByeRedirectAnyButMe: "ANY_BUT_ME",
+}
+
+func (k ByeRedirectKind) String() string {
+	if s, ok := byeRedirectKindToString[k]; ok {
+		return s
+	}
+	return "UNKNOWN"
+}
+
+// ByeRedirect describes where a peer receiving a BYE should reconnect to.
+// Address is only meaningful for ByeRedirectAddress.
+type ByeRedirect struct {
+	Kind    ByeRedirectKind
+	Address string
+}
+
+// NewByeRedirectMessage returns a BYE message carrying the provided reason
+// and redirect. BYE messages without a redirect are identical to those
+// returned by NewByeMessage.
+func NewByeRedirectMessage(reason ByeReason, redirect ByeRedirect) ClientMessage {
+	if redirect.Kind == ByeRedirectNone {
+		return NewByeMessage(reason)
+	}
+	payload := []byte{byte(reason), byte(redirect.Kind)}
+	if redirect.Kind == ByeRedirectAddress {
+		payload = append(payload, redirect.Address...)
+	}
+	return NewClientMessage(ClientMessageBye, payload)
+}
+
+// DecodeBye returns the reason and redirect carried by a BYE payload.
+func DecodeBye(payload []byte) (ByeReason, ByeRedirect) {
+	reason := DecodeByeReason(payload)
+	if len(payload) < 2 {
+		return reason, ByeRedirect{}
+	}
+	redirect := ByeRedirect{Kind: ByeRedirectKind(payload[1])}
+	if redirect.Kind == ByeRedirectAddress {
+		redirect.Address = string(payload[2:])
+	}
+	return reason, redirect
+}
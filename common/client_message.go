@@ -7,19 +7,39 @@ import (
 )
 
 /*
-Hello 0x00 0x01 0x00 "!UDPFW" 0x00 [size u16 be] [payload]
+Hello  0x00 0x01 0x00 "!UDPFW" 0x00 [size u16 be] [payload]
 
-Ack   0x00 0x02
+Ack    0x00 0x02 [size u16 be] [payload]
 
-Ping  0x00 0x03
+Ping   0x00 0x03
 
-Pong  0x00 0x04
+Pong   0x00 0x04
 
-Pkt   0x00 0x05 [size u16 be] [payload]
+Pkt    0x00 0x05 [size u16 be] [payload]
 
-Bye   0x00 0x06
+Bye    0x00 0x06 [size u16 be] [reason u8] [redirect kind u8] [redirect address]
+
+Groups 0x00 0x07 [size u16 be] [payload]
+
+Reply  0x00 0x08 [size u16 be] [payload]
+  (delivered to the client which published the query it answers, identified
+  by the querier address the frame is destined to)
+
+NsPkt  0x00 0x09 [size u16 be] [ns len u8] [ns] [payload]
+
+Role   0x00 0x0A [size u16 be] [role u8]
+
+Segment 0x00 0x0B [size u16 be] [joined u8] [since i64 be] [candidate len u16 be] [candidate] [segment]
+  (exchanged between dispatch instances only)
+
+Presence 0x00 0x0C [size u16 be] [event u8] [payload]
+  (exchanged between dispatch instances only)
 */
 
+// MaxPayloadSize is the largest payload a message may carry, bound by its
+// u16 size field.
+const MaxPayloadSize = 0xFFFF
+
 var HelloMagic = []byte("\x00!UDPFW\x00")
 var HelloSize = len(HelloMagic)
 
@@ -33,15 +53,27 @@ const (
 	ClientMessagePong
 	ClientMessagePkt
 	ClientMessageBye
+	ClientMessageGroups
+	ClientMessageReply
+	ClientMessageNsPkt
+	ClientMessageRole
+	ClientMessageSegment
+	ClientMessagePresence
 )
 
 var sizeOffset = map[ClientMessageType]int{
-	ClientMessageHello: 10,
-	ClientMessageAck:   0,
-	ClientMessagePing:  0,
-	ClientMessagePong:  0,
-	ClientMessagePkt:   2,
-	ClientMessageBye:   0,
+	ClientMessageHello:    10,
+	ClientMessageAck:      2,
+	ClientMessagePing:     0,
+	ClientMessagePong:     0,
+	ClientMessagePkt:      2,
+	ClientMessageBye:      2,
+	ClientMessageGroups:   2,
+	ClientMessageReply:    2,
+	ClientMessageNsPkt:    2,
+	ClientMessageRole:     2,
+	ClientMessageSegment:  2,
+	ClientMessagePresence: 2,
 }
 
 type ClientMessage []byte
@@ -64,19 +96,37 @@ func (c ClientMessage) Type() ClientMessageType {
 		return ClientMessagePkt
 	case 0x06:
 		return ClientMessageBye
+	case 0x07:
+		return ClientMessageGroups
+	case 0x08:
+		return ClientMessageReply
+	case 0x09:
+		return ClientMessageNsPkt
+	case 0x0A:
+		return ClientMessageRole
+	case 0x0B:
+		return ClientMessageSegment
+	case 0x0C:
+		return ClientMessagePresence
 	default:
 		return ClientMessageInvalid
 	}
 }
 
 var kindToString = map[ClientMessageType]string{
-	ClientMessageInvalid: "INVALID",
-	ClientMessageHello:   "HELLO",
-	ClientMessageAck:     "ACK",
-	ClientMessagePing:    "PING",
-	ClientMessagePong:    "PONG",
-	ClientMessagePkt:     "PKT",
-	ClientMessageBye:     "BYE",
+	ClientMessageInvalid:  "INVALID",
+	ClientMessageHello:    "HELLO",
+	ClientMessageAck:      "ACK",
+	ClientMessagePing:     "PING",
+	ClientMessagePong:     "PONG",
+	ClientMessagePkt:      "PKT",
+	ClientMessageBye:      "BYE",
+	ClientMessageGroups:   "GROUPS",
+	ClientMessageReply:    "REPLY",
+	ClientMessageNsPkt:    "NSPKT",
+	ClientMessageRole:     "ROLE",
+	ClientMessageSegment:  "SEGMENT",
+	ClientMessagePresence: "PRESENCE",
 }
 
 func (c ClientMessage) PayloadSize() int {
@@ -113,7 +163,12 @@ func (c ClientMessage) Deconstruct() (ClientMessageType, []byte) {
 	return t, c.Payload()
 }
 
+// NewClientMessage returns a message of the provided kind carrying payload,
+// or nil in case the payload exceeds MaxPayloadSize.
 func NewClientMessage(kind ClientMessageType, payload []byte) ClientMessage {
+	if len(payload) > MaxPayloadSize {
+		return nil
+	}
 	buf := make([]byte, 0, HelloSize+4) // At least 12 bytes may be immediately used
 	buf = append(buf, 0, byte(kind))
 	if kind == ClientMessageHello {
@@ -129,6 +184,29 @@ func NewClientMessage(kind ClientMessageType, payload []byte) ClientMessage {
 	return buf
 }
 
+// NewNsPktMessage returns a NSPKT message carrying a frame tagged with the
+// namespace it belongs to, or nil in case the namespace exceeds
+// MaxNamespaceLength or the tagged frame exceeds MaxPayloadSize.
+func NewNsPktMessage(ns string, frame []byte) ClientMessage {
+	if len(ns) > MaxNamespaceLength {
+		return nil
+	}
+	payload := make([]byte, 0, 1+len(ns)+len(frame))
+	payload = append(payload, byte(len(ns)))
+	payload = append(payload, ns...)
+	payload = append(payload, frame...)
+	return NewClientMessage(ClientMessageNsPkt, payload)
+}
+
+// DecodeNsPkt returns the namespace and frame carried by a NSPKT payload.
+func DecodeNsPkt(payload []byte) (string, []byte, error) {
+	if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+		return "", nil, fmt.Errorf("truncated NSPKT namespace")
+	}
+	size := int(payload[0])
+	return string(payload[1 : 1+size]), payload[1+size:], nil
+}
+
 func NewMessageAssembler() *MessageAssembler {
 	return &MessageAssembler{
 		buf:  make([]byte, 0, 128),
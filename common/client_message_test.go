@@ -3,6 +3,7 @@ package common
 import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -55,6 +56,54 @@ func TestMessageAssembler(t *testing.T) {
 		assert.Equal(t, 0, res.PayloadSize())
 		assert.Nil(t, res.Payload())
 	})
+
+	t.Run("Bye with reason", func(t *testing.T) {
+		asm := NewMessageAssembler()
+		var res ClientMessage
+		for _, v := range NewByeMessage(ByeReasonQuotaExceeded) {
+			res = asm.Feed(v)
+		}
+		require.NotNil(t, res)
+		assert.Equal(t, ClientMessageBye, res.Type())
+		assert.Equal(t, ByeReasonQuotaExceeded, DecodeByeReason(res.Payload()))
+	})
+
+	t.Run("Bye without reason", func(t *testing.T) {
+		asm := NewMessageAssembler()
+		var res ClientMessage
+		for _, v := range NewClientMessage(ClientMessageBye, nil) {
+			res = asm.Feed(v)
+		}
+		require.NotNil(t, res)
+		assert.Equal(t, ByeReasonNone, DecodeByeReason(res.Payload()))
+	})
+
+	t.Run("Bye with redirect address", func(t *testing.T) {
+		asm := NewMessageAssembler()
+		var res ClientMessage
+		msg := NewByeRedirectMessage(ByeReasonShutdown, ByeRedirect{Kind: ByeRedirectAddress, Address: "dispatch-1:3030"})
+		for _, v := range msg {
+			res = asm.Feed(v)
+		}
+		require.NotNil(t, res)
+		reason, redirect := DecodeBye(res.Payload())
+		assert.Equal(t, ByeReasonShutdown, reason)
+		assert.Equal(t, ByeRedirectAddress, redirect.Kind)
+		assert.Equal(t, "dispatch-1:3030", redirect.Address)
+	})
+
+	t.Run("Bye with any-but-me redirect", func(t *testing.T) {
+		msg := NewByeRedirectMessage(ByeReasonShutdown, ByeRedirect{Kind: ByeRedirectAnyButMe, Address: "ignored"})
+		reason, redirect := DecodeBye(msg.Payload())
+		assert.Equal(t, ByeReasonShutdown, reason)
+		assert.Equal(t, ByeRedirect{Kind: ByeRedirectAnyButMe}, redirect)
+	})
+
+	t.Run("Bye without redirect", func(t *testing.T) {
+		reason, redirect := DecodeBye(NewByeMessage(ByeReasonShutdown).Payload())
+		assert.Equal(t, ByeReasonShutdown, reason)
+		assert.Equal(t, ByeRedirectNone, redirect.Kind)
+	})
 }
 
 func TestNewClientMessage(t *testing.T) {
@@ -68,4 +117,39 @@ func TestNewClientMessage(t *testing.T) {
 	assert.Equal(t, ClientMessageHello, res.Type())
 	assert.Equal(t, 6, res.PayloadSize())
 	assert.Equal(t, []byte("foobar"), res.Payload())
+
+	assert.NotNil(t, NewClientMessage(ClientMessagePkt, make([]byte, MaxPayloadSize)))
+	assert.Nil(t, NewClientMessage(ClientMessagePkt, make([]byte, MaxPayloadSize+1)))
+}
+
+func TestNsPkt(t *testing.T) {
+	asm := NewMessageAssembler()
+	var res ClientMessage
+	for _, v := range NewNsPktMessage("segment-a", []byte("frame")) {
+		res = asm.Feed(v)
+	}
+	require.NotNil(t, res)
+	assert.Equal(t, ClientMessageNsPkt, res.Type())
+	ns, frame, err := DecodeNsPkt(res.Payload())
+	require.NoError(t, err)
+	assert.Equal(t, "segment-a", ns)
+	assert.Equal(t, []byte("frame"), frame)
+
+	_, _, err = DecodeNsPkt([]byte{5, 'a'})
+	assert.ErrorContains(t, err, "truncated")
+
+	assert.Nil(t, NewNsPktMessage(strings.Repeat("a", MaxNamespaceLength+1), []byte("frame")))
+	assert.Nil(t, NewNsPktMessage("segment-a", make([]byte, MaxPayloadSize)))
+}
+
+func TestRole(t *testing.T) {
+	asm := NewMessageAssembler()
+	var res ClientMessage
+	for _, v := range NewRoleMessage(SegmentRoleStandby) {
+		res = asm.Feed(v)
+	}
+	require.NotNil(t, res)
+	assert.Equal(t, ClientMessageRole, res.Type())
+	assert.Equal(t, SegmentRoleStandby, DecodeRole(res.Payload()))
+	assert.Equal(t, SegmentRoleNone, DecodeRole(nil))
 }
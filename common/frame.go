@@ -0,0 +1,86 @@
+package common
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+	etherTypeVLAN = 0x8100
+
+	ipProtocolUDP = 17
+)
+
+// FrameInfo contains addressing information extracted from an Ethernet frame
+// carried by a PKT message.
+type FrameInfo struct {
+	Src      net.IP
+	Dst      net.IP
+	Protocol uint8
+	SrcPort  uint16
+	DstPort  uint16
+
+	// Network contains the frame contents starting at its IP header.
+	Network []byte
+
+	// Payload contains the UDP payload, and is only filled for unfragmented
+	// UDP datagrams.
+	Payload []byte
+}
+
+// ParseFrame extracts addressing information from the provided Ethernet
+// frame. Ports are only filled for unfragmented UDP datagrams. The returned
+// boolean is false in case the frame does not contain an IPv4 or IPv6 packet.
+func ParseFrame(frame []byte) (info FrameInfo, ok bool) {
+	if len(frame) < 14 {
+		return
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	offset := 14
+	if etherType == etherTypeVLAN {
+		if len(frame) < 18 {
+			return
+		}
+		etherType = binary.BigEndian.Uint16(frame[16:18])
+		offset = 18
+	}
+
+	network := frame[offset:]
+	var transport []byte
+	switch etherType {
+	case etherTypeIPv4:
+		if len(network) < 20 {
+			return
+		}
+		headerLen := int(network[0]&0x0F) * 4
+		if headerLen < 20 || len(network) < headerLen {
+			return
+		}
+		info.Src = net.IP(network[12:16])
+		info.Dst = net.IP(network[16:20])
+		info.Protocol = network[9]
+		if binary.BigEndian.Uint16(network[6:8])&0x1FFF == 0 {
+			transport = network[headerLen:]
+		}
+	case etherTypeIPv6:
+		if len(network) < 40 {
+			return
+		}
+		info.Src = net.IP(network[8:24])
+		info.Dst = net.IP(network[24:40])
+		info.Protocol = network[6]
+		transport = network[40:]
+	default:
+		return
+	}
+
+	info.Network = network
+	if info.Protocol == ipProtocolUDP && len(transport) >= 8 {
+		info.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		info.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		info.Payload = transport[8:]
+	}
+	return info, true
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestParseFrame(t *testing.T) {
+	frame := []byte{
+		// Ethernet
+		0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB, 0x02, 0x42,
+		0xAC, 0x11, 0x00, 0x02, 0x08, 0x00,
+		// IPv4
+		0x45, 0x00, 0x00, 0x21, 0x00, 0x00, 0x40, 0x00,
+		0xFF, 0x11, 0x00, 0x00, 0xC0, 0xA8, 0x00, 0x0A,
+		0xE0, 0x00, 0x00, 0xFB,
+		// UDP
+		0x14, 0xE9, 0x14, 0xE9, 0x00, 0x0D, 0x00, 0x00,
+		0x66, 0x6F, 0x6F, 0x62, 0x61,
+	}
+
+	info, ok := ParseFrame(frame)
+	require.True(t, ok)
+	assert.True(t, info.Src.Equal(net.ParseIP("192.168.0.10")))
+	assert.True(t, info.Dst.Equal(net.ParseIP("224.0.0.251")))
+	assert.Equal(t, uint8(17), info.Protocol)
+	assert.Equal(t, uint16(5353), info.SrcPort)
+	assert.Equal(t, uint16(5353), info.DstPort)
+	assert.Equal(t, frame[14:], info.Network)
+	assert.Equal(t, []byte("fooba"), info.Payload)
+
+	t.Run("truncated frame", func(t *testing.T) {
+		_, ok := ParseFrame(frame[:20])
+		assert.False(t, ok)
+	})
+}
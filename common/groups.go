@@ -0,0 +1,46 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// GroupsRefreshInterval is the interval in which clients re-advertise their
+// multicast group memberships. Memberships learned from other dispatch
+// instances are discarded when not refreshed within three intervals.
+const GroupsRefreshInterval = 1 * time.Minute
+
+// EncodeGroups encodes a list of multicast groups into a GROUPS payload. Each
+// group is encoded as [len u8] [address], where len is either 4 or 16.
+func EncodeGroups(groups []net.IP) []byte {
+	buf := make([]byte, 0, len(groups)*17)
+	for _, g := range groups {
+		if v4 := g.To4(); v4 != nil {
+			buf = append(buf, net.IPv4len)
+			buf = append(buf, v4...)
+			continue
+		}
+		buf = append(buf, net.IPv6len)
+		buf = append(buf, g.To16()...)
+	}
+	return buf
+}
+
+// DecodeGroups decodes a GROUPS payload previously encoded through
+// EncodeGroups.
+func DecodeGroups(data []byte) ([]net.IP, error) {
+	var groups []net.IP
+	for len(data) > 0 {
+		size := int(data[0])
+		if size != net.IPv4len && size != net.IPv6len {
+			return nil, fmt.Errorf("invalid group address length %d", size)
+		}
+		if len(data) < size+1 {
+			return nil, fmt.Errorf("truncated group address")
+		}
+		groups = append(groups, append(net.IP{}, data[1:size+1]...))
+		data = data[size+1:]
+	}
+	return groups, nil
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestEncodeGroups(t *testing.T) {
+	groups := []net.IP{
+		net.ParseIP("224.0.0.251"),
+		net.ParseIP("ff02::fb"),
+		net.ParseIP("239.255.255.250"),
+	}
+
+	data := EncodeGroups(groups)
+	assert.Len(t, data, 5+17+5)
+
+	decoded, err := DecodeGroups(data)
+	require.NoError(t, err)
+	require.Len(t, decoded, 3)
+	for i, g := range groups {
+		assert.True(t, g.Equal(decoded[i]))
+	}
+
+	t.Run("empty payload", func(t *testing.T) {
+		decoded, err := DecodeGroups(nil)
+		require.NoError(t, err)
+		assert.Empty(t, decoded)
+	})
+
+	t.Run("truncated payload", func(t *testing.T) {
+		_, err := DecodeGroups(data[:len(data)-1])
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// helloTLVMarker prefixes HELLO payloads encoded through Hello.Encode. Legacy
+// HELLO payloads carry a bare namespace, which never starts with a NUL byte.
+const helloTLVMarker = 0x00
+
+const (
+	helloFieldNamespace byte = iota + 1
+	helloFieldNode
+	helloFieldInterface
+	helloFieldVersion
+	helloFieldLabel
+	helloFieldDirection
+	helloFieldSegment
+)
+
+// Direction restricts traffic flowing through a client connection.
+type Direction byte
+
+const (
+	// DirectionBoth allows a client to publish and receive frames.
+	DirectionBoth Direction = iota
+	// DirectionPublish allows a client to publish frames, without receiving
+	// frames published by other members of its namespaces.
+	DirectionPublish
+	// DirectionSubscribe allows a client to receive frames, without
+	// publishing any.
+	DirectionSubscribe
+)
+
+var directionToString = map[Direction]string{
+	DirectionBoth:      "both",
+	DirectionPublish:   "publish",
+	DirectionSubscribe: "subscribe",
+}
+
+func (d Direction) String() string {
+	if s, ok := directionToString[d]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// CanPublish determines whether frames emitted by a client are published.
+func (d Direction) CanPublish() bool { return d != DirectionSubscribe }
+
+// CanSubscribe determines whether frames are delivered to a client.
+func (d Direction) CanSubscribe() bool { return d != DirectionPublish }
+
+// ParseDirection parses a Direction from its string representation.
+func ParseDirection(value string) (Direction, error) {
+	for d, s := range directionToString {
+		if s == value {
+			return d, nil
+		}
+	}
+	return DirectionBoth, fmt.Errorf("invalid direction %q: expected both, publish or subscribe", value)
+}
+
+// Hello holds the attributes a client advertises through its HELLO message.
+// Clients may join several namespaces over a single connection.
+type Hello struct {
+	Namespaces []string
+	Node       string
+	Interface  string
+	Version    string
+	Labels     map[string]string
+	Direction  Direction
+
+	// Segment identifies the L2 segment the client captures on. Clients
+	// reporting the same segment elect a single active forwarder.
+	Segment string
+}
+
+// Encode encodes the Hello into a HELLO payload. The payload is composed by
+// a NUL marker followed by fields encoded as [type u8] [len u16 be] [value].
+// Namespaces are encoded as one field each, and labels as one "key=value"
+// field each. The direction is omitted when it is DirectionBoth. Unknown
+// fields are ignored by DecodeHello, so new fields may be introduced without
+// breaking older peers.
+func (h Hello) Encode() []byte {
+	buf := []byte{helloTLVMarker}
+	field := func(kind byte, value string) {
+		if value == "" {
+			return
+		}
+		buf = append(buf, kind)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+		buf = append(buf, value...)
+	}
+
+	for _, ns := range h.Namespaces {
+		field(helloFieldNamespace, ns)
+	}
+	field(helloFieldNode, h.Node)
+	field(helloFieldInterface, h.Interface)
+	field(helloFieldVersion, h.Version)
+	field(helloFieldSegment, h.Segment)
+	if h.Direction != DirectionBoth {
+		field(helloFieldDirection, h.Direction.String())
+	}
+
+	keys := make([]string, 0, len(h.Labels))
+	for k := range h.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field(helloFieldLabel, k+"="+h.Labels[k])
+	}
+	return buf
+}
+
+// DecodeHello decodes a HELLO payload. Payloads not produced by Hello.Encode
+// are handled as a bare namespace, as emitted by older clients.
+func DecodeHello(payload []byte) (Hello, error) {
+	if len(payload) == 0 {
+		return Hello{}, nil
+	}
+	if payload[0] != helloTLVMarker {
+		return Hello{Namespaces: []string{string(payload)}}, nil
+	}
+
+	var h Hello
+	data := payload[1:]
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return Hello{}, fmt.Errorf("truncated HELLO field header")
+		}
+		kind, size := data[0], int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+size {
+			return Hello{}, fmt.Errorf("truncated HELLO field")
+		}
+		value := string(data[3 : 3+size])
+		data = data[3+size:]
+
+		switch kind {
+		case helloFieldNamespace:
+			h.Namespaces = append(h.Namespaces, value)
+		case helloFieldNode:
+			h.Node = value
+		case helloFieldInterface:
+			h.Interface = value
+		case helloFieldVersion:
+			h.Version = value
+		case helloFieldLabel:
+			k, v, _ := strings.Cut(value, "=")
+			if h.Labels == nil {
+				h.Labels = make(map[string]string)
+			}
+			h.Labels[k] = v
+		case helloFieldSegment:
+			h.Segment = value
+		case helloFieldDirection:
+			d, err := ParseDirection(value)
+			if err != nil {
+				return Hello{}, err
+			}
+			h.Direction = d
+		}
+	}
+	return h, nil
+}
+
+// ParseLabels parses labels provided as "key=value" strings.
+func ParseLabels(values []string) (map[string]string, error) {
+	labels := make(map[string]string, len(values))
+	for _, v := range values {
+		k, val, ok := strings.Cut(v, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q: expected key=value", v)
+		}
+		labels[k] = val
+	}
+	return labels, nil
+}
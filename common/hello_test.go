@@ -0,0 +1,76 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		h := Hello{
+			Namespaces: []string{"segment-a", "segment-b"},
+			Node:       "worker-1",
+			Interface:  "eth0",
+			Version:    "1.2.3",
+			Labels:     map[string]string{"zone": "us-east-1a", "rack": "r12"},
+			Direction:  DirectionSubscribe,
+			Segment:    "10.0.1.0/24",
+		}
+		decoded, err := DecodeHello(h.Encode())
+		require.NoError(t, err)
+		assert.Equal(t, h, decoded)
+	})
+
+	t.Run("legacy namespace", func(t *testing.T) {
+		decoded, err := DecodeHello([]byte("segment-a"))
+		require.NoError(t, err)
+		assert.Equal(t, Hello{Namespaces: []string{"segment-a"}}, decoded)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		decoded, err := DecodeHello(nil)
+		require.NoError(t, err)
+		assert.Equal(t, Hello{}, decoded)
+	})
+
+	t.Run("unknown fields are ignored", func(t *testing.T) {
+		payload := append(Hello{Node: "worker-1"}.Encode(), 0xFF, 0x00, 0x01, 'x')
+		decoded, err := DecodeHello(payload)
+		require.NoError(t, err)
+		assert.Equal(t, Hello{Node: "worker-1"}, decoded)
+	})
+
+	t.Run("invalid direction", func(t *testing.T) {
+		payload := append([]byte{helloTLVMarker, helloFieldDirection, 0x00, 0x01}, 'x')
+		_, err := DecodeHello(payload)
+		assert.ErrorContains(t, err, "invalid direction")
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		payload := Hello{Node: "worker-1"}.Encode()
+		_, err := DecodeHello(payload[:len(payload)-1])
+		assert.ErrorContains(t, err, "truncated")
+	})
+
+	t.Run("through assembler", func(t *testing.T) {
+		asm := NewMessageAssembler()
+		var res ClientMessage
+		for _, v := range NewClientMessage(ClientMessageHello, Hello{Namespaces: []string{"ns"}}.Encode()) {
+			res = asm.Feed(v)
+		}
+		require.NotNil(t, res)
+		decoded, err := DecodeHello(res.Payload())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ns"}, decoded.Namespaces)
+	})
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels([]string{"zone=a", "empty="})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"zone": "a", "empty": ""}, labels)
+
+	_, err = ParseLabels([]string{"invalid"})
+	assert.ErrorContains(t, err, "expected key=value")
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Namespaces are hierarchical, composed by tokens separated by dots, such as
+// "site-a.floor-2". Subscriptions may use wildcard tokens: "*" matches exactly
+// one token, and ">", which must be the last token, matches one or more
+// tokens. Frames are only published on namespaces without wildcards.
+const (
+	NamespaceSeparator      = "."
+	NamespaceWildcardSingle = "*"
+	NamespaceWildcardTail   = ">"
+)
+
+// MaxNamespaceLength is the length of the longest namespace, which must fit
+// the u8 length of NSPKT messages.
+const MaxNamespaceLength = 0xFF
+
+// ValidateNamespace returns an error in case the provided namespace or
+// namespace pattern is malformed.
+func ValidateNamespace(ns string) error {
+	if ns == "" {
+		return fmt.Errorf("empty namespace")
+	}
+	if len(ns) > MaxNamespaceLength {
+		return fmt.Errorf("invalid namespace %q: longer than %d bytes", ns, MaxNamespaceLength)
+	}
+	tokens := strings.Split(ns, NamespaceSeparator)
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return fmt.Errorf("invalid namespace %q: empty token", ns)
+		case token == NamespaceWildcardTail && i != len(tokens)-1:
+			return fmt.Errorf("invalid namespace %q: %s must be the last token", ns, NamespaceWildcardTail)
+		case token != NamespaceWildcardSingle && token != NamespaceWildcardTail &&
+			strings.ContainsAny(token, NamespaceWildcardSingle+NamespaceWildcardTail):
+			return fmt.Errorf("invalid namespace %q: wildcards must be whole tokens", ns)
+		}
+	}
+	return nil
+}
+
+// IsNamespacePattern determines whether the provided namespace contains
+// wildcard tokens.
+func IsNamespacePattern(ns string) bool {
+	for _, token := range strings.Split(ns, NamespaceSeparator) {
+		if token == NamespaceWildcardSingle || token == NamespaceWildcardTail {
+			return true
+		}
+	}
+	return false
+}
+
+// NamespaceMatches determines whether a namespace matches the provided
+// pattern. Namespaces without wildcards only match themselves.
+func NamespaceMatches(pattern, ns string) bool {
+	if pattern == ns {
+		return true
+	}
+	patternTokens := strings.Split(pattern, NamespaceSeparator)
+	tokens := strings.Split(ns, NamespaceSeparator)
+	for i, p := range patternTokens {
+		if p == NamespaceWildcardTail {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) || (p != NamespaceWildcardSingle && p != tokens[i]) {
+			return false
+		}
+	}
+	return len(tokens) == len(patternTokens)
+}
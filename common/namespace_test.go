@@ -0,0 +1,44 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestValidateNamespace(t *testing.T) {
+	for _, ns := range []string{"$$global", "site-a", "site-a.floor-2", "site-a.*", "site-a.>", "*.floor-2", ">"} {
+		assert.NoError(t, ValidateNamespace(ns), ns)
+	}
+	for _, ns := range []string{"", "site-a.", ".site-a", "site-a..floor-2", "site-a.>.floor-2", "site-a.floor*", "site->"} {
+		assert.Error(t, ValidateNamespace(ns), ns)
+	}
+	assert.NoError(t, ValidateNamespace(strings.Repeat("a", MaxNamespaceLength)))
+	assert.Error(t, ValidateNamespace(strings.Repeat("a", MaxNamespaceLength+1)))
+}
+
+func TestNamespaceMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		ns      string
+		matches bool
+	}{
+		{"site-a", "site-a", true},
+		{"site-a", "site-b", false},
+		{"site-a", "site-a.floor-2", false},
+		{"site-a.*", "site-a.floor-2", true},
+		{"site-a.*", "site-a", false},
+		{"site-a.*", "site-a.floor-2.room-1", false},
+		{"site-a.>", "site-a.floor-2", true},
+		{"site-a.>", "site-a.floor-2.room-1", true},
+		{"site-a.>", "site-a", false},
+		{"*.floor-2", "site-b.floor-2", true},
+		{"*.floor-2", "site-b.floor-3", false},
+		{">", "site-a", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.matches, NamespaceMatches(tt.pattern, tt.ns), "%s ~ %s", tt.pattern, tt.ns)
+	}
+	assert.True(t, IsNamespacePattern("site-a.>"))
+	assert.False(t, IsNamespacePattern("site-a.floor-2"))
+}
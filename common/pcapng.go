@@ -0,0 +1,252 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngOptComment        = 1
+	pcapngOptIfName         = 2
+	pcapngOptIfDescription  = 3
+	pcapngOptShbUserAppl    = 4
+	pcapngLinkTypeEthernet  = 1
+	pcapngDefaultMaxFiles   = 10
+	pcapngDefaultMaxFileLen = 64 * 1024 * 1024
+	pcapngDefaultFlush      = time.Second
+)
+
+// RecorderOptions configures a Recorder. Files are rotated once they exceed
+// MaxFileSize bytes, and at most MaxFiles files are kept, older files being
+// removed. Recorded frames are flushed to disk every FlushInterval, upon
+// rotation, and upon Close.
+type RecorderOptions struct {
+	Dir           string
+	Prefix        string
+	Application   string
+	MaxFileSize   int64
+	MaxFiles      int
+	FlushInterval time.Duration
+}
+
+// RecorderInterface identifies the interface a recorded frame is associated
+// to. Each distinct interface is described by its own Interface Description
+// Block.
+type RecorderInterface struct {
+	Name        string
+	Description string
+}
+
+// NewRecorder returns a Recorder writing pcapng files to the directory
+// provided through opts, which is created in case it does not exist.
+func NewRecorder(opts RecorderOptions) (*Recorder, error) {
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = pcapngDefaultMaxFileLen
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = pcapngDefaultMaxFiles
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = pcapngDefaultFlush
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{opts: opts, stop: make(chan struct{})}
+	go r.flushPeriodically()
+	return r, nil
+}
+
+// Recorder writes Ethernet frames into rotating pcapng files.
+type Recorder struct {
+	mu         sync.Mutex
+	opts       RecorderOptions
+	file       *os.File
+	w          *bufio.Writer
+	size       int64
+	seq        int
+	files      []string
+	interfaces map[RecorderInterface]uint32
+	stop       chan struct{}
+	closed     bool
+}
+
+// Record appends a frame associated to the provided interface, along with
+// an optional comment. Returns os.ErrClosed once the Recorder is closed.
+func (r *Recorder) Record(iface RecorderInterface, ts time.Time, frame []byte, comment string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return os.ErrClosed
+	}
+
+	if r.file == nil || r.size >= r.opts.MaxFileSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	id, ok := r.interfaces[iface]
+	if !ok {
+		id = uint32(len(r.interfaces))
+		if err := r.writeBlock(pcapngInterfaceDesc, interfaceDescBody(), []pcapngOption{
+			{pcapngOptIfName, iface.Name},
+			{pcapngOptIfDescription, iface.Description},
+		}); err != nil {
+			return err
+		}
+		r.interfaces[iface] = id
+	}
+
+	if err := r.writeBlock(pcapngEnhancedPacket, enhancedPacketBody(id, ts, frame), []pcapngOption{
+		{pcapngOptComment, comment},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// flushPeriodically flushes buffered frames every configured interval, so
+// recordings can be inspected while being written without flushing on every
+// frame.
+func (r *Recorder) flushPeriodically() {
+	tick := time.NewTicker(r.opts.FlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-tick.C:
+			r.mu.Lock()
+			if r.w != nil {
+				_ = r.w.Flush()
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// Close flushes and closes the current file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.stop)
+	}
+	return r.closeFile()
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if cErr := r.file.Close(); err == nil {
+		err = cErr
+	}
+	r.file, r.w = nil, nil
+	return err
+}
+
+func (r *Recorder) rotate() error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+
+	r.seq++
+	name := fmt.Sprintf("%s-%s-%04d.pcapng", r.opts.Prefix, time.Now().UTC().Format("20060102T150405"), r.seq)
+	path := filepath.Join(r.opts.Dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	r.file = f
+	r.w = bufio.NewWriter(f)
+	r.size = 0
+	r.interfaces = make(map[RecorderInterface]uint32)
+	r.files = append(r.files, path)
+	for len(r.files) > r.opts.MaxFiles {
+		_ = os.Remove(r.files[0])
+		r.files = r.files[1:]
+	}
+
+	return r.writeBlock(pcapngSectionHeader, sectionHeaderBody(), []pcapngOption{
+		{pcapngOptShbUserAppl, r.opts.Application},
+	})
+}
+
+type pcapngOption struct {
+	code  uint16
+	value string
+}
+
+func sectionHeaderBody() []byte {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	binary.LittleEndian.PutUint64(body[8:], 0xFFFFFFFFFFFFFFFF) // Unspecified section length
+	return body
+}
+
+func interfaceDescBody() []byte {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], pcapngLinkTypeEthernet)
+	return body
+}
+
+func enhancedPacketBody(id uint32, ts time.Time, frame []byte) []byte {
+	micros := uint64(ts.UnixMicro())
+	body := make([]byte, 20, 20+len(frame)+3)
+	binary.LittleEndian.PutUint32(body[0:], id)
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(frame)))
+	body = append(body, frame...)
+	return pad32(body)
+}
+
+func pad32(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func (r *Recorder) writeBlock(kind uint32, body []byte, options []pcapngOption) error {
+	for _, opt := range options {
+		if opt.value == "" {
+			continue
+		}
+		hdr := make([]byte, 4)
+		binary.LittleEndian.PutUint16(hdr[0:], opt.code)
+		binary.LittleEndian.PutUint16(hdr[2:], uint16(len(opt.value)))
+		body = append(body, hdr...)
+		body = pad32(append(body, opt.value...))
+	}
+	body = append(body, 0, 0, 0, 0) // opt_endofopt
+
+	total := uint32(len(body) + 12)
+	block := make([]byte, 8, total)
+	binary.LittleEndian.PutUint32(block[0:], kind)
+	binary.LittleEndian.PutUint32(block[4:], total)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, total)
+
+	n, err := r.w.Write(block)
+	r.size += int64(n)
+	return err
+}
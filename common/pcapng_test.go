@@ -0,0 +1,124 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type pcapngBlock struct {
+	kind uint32
+	body []byte
+}
+
+func readBlocks(t *testing.T, path string) []pcapngBlock {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var blocks []pcapngBlock
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 12)
+		kind := binary.LittleEndian.Uint32(data[0:])
+		total := binary.LittleEndian.Uint32(data[4:])
+		require.Zero(t, total%4)
+		require.Equal(t, total, binary.LittleEndian.Uint32(data[total-4:]))
+		blocks = append(blocks, pcapngBlock{kind: kind, body: data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(RecorderOptions{Dir: dir, Prefix: "test", Application: "udpfw-test"})
+	require.NoError(t, err)
+
+	eth0 := RecorderInterface{Name: "eth0:captured", Description: "Captured"}
+	frame := []byte{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb, 0xaa}
+	ts := time.Unix(1700000000, 123000)
+	require.NoError(t, r.Record(eth0, ts, frame, "direction=captured"))
+	require.NoError(t, r.Record(eth0, ts, frame, ""))
+	require.NoError(t, r.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "test-*.pcapng"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	blocks := readBlocks(t, files[0])
+	require.Len(t, blocks, 4)
+	assert.Equal(t, uint32(pcapngSectionHeader), blocks[0].kind)
+	assert.Equal(t, uint32(pcapngByteOrderMagic), binary.LittleEndian.Uint32(blocks[0].body))
+	assert.True(t, bytes.Contains(blocks[0].body, []byte("udpfw-test")))
+
+	assert.Equal(t, uint32(pcapngInterfaceDesc), blocks[1].kind)
+	assert.True(t, bytes.Contains(blocks[1].body, []byte("eth0:captured")))
+
+	epb := blocks[2]
+	assert.Equal(t, uint32(pcapngEnhancedPacket), epb.kind)
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(epb.body[0:]))
+	micros := uint64(binary.LittleEndian.Uint32(epb.body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb.body[8:]))
+	assert.Equal(t, uint64(ts.UnixMicro()), micros)
+	assert.Equal(t, uint32(len(frame)), binary.LittleEndian.Uint32(epb.body[12:]))
+	assert.Equal(t, frame, epb.body[20:20+len(frame)])
+	assert.True(t, bytes.Contains(epb.body, []byte("direction=captured")))
+}
+
+func TestRecorder_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(RecorderOptions{Dir: dir, Prefix: "rot", MaxFileSize: 256, MaxFiles: 2})
+	require.NoError(t, err)
+
+	iface := RecorderInterface{Name: "ns"}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, r.Record(iface, time.Now(), make([]byte, 100), ""))
+	}
+	require.NoError(t, r.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "rot-*.pcapng"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		blocks := readBlocks(t, f)
+		// Every file starts its own section, describing its interfaces.
+		assert.Equal(t, uint32(pcapngSectionHeader), blocks[0].kind)
+		assert.Equal(t, uint32(pcapngInterfaceDesc), blocks[1].kind)
+	}
+}
+
+func TestRecorder_RecordAfterClose(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(RecorderOptions{Dir: dir, Prefix: "closed"})
+	require.NoError(t, err)
+
+	iface := RecorderInterface{Name: "ns"}
+	require.NoError(t, r.Record(iface, time.Now(), make([]byte, 60), ""))
+	require.NoError(t, r.Close())
+	assert.ErrorIs(t, r.Record(iface, time.Now(), make([]byte, 60), ""), os.ErrClosed)
+
+	// No file is created for frames recorded late.
+	files, err := filepath.Glob(filepath.Join(dir, "closed-*.pcapng"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Len(t, readBlocks(t, files[0]), 3)
+}
+
+func TestRecorder_PeriodicFlush(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(RecorderOptions{Dir: dir, Prefix: "flush", FlushInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+
+	require.NoError(t, r.Record(RecorderInterface{Name: "ns"}, time.Now(), make([]byte, 60), ""))
+	files, err := filepath.Glob(filepath.Join(dir, "flush-*.pcapng"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Eventually(t, func() bool {
+		stat, err := os.Stat(files[0])
+		return err == nil && stat.Size() > 0 && len(readBlocks(t, files[0])) == 3
+	}, time.Second, 10*time.Millisecond)
+}
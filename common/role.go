@@ -0,0 +1,42 @@
+package common
+
+// SegmentRole indicates whether a client reporting a segment is the elected
+// forwarder for it. It is carried by ROLE messages, emitted by the dispatch
+// whenever the role of a client changes.
+type SegmentRole byte
+
+const (
+	SegmentRoleNone SegmentRole = iota
+	// SegmentRoleActive indicates the client captures and injects traffic
+	// for its segment.
+	SegmentRoleActive
+	// SegmentRoleStandby indicates another client forwards traffic for the
+	// segment, and the client must neither capture nor inject.
+	SegmentRoleStandby
+)
+
+var segmentRoleToString = map[SegmentRole]string{
+	SegmentRoleNone:    "none",
+	SegmentRoleActive:  "active",
+	SegmentRoleStandby: "standby",
+}
+
+func (r SegmentRole) String() string {
+	if s, ok := segmentRoleToString[r]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// NewRoleMessage returns a ROLE message carrying the provided role.
+func NewRoleMessage(role SegmentRole) ClientMessage {
+	return NewClientMessage(ClientMessageRole, []byte{byte(role)})
+}
+
+// DecodeRole returns the role carried by a ROLE payload.
+func DecodeRole(payload []byte) SegmentRole {
+	if len(payload) == 0 {
+		return SegmentRoleNone
+	}
+	return SegmentRole(payload[0])
+}
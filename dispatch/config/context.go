@@ -4,13 +4,17 @@ import (
 	"fmt"
 	"github.com/nats-io/nats.go"
 	"github.com/redis/go-redis/v9"
+	"github.com/udpfw/common"
+	"net"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type AllOptions struct {
-	Bind  string `name:"bind" usage:"Bind address the server will listen on" env:"BIND"`
-	Debug *bool  `name:"debug" usage:"Enables debug logging" env:"DEBUG"`
+	Bind         string         `name:"bind" usage:"Bind address the server will listen on" env:"BIND"`
+	Debug        *bool          `name:"debug" usage:"Enables debug logging" env:"DEBUG"`
+	DrainTimeout *time.Duration `name:"drain-timeout" usage:"Time to wait for clients to disconnect upon shutdown before forcibly closing their connections" env:"DRAIN_TIMEOUT" value:"30s"`
 
 	NatsURL                 *string `name:"nats-url" usage:"URL for a NATS server (when using NATS for pubsub)" env:"NATS_URL" category:"NATS"`
 	NatsSubscriptionSubject *string `name:"nats-subscription-subject" usage:"Name of a NATS subscription subject where data will be exchanged" env:"NATS_SUBSCRIPTION_SUBJECT" category:"NATS" value:"udpfw-dispatch-exchange"`
@@ -24,6 +28,35 @@ type AllOptions struct {
 
 	RedisURL           *string `name:"redis-url" usage:"Redis URL (when using Redis for pubsub)" env:"REDIS_URL" category:"Redis" `
 	RedisPubsubChannel *string `name:"redis-pubsub-channel" usage:"Redis channel name where data will be exchanged" env:"REDIS_PUBSUB_CHANNEL" category:"Redis" value:"udpfw-dispatch-exchange"`
+
+	NamespaceMaxClients  *int           `name:"namespace-max-clients" usage:"Maximum amount of clients connected to this instance in a single namespace" env:"NAMESPACE_MAX_CLIENTS" category:"Quotas"`
+	NamespaceMaxPPS      *int           `name:"namespace-max-pps" usage:"Maximum amount of packets per second a single namespace may emit through this instance" env:"NAMESPACE_MAX_PPS" category:"Quotas"`
+	NamespaceMaxBPS      *int           `name:"namespace-max-bps" usage:"Maximum amount of bytes per second a single namespace may emit through this instance" env:"NAMESPACE_MAX_BPS" category:"Quotas"`
+	ClientMaxPPS         *int           `name:"client-max-pps" usage:"Maximum amount of packets per second a single client may emit" env:"CLIENT_MAX_PPS" category:"Quotas"`
+	ClientMaxBPS         *int           `name:"client-max-bps" usage:"Maximum amount of bytes per second a single client may emit" env:"CLIENT_MAX_BPS" category:"Quotas"`
+	QuotaDisconnectAfter *time.Duration `name:"quota-disconnect-after" usage:"Disconnects clients continuously exceeding quotas for longer than this duration" env:"QUOTA_DISCONNECT_AFTER" category:"Quotas" value:"10s"`
+
+	RecordDir         *string `name:"record-dir" usage:"Directory in which forwarded frames are recorded as pcapng files. Recording is disabled when unset" env:"RECORD_DIR" category:"Recording"`
+	RecordMaxFileSize *int    `name:"record-max-file-size" usage:"Size in bytes after which recording files are rotated" env:"RECORD_MAX_FILE_SIZE" category:"Recording" value:"67108864"`
+	RecordMaxFiles    *int    `name:"record-max-files" usage:"Maximum amount of recording files kept. Older files are removed" env:"RECORD_MAX_FILES" category:"Recording" value:"10"`
+
+	MetricsBind *string `name:"metrics-bind" usage:"Address on which metrics are exposed under /debug/vars. Metrics are not exposed when unset" env:"METRICS_BIND" category:"Metrics"`
+
+	HandoverAddress  *string `name:"handover-address" usage:"Dispatch address clients are redirected to upon shutdown" env:"HANDOVER_ADDRESS" category:"Handover"`
+	HandoverAnyButMe *bool   `name:"handover-any-but-me" usage:"Redirects clients upon shutdown to any address their dispatch address resolves to, except this instance" env:"HANDOVER_ANY_BUT_ME" category:"Handover"`
+
+	KeepaliveInterval  *time.Duration `name:"keepalive-interval" usage:"Interval between PING messages emitted to clients. Keepalive is disabled when zero" env:"KEEPALIVE_INTERVAL" category:"Keepalive" value:"15s"`
+	KeepaliveMaxMissed *int           `name:"keepalive-max-missed" usage:"Amount of consecutive PING messages left unanswered after which a client is disconnected" env:"KEEPALIVE_MAX_MISSED" category:"Keepalive" value:"3"`
+
+	AdminBind  *string `name:"admin-bind" usage:"Address on which the admin API is exposed. The API is not exposed when unset. Binding to addresses other than loopback ones requires --admin-token" env:"ADMIN_BIND" category:"Admin"`
+	AdminToken *string `name:"admin-token" usage:"Bearer token required by the admin API in the Authorization header. The API is not authenticated when unset" env:"ADMIN_TOKEN" category:"Admin"`
+
+	DedupeWindow *time.Duration `name:"dedupe-window" usage:"Time during which identical frames emitted by distinct clients on a namespace are delivered once. Duplicate suppression is disabled when zero. Instances predating duplicate suppression do not share frame hashes, so frames they publish are hashed upon receipt, and frames they receive are never suppressed" env:"DEDUPE_WINDOW" category:"Dedupe"`
+
+	RoutesFile           *FilePath      `name:"routes-file" usage:"JSON file holding routing rules bridging namespaces. Routing is disabled when unset" env:"ROUTES_FILE" category:"Routing"`
+	RoutesReloadInterval *time.Duration `name:"routes-reload-interval" usage:"Interval at which the routes file is checked for changes. Reloading is disabled when zero" env:"ROUTES_RELOAD_INTERVAL" category:"Routing" value:"10s"`
+
+	PresenceInterval *time.Duration `name:"presence-interval" usage:"Interval at which local clients are announced to other dispatch instances through the pubsub, building a cluster-wide client list. Should be identical across instances. Presence is disabled when zero" env:"PRESENCE_INTERVAL" category:"Presence" value:"10s"`
 }
 
 type FilePath string
@@ -46,9 +79,47 @@ func (f FilePath) Clean() (string, error) {
 }
 
 type Context struct {
-	BindAddress   string
-	PubSubService any // *NATSConfig, *RedisConfig, or nil
-	Debug         bool
+	BindAddress      string
+	PubSubService    any // *NATSConfig, *RedisConfig, or nil
+	Debug            bool
+	DrainTimeout     time.Duration
+	Quotas           QuotaConfig
+	MetricsBind      string
+	AdminBind        string
+	AdminToken       string                  // Empty when the admin API is not authenticated
+	Recording        *common.RecorderOptions // nil when recording is disabled
+	Handover         common.ByeRedirect      // Redirect sent to clients upon shutdown
+	Keepalive        KeepaliveConfig
+	Routing          RoutingConfig
+	DedupeWindow     time.Duration
+	PresenceInterval time.Duration // Zero disables presence announcements
+}
+
+// RoutingConfig determines where routing rules are loaded from, and how often
+// they are checked for changes. An empty File disables routing, and a zero
+// ReloadInterval disables reloading.
+type RoutingConfig struct {
+	File           string
+	ReloadInterval time.Duration
+}
+
+// KeepaliveConfig determines how often clients are sent PING messages, and
+// after how many consecutive unanswered ones they are disconnected. A zero
+// Interval disables keepalive.
+type KeepaliveConfig struct {
+	Interval  time.Duration
+	MaxMissed int
+}
+
+// QuotaConfig holds limits enforced on clients and namespaces. Zero values
+// disable their respective limits.
+type QuotaConfig struct {
+	NamespaceMaxClients int
+	NamespaceMaxPPS     int
+	NamespaceMaxBPS     int
+	ClientMaxPPS        int
+	ClientMaxBPS        int
+	DisconnectAfter     time.Duration
 }
 
 type NATSConfig struct {
@@ -72,6 +143,97 @@ func (a *AllOptions) IntoContext() (*Context, error) {
 		Debug:       a.Debug != nil && *a.Debug,
 	}
 
+	if a.DrainTimeout != nil {
+		ctx.DrainTimeout = *a.DrainTimeout
+	}
+
+	if a.MetricsBind != nil {
+		ctx.MetricsBind = *a.MetricsBind
+	}
+
+	if a.AdminBind != nil {
+		ctx.AdminBind = *a.AdminBind
+	}
+	if a.AdminToken != nil {
+		ctx.AdminToken = *a.AdminToken
+	}
+	if ctx.AdminBind != "" && ctx.AdminToken == "" && !isLoopbackBind(ctx.AdminBind) {
+		return nil, fmt.Errorf("--admin-bind %s is not a loopback address: define --admin-token to expose the admin API", ctx.AdminBind)
+	}
+
+	if a.KeepaliveInterval != nil {
+		ctx.Keepalive.Interval = *a.KeepaliveInterval
+	}
+	if a.KeepaliveMaxMissed != nil {
+		if *a.KeepaliveMaxMissed < 1 {
+			return nil, fmt.Errorf("--keepalive-max-missed must be at least 1")
+		}
+		ctx.Keepalive.MaxMissed = *a.KeepaliveMaxMissed
+	}
+
+	if a.DedupeWindow != nil {
+		ctx.DedupeWindow = *a.DedupeWindow
+	}
+
+	if a.PresenceInterval != nil {
+		ctx.PresenceInterval = *a.PresenceInterval
+	}
+
+	if a.RoutesFile != nil {
+		path, err := a.RoutesFile.Clean()
+		if err != nil {
+			return nil, err
+		}
+		ctx.Routing.File = path
+	}
+	if a.RoutesReloadInterval != nil {
+		ctx.Routing.ReloadInterval = *a.RoutesReloadInterval
+	}
+
+	anyButMe := a.HandoverAnyButMe != nil && *a.HandoverAnyButMe
+	if a.HandoverAddress != nil && anyButMe {
+		return nil, fmt.Errorf("define either --handover-address or --handover-any-but-me, not both")
+	}
+	if a.HandoverAddress != nil {
+		ctx.Handover = common.ByeRedirect{Kind: common.ByeRedirectAddress, Address: *a.HandoverAddress}
+	} else if anyButMe {
+		ctx.Handover = common.ByeRedirect{Kind: common.ByeRedirectAnyButMe}
+	}
+
+	quotas := []struct {
+		name   string
+		value  *int
+		target *int
+	}{
+		{"namespace-max-clients", a.NamespaceMaxClients, &ctx.Quotas.NamespaceMaxClients},
+		{"namespace-max-pps", a.NamespaceMaxPPS, &ctx.Quotas.NamespaceMaxPPS},
+		{"namespace-max-bps", a.NamespaceMaxBPS, &ctx.Quotas.NamespaceMaxBPS},
+		{"client-max-pps", a.ClientMaxPPS, &ctx.Quotas.ClientMaxPPS},
+		{"client-max-bps", a.ClientMaxBPS, &ctx.Quotas.ClientMaxBPS},
+	}
+	for _, q := range quotas {
+		if q.value == nil {
+			continue
+		}
+		if *q.value < 0 {
+			return nil, fmt.Errorf("--%s must not be negative", q.name)
+		}
+		*q.target = *q.value
+	}
+	if a.QuotaDisconnectAfter != nil {
+		ctx.Quotas.DisconnectAfter = *a.QuotaDisconnectAfter
+	}
+
+	if a.RecordDir != nil {
+		ctx.Recording = &common.RecorderOptions{
+			Dir:         *a.RecordDir,
+			Prefix:      "udpfw-dispatch",
+			Application: "udpfw-dispatch",
+			MaxFileSize: int64(*a.RecordMaxFileSize),
+			MaxFiles:    *a.RecordMaxFiles,
+		}
+	}
+
 	if a.NatsURL != nil {
 		if a.NatsUserCredentials == nil && a.NatsUserCredentialsNKey != nil {
 			return nil, fmt.Errorf("--nats-user-credentials-nkey must be used with --nats-user-credentials")
@@ -159,3 +321,17 @@ func (a *AllOptions) IntoContext() (*Context, error) {
 
 	return &ctx, nil
 }
+
+// isLoopbackBind determines whether a bind address only accepts connections
+// from the local host. Addresses without a host bind to all interfaces.
+func isLoopbackBind(bind string) bool {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
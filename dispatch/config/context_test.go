@@ -3,7 +3,11 @@ package config
 import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func getOptsError(t *testing.T, opts ...OptionFn) error {
@@ -32,4 +36,107 @@ func TestAllOptions_IntoContext(t *testing.T) {
 		o := getOpts(t, WithAnyBind(), WithNatsURL("test"))
 		assert.Equal(t, "test", o.PubSubService.(*NATSConfig).URL)
 	})
+
+	t.Run("with quotas", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL(),
+			WithClientMaxPPS("100"),
+			WithNamespaceMaxClients("5"),
+			WithQuotaDisconnectAfter("30s"))
+		assert.Equal(t, 100, o.Quotas.ClientMaxPPS)
+		assert.Equal(t, 5, o.Quotas.NamespaceMaxClients)
+		assert.Zero(t, o.Quotas.NamespaceMaxPPS)
+		assert.Equal(t, 30*time.Second, o.Quotas.DisconnectAfter)
+	})
+
+	t.Run("with loopback admin bind", func(t *testing.T) {
+		for _, bind := range []string{"127.0.0.1:8081", "[::1]:8081", "localhost:8081"} {
+			o := getOpts(t, WithAnyBind(), WithAnyNatsURL(), WithAdminBind(bind))
+			assert.Equal(t, bind, o.AdminBind)
+			assert.Empty(t, o.AdminToken)
+		}
+	})
+
+	t.Run("with exposed admin bind", func(t *testing.T) {
+		for _, bind := range []string{":8081", "0.0.0.0:8081", "10.0.0.1:8081", "dispatch:8081"} {
+			err := getOptsError(t, WithAnyBind(), WithAnyNatsURL(), WithAdminBind(bind))
+			assert.ErrorContains(t, err, "--admin-token", bind)
+		}
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL(), WithAdminBind(":8081"), WithAdminToken("secret"))
+		assert.Equal(t, "secret", o.AdminToken)
+	})
+
+	t.Run("with default quota disconnect duration", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL())
+		assert.Equal(t, 10*time.Second, o.Quotas.DisconnectAfter)
+	})
+
+	t.Run("with negative quota", func(t *testing.T) {
+		err := getOptsError(t, WithAnyBind(), WithAnyNatsURL(), WithClientMaxBPS("-1"))
+		assert.ErrorContains(t, err, "must not be negative")
+	})
+
+	t.Run("with recording", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL(), WithRecordDir("/tmp/rec"), WithRecordMaxFiles("3"))
+		require.NotNil(t, o.Recording)
+		assert.Equal(t, "/tmp/rec", o.Recording.Dir)
+		assert.Equal(t, 3, o.Recording.MaxFiles)
+		assert.Equal(t, int64(64*1024*1024), o.Recording.MaxFileSize)
+	})
+
+	t.Run("without recording", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL())
+		assert.Nil(t, o.Recording)
+	})
+
+	t.Run("with handover address", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL(), WithHandoverAddress("dispatch-1:3030"))
+		assert.Equal(t, common.ByeRedirect{Kind: common.ByeRedirectAddress, Address: "dispatch-1:3030"}, o.Handover)
+	})
+
+	t.Run("with any-but-me handover", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL(), WithHandoverAnyButMe())
+		assert.Equal(t, common.ByeRedirectAnyButMe, o.Handover.Kind)
+	})
+
+	t.Run("with both handover modes", func(t *testing.T) {
+		err := getOptsError(t, WithAnyBind(), WithAnyNatsURL(), WithAnyHandoverAddress(), WithHandoverAnyButMe())
+		assert.ErrorContains(t, err, "define either --handover-address")
+	})
+
+	t.Run("with default keepalive", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL())
+		assert.Equal(t, KeepaliveConfig{Interval: 15 * time.Second, MaxMissed: 3}, o.Keepalive)
+	})
+
+	t.Run("with invalid keepalive max missed", func(t *testing.T) {
+		err := getOptsError(t, WithAnyBind(), WithAnyNatsURL(), WithKeepaliveMaxMissed("0"))
+		assert.ErrorContains(t, err, "--keepalive-max-missed must be at least 1")
+	})
+
+	t.Run("with default dedupe window", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL())
+		assert.Zero(t, o.DedupeWindow)
+	})
+
+	t.Run("with default presence interval", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL())
+		assert.Equal(t, 10*time.Second, o.PresenceInterval)
+	})
+
+	t.Run("with presence disabled", func(t *testing.T) {
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL(), WithPresenceInterval("0s"))
+		assert.Zero(t, o.PresenceInterval)
+	})
+
+	t.Run("with routes file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "routes.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"routes":[]}`), 0o600))
+		o := getOpts(t, WithAnyBind(), WithAnyNatsURL(), WithRoutesFile(path))
+		assert.Equal(t, RoutingConfig{File: path, ReloadInterval: 10 * time.Second}, o.Routing)
+	})
+
+	t.Run("with missing routes file", func(t *testing.T) {
+		err := getOptsError(t, WithAnyBind(), WithAnyNatsURL(), WithRoutesFile(filepath.Join(t.TempDir(), "missing.json")))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
 }
@@ -30,9 +30,13 @@ func makeOptions(t *testing.T, opts ...OptionFn) *AllOptions {
 	return &appOpts
 }
 
-func WithBind(v string) OptionFn    { return func() []string { return []string{"--bind", v} } }
-func WithAnyBind() OptionFn         { return WithBind("foo") }
-func WithDebug() OptionFn           { return func() []string { return []string{"--debug"} } }
+func WithBind(v string) OptionFn { return func() []string { return []string{"--bind", v} } }
+func WithAnyBind() OptionFn      { return WithBind("foo") }
+func WithDebug() OptionFn        { return func() []string { return []string{"--debug"} } }
+func WithDrainTimeout(v string) OptionFn {
+	return func() []string { return []string{"--drain-timeout", v} }
+}
+func WithAnyDrainTimeout() OptionFn { return WithDrainTimeout("1s") }
 func WithNatsURL(v string) OptionFn { return func() []string { return []string{"--nats-url", v} } }
 func WithAnyNatsURL() OptionFn      { return WithNatsURL("foo") }
 func WithNatsSubscriptionSubject(v string) OptionFn {
@@ -69,3 +73,78 @@ func WithRedisPubsubChannel(v string) OptionFn {
 	return func() []string { return []string{"--redis-pubsub-channel", v} }
 }
 func WithAnyRedisPubsubChannel() OptionFn { return WithRedisPubsubChannel("foo") }
+func WithNamespaceMaxClients(v string) OptionFn {
+	return func() []string { return []string{"--namespace-max-clients", v} }
+}
+func WithAnyNamespaceMaxClients() OptionFn { return WithNamespaceMaxClients("1") }
+func WithNamespaceMaxPPS(v string) OptionFn {
+	return func() []string { return []string{"--namespace-max-pps", v} }
+}
+func WithAnyNamespaceMaxPPS() OptionFn { return WithNamespaceMaxPPS("1") }
+func WithNamespaceMaxBPS(v string) OptionFn {
+	return func() []string { return []string{"--namespace-max-bps", v} }
+}
+func WithAnyNamespaceMaxBPS() OptionFn { return WithNamespaceMaxBPS("1") }
+func WithClientMaxPPS(v string) OptionFn {
+	return func() []string { return []string{"--client-max-pps", v} }
+}
+func WithAnyClientMaxPPS() OptionFn { return WithClientMaxPPS("1") }
+func WithClientMaxBPS(v string) OptionFn {
+	return func() []string { return []string{"--client-max-bps", v} }
+}
+func WithAnyClientMaxBPS() OptionFn { return WithClientMaxBPS("1") }
+func WithQuotaDisconnectAfter(v string) OptionFn {
+	return func() []string { return []string{"--quota-disconnect-after", v} }
+}
+func WithAnyQuotaDisconnectAfter() OptionFn { return WithQuotaDisconnectAfter("1s") }
+func WithRecordDir(v string) OptionFn       { return func() []string { return []string{"--record-dir", v} } }
+func WithAnyRecordDir() OptionFn            { return WithRecordDir("foo") }
+func WithRecordMaxFileSize(v string) OptionFn {
+	return func() []string { return []string{"--record-max-file-size", v} }
+}
+func WithAnyRecordMaxFileSize() OptionFn { return WithRecordMaxFileSize("1") }
+func WithRecordMaxFiles(v string) OptionFn {
+	return func() []string { return []string{"--record-max-files", v} }
+}
+func WithAnyRecordMaxFiles() OptionFn { return WithRecordMaxFiles("1") }
+func WithMetricsBind(v string) OptionFn {
+	return func() []string { return []string{"--metrics-bind", v} }
+}
+func WithAnyMetricsBind() OptionFn { return WithMetricsBind("foo") }
+func WithHandoverAddress(v string) OptionFn {
+	return func() []string { return []string{"--handover-address", v} }
+}
+func WithAnyHandoverAddress() OptionFn { return WithHandoverAddress("foo") }
+func WithHandoverAnyButMe() OptionFn {
+	return func() []string { return []string{"--handover-any-but-me"} }
+}
+func WithKeepaliveInterval(v string) OptionFn {
+	return func() []string { return []string{"--keepalive-interval", v} }
+}
+func WithAnyKeepaliveInterval() OptionFn { return WithKeepaliveInterval("1s") }
+func WithKeepaliveMaxMissed(v string) OptionFn {
+	return func() []string { return []string{"--keepalive-max-missed", v} }
+}
+func WithAnyKeepaliveMaxMissed() OptionFn { return WithKeepaliveMaxMissed("1") }
+func WithAdminBind(v string) OptionFn     { return func() []string { return []string{"--admin-bind", v} } }
+func WithAnyAdminBind() OptionFn          { return WithAdminBind("foo") }
+func WithAdminToken(v string) OptionFn {
+	return func() []string { return []string{"--admin-token", v} }
+}
+func WithAnyAdminToken() OptionFn { return WithAdminToken("foo") }
+func WithDedupeWindow(v string) OptionFn {
+	return func() []string { return []string{"--dedupe-window", v} }
+}
+func WithAnyDedupeWindow() OptionFn { return WithDedupeWindow("1s") }
+func WithPresenceInterval(v string) OptionFn {
+	return func() []string { return []string{"--presence-interval", v} }
+}
+func WithAnyPresenceInterval() OptionFn { return WithPresenceInterval("1s") }
+func WithRoutesFile(v string) OptionFn {
+	return func() []string { return []string{"--routes-file", v} }
+}
+func WithAnyRoutesFile() OptionFn { return WithRoutesFile("foo") }
+func WithRoutesReloadInterval(v string) OptionFn {
+	return func() []string { return []string{"--routes-reload-interval", v} }
+}
+func WithAnyRoutesReloadInterval() OptionFn { return WithRoutesReloadInterval("1s") }
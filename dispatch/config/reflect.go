@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var stringPtr = reflect.TypeOf((*string)(nil))
 var filePathPtr = reflect.TypeOf((*FilePath)(nil))
 var boolPtr = reflect.TypeOf((*bool)(nil))
+var intPtr = reflect.TypeOf((*int)(nil))
+var durationPtr = reflect.TypeOf((*time.Duration)(nil))
 
 func getField(v reflect.StructField, name string) (string, error) {
 	value, ok := v.Tag.Lookup(name)
@@ -60,6 +64,36 @@ func makeCLIFlagsFrom[T any]() ([]cli.Flag, error) {
 				Required: field.Type.Kind() == reflect.String,
 				Value:    value == "true",
 			}
+		} else if isDuration(field.Type) {
+			var defaultValue time.Duration
+			if value != "" {
+				if defaultValue, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("BUG: AllOptions field %s has invalid default value: %w", field.Name, err)
+				}
+			}
+			arg = &cli.DurationFlag{
+				Name:     name,
+				Category: category,
+				Usage:    usage,
+				EnvVars:  envNamed(env),
+				Required: field.Type.Kind() == reflect.Int64,
+				Value:    defaultValue,
+			}
+		} else if isInt(field.Type) {
+			var defaultValue int
+			if value != "" {
+				if defaultValue, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("BUG: AllOptions field %s has invalid default value: %w", field.Name, err)
+				}
+			}
+			arg = &cli.IntFlag{
+				Name:     name,
+				Category: category,
+				Usage:    usage,
+				EnvVars:  envNamed(env),
+				Required: field.Type.Kind() == reflect.Int,
+				Value:    defaultValue,
+			}
 		} else {
 			strArg := &cli.StringFlag{
 				Name:        name,
@@ -121,6 +155,20 @@ func OptionsFrom(ctx *cli.Context) (AllOptions, error) {
 			} else if targetField.Kind() == reflect.Bool {
 				value = reflect.ValueOf(rawValue)
 			}
+		} else if isDuration(targetField.Type()) {
+			rawValue := ctx.Duration(name)
+			if targetField.Type() == durationPtr {
+				value = reflect.ValueOf(&rawValue)
+			} else {
+				value = reflect.ValueOf(rawValue)
+			}
+		} else if isInt(targetField.Type()) {
+			rawValue := ctx.Int(name)
+			if targetField.Type() == intPtr {
+				value = reflect.ValueOf(&rawValue)
+			} else {
+				value = reflect.ValueOf(rawValue)
+			}
 		} else {
 			panic("Not implemented")
 		}
@@ -140,3 +188,13 @@ func isBool(t reflect.Type) bool {
 	return t == boolPtr ||
 		t.Kind() == reflect.Bool
 }
+
+func isDuration(t reflect.Type) bool {
+	return t == durationPtr ||
+		t == durationPtr.Elem()
+}
+
+func isInt(t reflect.Type) bool {
+	return t == intPtr ||
+		t.Kind() == reflect.Int
+}
@@ -0,0 +1,227 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/udpfw/dispatch/tcp"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminShutdownTimeout is the time in-flight admin requests are given to
+// complete upon shutdown before their connections are closed.
+const adminShutdownTimeout = time.Second
+
+// adminHandler exposes the state of the TCP server and operations on it over
+// HTTP. Operations are triggered through POST requests, taking their
+// arguments as query parameters. Requests must carry the configured admin
+// token, if any, as a bearer token.
+func (s *Daemon) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", s.adminGet(func(r *http.Request) (any, error) {
+		return s.tcp.Clients(), nil
+	}))
+	mux.HandleFunc("/clients/disconnect", s.adminPost(func(r *http.Request) (any, error) {
+		id, err := requireParam(r, "id")
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.tcp.DisconnectClient(id)
+	}))
+	mux.HandleFunc("/clients/move", s.adminPost(func(r *http.Request) (any, error) {
+		id, err := requireParam(r, "id")
+		if err != nil {
+			return nil, err
+		}
+		ns, err := requireParam(r, "namespace")
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.tcp.MoveClient(id, r.URL.Query().Get("from"), ns)
+	}))
+	mux.HandleFunc("/namespaces", s.adminGet(func(r *http.Request) (any, error) {
+		return s.tcp.Namespaces(), nil
+	}))
+	mux.HandleFunc("/namespaces/tail", s.adminTail)
+	mux.HandleFunc("/namespaces/pause", s.adminPost(func(r *http.Request) (any, error) {
+		ns, err := requireParam(r, "namespace")
+		if err != nil {
+			return nil, err
+		}
+		s.tcp.PauseNamespace(ns)
+		return nil, nil
+	}))
+	mux.HandleFunc("/namespaces/resume", s.adminPost(func(r *http.Request) (any, error) {
+		ns, err := requireParam(r, "namespace")
+		if err != nil {
+			return nil, err
+		}
+		s.tcp.ResumeNamespace(ns)
+		return nil, nil
+	}))
+	mux.HandleFunc("/cluster/clients", s.adminGet(func(r *http.Request) (any, error) {
+		return s.tcp.ClusterClients(), nil
+	}))
+	mux.HandleFunc("/cluster/namespaces", s.adminGet(func(r *http.Request) (any, error) {
+		return s.tcp.ClusterNamespaces(), nil
+	}))
+	mux.HandleFunc("/routes", s.adminGet(func(r *http.Request) (any, error) {
+		if table := s.tcp.RoutingTable(); table != nil {
+			return table, nil
+		}
+		return tcp.RoutingTable{Routes: []tcp.Route{}}, nil
+	}))
+	mux.HandleFunc("/routes/reload", s.adminPost(func(r *http.Request) (any, error) {
+		if s.ctx.Routing.File == "" {
+			return nil, adminError{http.StatusConflict, "routing is disabled"}
+		}
+		if err := s.reloadRoutes(); err != nil {
+			return nil, adminError{http.StatusBadRequest, err.Error()}
+		}
+		return s.tcp.RoutingTable(), nil
+	}))
+	mux.HandleFunc("/drain", s.adminPost(func(r *http.Request) (any, error) {
+		s.log.Info("Drain requested through admin API")
+		go s.Shutdown()
+		return nil, nil
+	}))
+	if s.ctx.AdminToken == "" {
+		return mux
+	}
+	return requireToken(s.ctx.AdminToken, mux)
+}
+
+// requireToken rejects requests not carrying the provided bearer token in
+// their Authorization header.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminTail streams frames forwarded on a namespace as newline-delimited
+// JSON, until the request is cancelled.
+func (s *Daemon) adminTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	ns, err := requireParam(r, "namespace")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	frames, release := s.tcp.Tap(ns)
+	defer release()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case f := <-frames:
+			if err := enc.Encode(f); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func (s *Daemon) serveAdmin() {
+	s.log.Info("Serving admin API",
+		zap.String("address", s.ctx.AdminBind),
+		zap.Bool("authenticated", s.ctx.AdminToken != ""))
+	if err := s.admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.log.Error("Admin server failed", zap.Error(err))
+	}
+}
+
+// shutdownAdmin stops the admin server, closing connections of requests
+// still in flight after adminShutdownTimeout, such as tail streams.
+func (s *Daemon) shutdownAdmin() {
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	if err := s.admin.Shutdown(ctx); err != nil {
+		_ = s.admin.Close()
+	}
+}
+
+type adminError struct {
+	status int
+	msg    string
+}
+
+func (e adminError) Error() string { return e.msg }
+
+func requireParam(r *http.Request, name string) (string, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return "", adminError{http.StatusBadRequest, "missing parameter " + name}
+	}
+	return v, nil
+}
+
+func (s *Daemon) adminGet(fn func(r *http.Request) (any, error)) http.HandlerFunc {
+	return s.adminMethod(http.MethodGet, fn)
+}
+
+func (s *Daemon) adminPost(fn func(r *http.Request) (any, error)) http.HandlerFunc {
+	return s.adminMethod(http.MethodPost, fn)
+}
+
+func (s *Daemon) adminMethod(method string, fn func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		result, err := fn(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var aErr adminError
+			switch {
+			case errors.As(err, &aErr):
+				status = aErr.status
+			case errors.Is(err, tcp.UnknownClientErr):
+				status = http.StatusNotFound
+			case errors.Is(err, tcp.AmbiguousMoveErr), errors.Is(err, tcp.NotMemberErr):
+				status = http.StatusBadRequest
+			case errors.Is(err, tcp.HandshakePendingErr), errors.Is(err, tcp.NamespaceFullErr):
+				status = http.StatusConflict
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		if result == nil {
+			result = map[string]bool{"ok": true}
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
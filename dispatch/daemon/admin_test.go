@@ -0,0 +1,31 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/udpfw/dispatch/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler_Token(t *testing.T) {
+	d := New(&config.Context{AdminToken: "secret"})
+	handler := d.adminHandler()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret", "Basic secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+		assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"), auth)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 func Boot(cliCtx *cli.Context) error {
@@ -17,9 +18,12 @@ func Boot(cliCtx *cli.Context) error {
 		return cli.Exit(err, 1)
 	}
 
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, os.Interrupt)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	srv := New(ctx)
 	go srv.ArmShutdown(sigChan)
-	return srv.Run()
+	if err = srv.Run(); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return nil
 }
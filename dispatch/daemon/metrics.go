@@ -0,0 +1,16 @@
+package daemon
+
+import (
+	"expvar"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+func (s *Daemon) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	s.log.Info("Serving metrics", zap.String("address", s.ctx.MetricsBind))
+	if err := http.ListenAndServe(s.ctx.MetricsBind, mux); err != nil {
+		s.log.Error("Metrics server failed", zap.Error(err))
+	}
+}
@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/udpfw/dispatch/tcp"
+	"go.uber.org/zap"
+	"os"
+	"time"
+)
+
+// reloadRoutes loads the routing table from the configured file and applies
+// it to the TCP server. The previous table is kept in case loading fails.
+func (s *Daemon) reloadRoutes() error {
+	table, err := tcp.LoadRoutingTable(s.ctx.Routing.File)
+	if err != nil {
+		return fmt.Errorf("failed loading routes from %s: %w", s.ctx.Routing.File, err)
+	}
+	s.tcp.SetRoutingTable(table)
+	s.log.Info("Loaded routing table",
+		zap.String("file", s.ctx.Routing.File),
+		zap.Int("routes", len(table.Routes)))
+	return nil
+}
+
+// watchRoutes reloads the routing table whenever the routes file is modified,
+// checking it every configured interval until the daemon stops.
+func (s *Daemon) watchRoutes() {
+	path := s.ctx.Routing.File
+	var lastMod time.Time
+	var lastSize int64
+	if stat, err := os.Stat(path); err == nil {
+		lastMod, lastSize = stat.ModTime(), stat.Size()
+	}
+
+	ticker := time.NewTicker(s.ctx.Routing.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			s.log.Warn("Failed checking routes file", zap.String("file", path), zap.Error(err))
+			continue
+		}
+		if stat.ModTime().Equal(lastMod) && stat.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = stat.ModTime(), stat.Size()
+		if err = s.reloadRoutes(); err != nil {
+			s.log.Error("Keeping previous routing table", zap.Error(err))
+		}
+	}
+}
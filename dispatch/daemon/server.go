@@ -2,11 +2,13 @@ package daemon
 
 import (
 	"errors"
+	"expvar"
 	"fmt"
 	"github.com/udpfw/dispatch/config"
 	"github.com/udpfw/dispatch/pubsub"
 	"github.com/udpfw/dispatch/tcp"
 	"go.uber.org/zap"
+	"net/http"
 	"os"
 	"sync/atomic"
 )
@@ -26,14 +28,19 @@ type Daemon struct {
 	ctx      *config.Context
 	ps       pubsub.PubSub
 	tcp      *tcp.Server
+	admin    *http.Server // nil when the admin API is not exposed
 	log      *zap.Logger
 	stopping *atomic.Bool
 	stopped  chan bool
+
+	// shutdownErr holds the reason Shutdown did not complete cleanly, and is
+	// only read after stopped is closed.
+	shutdownErr error
 }
 
 func (s *Daemon) ArmShutdown(sigChan chan os.Signal) {
-	<-sigChan
-	s.log.Info("Received shutdown signal. Notifying clients and draining queues...")
+	sig := <-sigChan
+	s.log.Info("Received shutdown signal. Notifying clients and draining queues...", zap.Stringer("signal", sig))
 	s.Shutdown()
 }
 
@@ -42,12 +49,19 @@ func (s *Daemon) Shutdown() {
 		return
 	}
 
-	s.tcp.Shutdown()
+	if err := s.tcp.Shutdown(); err != nil {
+		s.log.Error("TCP shutdown did not complete cleanly", zap.Error(err))
+		s.shutdownErr = err
+	}
 	s.log.Info("TCP shutdown completed. Now draining queues...")
 	if err := s.ps.Shutdown(); err != nil {
 		s.log.Error("CRITICAL: PubSub shutdown failed", zap.Error(err))
+		s.shutdownErr = err
 	}
 	s.log.Info("Drain complete")
+	if s.admin != nil {
+		s.shutdownAdmin()
+	}
 	s.log.Info("Bye!")
 	close(s.stopped)
 }
@@ -85,6 +99,29 @@ func (s *Daemon) Run() error {
 	}
 	s.tcp = srv
 
+	if s.ctx.Routing.File != "" {
+		if err = s.reloadRoutes(); err != nil {
+			log.Error("Failed loading routing table", zap.Error(err))
+			_ = srv.Shutdown()
+			if err := ps.Shutdown(); err != nil {
+				log.Error("Failed shutting-down PubSub after previous failure", zap.Error(err))
+			}
+			return err
+		}
+		if s.ctx.Routing.ReloadInterval > 0 {
+			go s.watchRoutes()
+		}
+	}
+
+	expvar.Publish("tcp", expvar.Func(func() any { return srv.Stats() }))
+	if s.ctx.MetricsBind != "" {
+		go s.serveMetrics()
+	}
+	if s.ctx.AdminBind != "" {
+		s.admin = &http.Server{Addr: s.ctx.AdminBind, Handler: s.adminHandler()}
+		go s.serveAdmin()
+	}
+
 	log.Info("Now listening", zap.String("address", s.ctx.BindAddress))
 
 	if err = srv.Run(); err != nil {
@@ -92,5 +129,5 @@ func (s *Daemon) Run() error {
 	}
 	s.Shutdown()
 	<-s.stopped
-	return nil
+	return s.shutdownErr
 }
@@ -4,6 +4,17 @@ import "encoding/binary"
 
 const sourceLength = 22
 
+// instanceLength is the length of the identifier of the dispatch instance
+// emitting a packet. It trails the payload so older instances, which ignore
+// trailing bytes, remain able to decode packets carrying it, and is followed
+// by the payload hash.
+const instanceLength = 22
+
+// hashLength is the length of the payload hash trailing the instance
+// identifier. The hash may be followed by the fan-out list, composed by
+// length-prefixed namespaces.
+const hashLength = 8
+
 type PacketData []byte
 
 func (p PacketData) Source() string { return string(p[0:sourceLength]) }
@@ -25,20 +36,68 @@ func (p PacketData) Payload() []byte {
 	return p[offset : offset+p.PayloadLength()]
 }
 
+// Instance returns the identifier of the dispatch instance which emitted the
+// packet, or an empty string in case it was emitted by an instance not
+// providing one.
+func (p PacketData) Instance() string {
+	offset := sourceLength + 2 + p.NamespaceLength() + 2 + p.PayloadLength()
+	if len(p) < offset+instanceLength {
+		return ""
+	}
+	return string(p[offset : offset+instanceLength])
+}
+
+// Hash returns the hash of the frame carried by the packet, used to suppress
+// duplicates, or zero in case none was provided, such as in packets published
+// by instances predating duplicate suppression.
+func (p PacketData) Hash() uint64 {
+	offset := sourceLength + 2 + p.NamespaceLength() + 2 + p.PayloadLength() + instanceLength
+	if len(p) < offset+hashLength {
+		return 0
+	}
+	return binary.BigEndian.Uint64(p[offset:])
+}
+
+// FanOut returns all namespaces the frame carried by the packet was published
+// on, in the order its emitter delivered it, or nil in case it was published
+// on a single namespace. Each of them is published as a distinct packet.
+func (p PacketData) FanOut() []string {
+	offset := sourceLength + 2 + p.NamespaceLength() + 2 + p.PayloadLength() + instanceLength + hashLength
+	var namespaces []string
+	for offset+2 <= len(p) {
+		nsLen := int(binary.BigEndian.Uint16(p[offset:]))
+		offset += 2
+		if offset+nsLen > len(p) {
+			return nil
+		}
+		namespaces = append(namespaces, string(p[offset:offset+nsLen]))
+		offset += nsLen
+	}
+	return namespaces
+}
+
 func (p PacketData) Deconstruct() (source string, namespace string, payload []byte) {
 	return p.Source(), p.Namespace(), p.Payload()
 }
 
-func MakePacket(source string, ns string, payload []byte) PacketData {
+func MakePacket(instance string, source string, ns string, payload []byte, hash uint64, fanOut []string) PacketData {
 	sourceLen := len(source)
 	if sourceLen != sourceLength {
 		panic("Source must have 22 bytes")
 	}
+	if len(instance) != instanceLength {
+		panic("Instance must have 22 bytes")
+	}
 
 	nsLen := len(ns)
 	payloadLen := len(payload)
 
-	packet := make([]byte, sourceLen+nsLen+payloadLen+4)
+	fanOutLen := 0
+	for _, n := range fanOut {
+		fanOutLen += 2 + len(n)
+	}
+
+	packet := make([]byte, sourceLen+nsLen+payloadLen+4+instanceLength+hashLength+fanOutLen)
 	cursor := 0
 	copy(packet, source)
 	cursor += sourceLen
@@ -53,5 +112,19 @@ func MakePacket(source string, ns string, payload []byte) PacketData {
 	cursor += 2
 
 	copy(packet[cursor:], payload)
+	cursor += payloadLen
+
+	copy(packet[cursor:], instance)
+	cursor += instanceLength
+
+	binary.BigEndian.PutUint64(packet[cursor:], hash)
+	cursor += hashLength
+
+	for _, n := range fanOut {
+		binary.BigEndian.PutUint16(packet[cursor:], uint16(len(n)))
+		cursor += 2
+		copy(packet[cursor:], n)
+		cursor += len(n)
+	}
 	return packet
 }
@@ -6,12 +6,32 @@ import (
 )
 
 var src = "0123456789ABCDEFGHIJKL"
+var instance = "LKJIHGFEDCBA9876543210"
 
 func TestMakePacket(t *testing.T) {
-	packet := MakePacket(src, "ns", []byte("payload"))
+	packet := MakePacket(instance, src, "ns", []byte("payload"), 42, nil)
+	assert.Equal(t, instance, packet.Instance())
+	assert.Equal(t, uint64(42), packet.Hash())
 	assert.Equal(t, src, packet.Source())
 	assert.Equal(t, 2, packet.NamespaceLength())
 	assert.Equal(t, "ns", packet.Namespace())
 	assert.Equal(t, 7, packet.PayloadLength())
 	assert.Equal(t, []byte("payload"), packet.Payload())
+	assert.Nil(t, packet.FanOut())
+}
+
+func TestPacketData_LegacyInstance(t *testing.T) {
+	packet := MakePacket(instance, src, "ns", []byte("payload"), 42, nil)
+	legacy := packet[:len(packet)-instanceLength-hashLength]
+	assert.Empty(t, legacy.Instance())
+	assert.Zero(t, legacy.Hash())
+	assert.Equal(t, []byte("payload"), legacy.Payload())
+}
+
+func TestPacketData_FanOut(t *testing.T) {
+	packet := MakePacket(instance, src, "b", []byte("payload"), 42, []string{"a", "b"})
+	assert.Equal(t, "b", packet.Namespace())
+	assert.Equal(t, uint64(42), packet.Hash())
+	assert.Equal(t, []string{"a", "b"}, packet.FanOut())
+	assert.Nil(t, packet[:len(packet)-1].FanOut(), "truncated")
 }
@@ -0,0 +1,148 @@
+package tcp
+
+import (
+	"fmt"
+	"github.com/udpfw/common"
+	"go.uber.org/zap"
+	"sort"
+	"time"
+)
+
+var (
+	UnknownClientErr    = fmt.Errorf("unknown client")
+	HandshakePendingErr = fmt.Errorf("client did not complete its handshake")
+	NamespaceFullErr    = fmt.Errorf("namespace is full")
+	AmbiguousMoveErr    = fmt.Errorf("client is a member of several namespaces")
+	NotMemberErr        = fmt.Errorf("client is not a member of the namespace")
+)
+
+// NamespaceInfo describes a namespace known to this instance, either for
+// having local clients or for being paused. Traffic counters are summed over
+// clients currently connected to the namespace, and clients joining several
+// namespaces are accounted for in each of them.
+type NamespaceInfo struct {
+	Name       string   `json:"name"`
+	Clients    []string `json:"clients"`
+	Paused     bool     `json:"paused"`
+	RxMessages uint64   `json:"rx_messages"`
+	RxBytes    uint64   `json:"rx_bytes"`
+	TxMessages uint64   `json:"tx_messages"`
+	TxBytes    uint64   `json:"tx_bytes"`
+}
+
+// Namespaces returns information about namespaces with local clients, along
+// with paused namespaces.
+func (s *Server) Namespaces() []NamespaceInfo {
+	names := map[string]bool{}
+	for _, ns := range s.namespaces.Keys() {
+		names[ns] = true
+	}
+	s.paused.Range(func(key, _ any) bool {
+		names[key.(string)] = true
+		return true
+	})
+
+	result := make([]NamespaceInfo, 0, len(names))
+	for ns := range names {
+		info := NamespaceInfo{Name: ns, Clients: []string{}, Paused: s.isPaused(ns)}
+		for _, c := range s.namespaces.Get(ns) {
+			info.Clients = append(info.Clients, c.id)
+			info.RxMessages += c.rxMessages.Load()
+			info.RxBytes += c.rxBytes.Load()
+			info.TxMessages += c.txMessages.Load()
+			info.TxBytes += c.txBytes.Load()
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// DisconnectClient asks a client to disconnect, closing its connection once
+// the request is written.
+func (s *Server) DisconnectClient(id string) error {
+	c, ok := s.clients.Get(id)
+	if !ok {
+		return UnknownClientErr
+	}
+	c.log.Info("Disconnecting client upon administrative request")
+	if c.hello.Load() == nil {
+		c.drop()
+		return nil
+	}
+	c.disconnect(common.ByeReasonAdministrative)
+	return nil
+}
+
+// MoveClient moves a client from one of its namespaces to another one. The
+// namespace to move from may be empty for clients that are a member of a
+// single namespace. Groups advertised by the client are withdrawn from its
+// previous namespace and advertised on the new one.
+func (s *Server) MoveClient(id, from, to string) error {
+	c, ok := s.clients.Get(id)
+	if !ok {
+		return UnknownClientErr
+	}
+	current := s.namespaces.Memberships(c)
+	if len(current) == 0 {
+		return HandshakePendingErr
+	}
+	if from == "" {
+		if len(current) > 1 {
+			return AmbiguousMoveErr
+		}
+		from = current[0]
+	} else if !s.namespaces.IsMember(from, c) {
+		return NotMemberErr
+	}
+	if from == to {
+		return nil
+	}
+	if s.namespaces.IsMember(to, c) {
+		// Already a member of the destination; just leave the origin.
+		s.leaveNamespace(c, from)
+		return nil
+	}
+	if !s.namespaces.AddLimited(to, c, s.quotas.config.NamespaceMaxClients) {
+		return NamespaceFullErr
+	}
+	s.leaveNamespace(c, from)
+
+	if groups := c.groups.Load(); groups != nil {
+		list := groups.List()
+		s.groups.Update(to, c.id, list, false, time.Now())
+		s.syncGroups(to)
+		s.emitBroadcast(c.id, to, common.NewClientMessage(common.ClientMessageGroups, common.EncodeGroups(list)))
+	}
+
+	// The client may have been released while being moved, in which case
+	// it must not linger on its new namespace.
+	if c.stopped.Load() {
+		s.leaveNamespace(c, to)
+	}
+
+	c.log.Info("Moved client upon administrative request",
+		zap.String("from", from),
+		zap.String("to", to))
+	return nil
+}
+
+// PauseNamespace stops forwarding traffic on a namespace through this
+// instance. Traffic emitted by local clients is not published, and traffic
+// published by other instances is not delivered to local clients.
+func (s *Server) PauseNamespace(ns string) {
+	s.paused.Store(ns, struct{}{})
+	s.log.Info("Paused namespace", zap.String("namespace", ns))
+}
+
+// ResumeNamespace resumes forwarding traffic on a namespace paused through
+// PauseNamespace.
+func (s *Server) ResumeNamespace(ns string) {
+	s.paused.Delete(ns)
+	s.log.Info("Resumed namespace", zap.String("namespace", ns))
+}
+
+func (s *Server) isPaused(ns string) bool {
+	_, ok := s.paused.Load(ns)
+	return ok
+}
@@ -0,0 +1,117 @@
+package tcp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"github.com/udpfw/dispatch/config"
+	"testing"
+	"time"
+)
+
+func clientIDs(srv *Server, ns string) []string {
+	for _, info := range srv.Namespaces() {
+		if info.Name == ns {
+			return info.Clients
+		}
+	}
+	return nil
+}
+
+func TestServer_MoveClient(t *testing.T) {
+	srv := startServer(t, &config.Context{
+		DrainTimeout: 100 * time.Millisecond,
+		Quotas:       config.QuotaConfig{NamespaceMaxClients: 1},
+	})
+	defer func() { _ = srv.Shutdown() }()
+
+	a := connectClient(t, srv, "a")
+	defer func() { _ = a.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, a).Type())
+	b := connectClient(t, srv, "b")
+	defer func() { _ = b.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, b).Type())
+
+	id := clientIDs(srv, "a")[0]
+	assert.ErrorIs(t, srv.MoveClient("unknown", "", "b"), UnknownClientErr)
+	assert.ErrorIs(t, srv.MoveClient(id, "", "b"), NamespaceFullErr)
+	assert.ErrorIs(t, srv.MoveClient(id, "b", "c"), NotMemberErr)
+
+	require.NoError(t, srv.MoveClient(id, "", "c"))
+	assert.Nil(t, clientIDs(srv, "a"))
+	assert.Equal(t, []string{id}, clientIDs(srv, "c"))
+	for _, info := range srv.Clients() {
+		if info.ID == id {
+			assert.Equal(t, []string{"c"}, info.Namespaces)
+		}
+	}
+}
+
+func TestServer_PauseNamespace(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	sender := connectClient(t, srv, "ns")
+	defer func() { _ = sender.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, sender).Type())
+	receiver := connectClient(t, srv, "ns")
+	defer func() { _ = receiver.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, receiver).Type())
+
+	srv.PauseNamespace("ns")
+	namespaces := srv.Namespaces()
+	require.Len(t, namespaces, 1)
+	assert.True(t, namespaces[0].Paused)
+	assert.Len(t, namespaces[0].Clients, 2)
+	_, err := sender.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("paused")))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return srv.Stats().PausedDropped == 1 }, time.Second, 10*time.Millisecond)
+
+	srv.ResumeNamespace("ns")
+	_, err = sender.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("resumed")))
+	require.NoError(t, err)
+	msg := readMessage(t, receiver)
+	assert.Equal(t, common.ClientMessagePkt, msg.Type())
+	assert.Equal(t, []byte("resumed"), msg.Payload())
+}
+
+func TestServer_Tap(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	frames, release := srv.Tap("ns")
+	defer release()
+
+	conn := connectClient(t, srv, "ns")
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+	_, err := conn.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("frame")))
+	require.NoError(t, err)
+
+	select {
+	case f := <-frames:
+		assert.Equal(t, []byte("frame"), f.Frame)
+		assert.Equal(t, clientIDs(srv, "ns")[0], f.Client)
+	case <-time.After(time.Second):
+		t.Fatal("frame was not tapped")
+	}
+
+	namespaces := srv.Namespaces()
+	require.Len(t, namespaces, 1)
+	assert.Equal(t, uint64(2), namespaces[0].RxMessages)
+}
+
+func TestServer_DisconnectClient(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	conn := connectClient(t, srv, "ns")
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+
+	require.NoError(t, srv.DisconnectClient(clientIDs(srv, "ns")[0]))
+	msg := readMessage(t, conn)
+	assert.Equal(t, common.ClientMessageBye, msg.Type())
+	assert.Equal(t, common.ByeReasonAdministrative, common.DecodeByeReason(msg.Payload()))
+	require.Eventually(t, func() bool { return srv.CountConnected() == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Client struct {
@@ -19,8 +20,50 @@ type Client struct {
 	readySignal chan bool
 	assembler   *common.MessageAssembler
 	wantsHello  bool
-	ns          *string
 	server      *Server
+
+	// tagged indicates the client joined several namespaces or a wildcard
+	// pattern, in which case frames delivered to it are emitted as NSPKT
+	// messages tagged with the namespace they were published on.
+	tagged atomic.Bool
+
+	// groups holds multicast groups the client has listeners for. It is
+	// nil for clients that never advertised groups.
+	groups           atomic.Pointer[groupSet]
+	groupsMu         sync.Mutex
+	groupsAdvertised bool
+	advertisedGroups string
+
+	// limiter enforces per-client quotas, and is nil when none are
+	// configured.
+	limiter       *rateLimiter
+	violation     quotaViolation
+	disconnecting atomic.Bool
+
+	// segment holds the segment the client is a candidate for once it
+	// joined its election, and role the role it was last informed about.
+	roleMu sync.Mutex
+	seg    string
+	role   common.SegmentRole
+
+	// hello holds attributes advertised by the client through its
+	// handshake, and is nil until it is received.
+	hello atomic.Pointer[common.Hello]
+
+	// closed is closed once the client is dropped. missedPings counts PINGs
+	// emitted since the last message received from the client, and pingSent
+	// holds when the last unanswered PING was emitted, in nanoseconds since
+	// the epoch.
+	closed      chan struct{}
+	missedPings atomic.Int32
+	pingSent    atomic.Int64
+	rtt         atomic.Int64
+
+	connectedAt time.Time
+	rxMessages  atomic.Uint64
+	rxBytes     atomic.Uint64
+	txMessages  atomic.Uint64
+	txBytes     atomic.Uint64
 }
 
 func (c *Client) service() {
@@ -30,6 +73,10 @@ func (c *Client) service() {
 		wg.Add(2)
 		go c.serviceWrites(wg.Done)
 		go c.serviceReads(wg.Done)
+		if c.server.keepalive.Interval > 0 {
+			wg.Add(1)
+			go c.serviceKeepalive(wg.Done)
+		}
 		wg.Wait()
 	}()
 }
@@ -41,11 +88,21 @@ func (c *Client) drop() {
 		return // Already stopped, or in the process of stopping.
 	}
 	_ = c.conn.Close()
+	close(c.closed)
+
+	// Wake the writer in case it is idle, so it can exit.
+	select {
+	case c.writeQueue <- nil:
+	default:
+	}
 }
 
 func (c *Client) serviceWrites(done func()) {
 	defer done()
-	<-c.readySignal
+	select {
+	case <-c.readySignal:
+	case <-c.closed:
+	}
 
 	// In case we were dropped before the ready signal...
 	if c.stopped.Load() {
@@ -54,6 +111,8 @@ func (c *Client) serviceWrites(done func()) {
 
 	for msg := range c.writeQueue {
 		if msg == nil {
+			// Emitted by disconnect once the client was notified.
+			c.drop()
 			break
 		}
 
@@ -76,10 +135,107 @@ func (c *Client) serviceWrites(done func()) {
 			}
 			written += n
 		}
+		c.txMessages.Add(1)
+		c.txBytes.Add(uint64(toWrite))
 		c.log.Debug("Wrote payload to client", zap.Int("size", toWrite))
 	}
 }
 
+// serviceKeepalive emits a PING every configured interval once the client
+// completed its handshake, and drops the client once the configured amount of
+// PINGs were emitted without receiving any message from it.
+func (c *Client) serviceKeepalive(done func()) {
+	defer done()
+	select {
+	case <-c.readySignal:
+	case <-c.closed:
+		return
+	}
+
+	cfg := c.server.keepalive
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if int(c.missedPings.Load()) >= cfg.MaxMissed {
+			c.log.Info("Dropping client not responding to keepalives", zap.Int("missed", cfg.MaxMissed))
+			c.server.keepaliveTimeouts.Add(1)
+			c.drop()
+			return
+		}
+		c.missedPings.Add(1)
+		c.pingSent.Store(time.Now().UnixNano())
+
+		// A full queue means the client is not draining its connection,
+		// which is accounted for as a missed PING.
+		select {
+		case c.writeQueue <- common.NewClientMessage(common.ClientMessagePing, nil):
+		default:
+		}
+	}
+}
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	ID             string            `json:"id"`
+	Address        string            `json:"address"`
+	Namespaces     []string          `json:"namespaces,omitempty"`
+	Node           string            `json:"node,omitempty"`
+	Interface      string            `json:"iface,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Direction      string            `json:"direction"`
+	Segment        string            `json:"segment,omitempty"`
+	Role           string            `json:"role,omitempty"`
+	ConnectedSince time.Time         `json:"connected_since"`
+	QueueDepth     int               `json:"queue_depth"`
+	RxMessages     uint64            `json:"rx_messages"`
+	RxBytes        uint64            `json:"rx_bytes"`
+	TxMessages     uint64            `json:"tx_messages"`
+	TxBytes        uint64            `json:"tx_bytes"`
+	RTTMicros      int64             `json:"rtt_us"`
+}
+
+// Info returns attributes describing the client. Attributes advertised
+// through the handshake are empty until it is received.
+func (c *Client) Info() ClientInfo {
+	info := ClientInfo{
+		ID:             c.id,
+		Address:        c.conn.RemoteAddr().String(),
+		Namespaces:     c.namespaces(),
+		ConnectedSince: c.connectedAt,
+		QueueDepth:     len(c.writeQueue),
+		RxMessages:     c.rxMessages.Load(),
+		RxBytes:        c.rxBytes.Load(),
+		TxMessages:     c.txMessages.Load(),
+		TxBytes:        c.txBytes.Load(),
+		RTTMicros:      c.RTT().Microseconds(),
+		Direction:      c.direction().String(),
+	}
+	c.roleMu.Lock()
+	if c.seg != "" {
+		info.Segment = c.seg
+		info.Role = c.role.String()
+	}
+	c.roleMu.Unlock()
+	if hello := c.hello.Load(); hello != nil {
+		info.Node = hello.Node
+		info.Interface = hello.Interface
+		info.Version = hello.Version
+		info.Labels = hello.Labels
+	}
+	return info
+}
+
+// RTT returns the last round-trip time measured through PING messages, or
+// zero in case none was measured.
+func (c *Client) RTT() time.Duration { return time.Duration(c.rtt.Load()) }
+
 func (c *Client) serviceReads(done func()) {
 	defer done()
 	buffer := make([]byte, 128)
@@ -116,46 +272,232 @@ func (c *Client) serviceReads(done func()) {
 }
 
 func (c *Client) handleMessage(msg common.ClientMessage) {
+	c.missedPings.Store(0)
+	c.rxMessages.Add(1)
+	c.rxBytes.Add(uint64(len(msg)))
+	if c.disconnecting.Load() {
+		return
+	}
+
 	if c.wantsHello && msg.Type() != common.ClientMessageHello {
 		c.log.Info("Dropping client attempting exchange without handshake")
 		c.drop()
 		return
 	}
 
+	switch msg.Type() {
+	case common.ClientMessagePkt, common.ClientMessageNsPkt, common.ClientMessageReply:
+		if !c.direction().CanPublish() {
+			c.log.Debug("Dropping frame emitted by subscribe-only client")
+			c.server.directionDropped.Add(1)
+			return
+		}
+		if c.standby() {
+			c.log.Debug("Dropping frame emitted by standby client")
+			c.server.standbyDropped.Add(1)
+			return
+		}
+	}
+
 	switch msg.Type() {
 	case common.ClientMessageHello:
-		c.log.Debug("Received valid handshake")
-		var ns string
-		if msg.PayloadSize() > 0 {
-			ns = string(msg.Payload())
-			c.log.Debug("Registered interest in namespace", zap.String("namespace", ns))
+		hello, err := common.DecodeHello(msg.Payload())
+		if err != nil {
+			c.log.Info("Dropping client emitting malformed handshake", zap.Error(err))
+			c.drop()
+			return
+		}
+		c.hello.Store(&hello)
+		c.log = c.log.With(
+			zap.String("node", hello.Node),
+			zap.String("iface", hello.Interface),
+			zap.String("version", hello.Version),
+			zap.Stringer("direction", hello.Direction),
+			zap.String("segment", hello.Segment))
+		c.log.Debug("Received valid handshake", zap.Any("labels", hello.Labels))
+		namespaces := uniqueNamespaces(hello.Namespaces)
+		for _, ns := range namespaces {
+			if err := common.ValidateNamespace(ns); err != nil {
+				c.log.Info("Dropping client requesting invalid namespace", zap.Error(err))
+				c.drop()
+				return
+			}
+		}
+		if len(namespaces) > 0 {
+			c.log.Debug("Registered interest in namespaces", zap.Strings("namespaces", namespaces))
 		} else {
-			ns = "$$global"
+			namespaces = []string{"$$global"}
 			c.log.Debug("Client is running on global namespace")
 		}
-		c.ns = &ns
+		c.tagged.Store(len(namespaces) > 1 || common.IsNamespacePattern(namespaces[0]))
 		c.wantsHello = false
-		c.server.AssocNamespace(c, ns)
+		if ns, ok := c.server.AssocNamespaces(c, namespaces); !ok {
+			c.log.Info("Rejecting client on full namespace", zap.String("namespace", ns))
+			c.ready()
+			c.disconnect(common.ByeReasonNamespaceFull)
+			return
+		}
 		c.Write(common.NewClientMessage(common.ClientMessageAck, []byte(c.server.hostname)))
 		c.ready()
+		if hello.Segment != "" {
+			c.server.joinSegment(c, hello.Segment)
+		}
+		c.server.announcePresence(c, presenceJoin)
 
 	case common.ClientMessagePing:
 		c.log.Debug("Processing PING message")
 		c.Write(common.NewClientMessage(common.ClientMessagePong, nil))
 
+	case common.ClientMessagePong:
+		if sent := c.pingSent.Swap(0); sent != 0 {
+			c.rtt.Store(int64(time.Since(time.Unix(0, sent))))
+		}
+
 	case common.ClientMessagePkt:
 		c.log.Debug("Processing PKT message")
 		c.server.RequestBroadcast(c, msg)
 
+	case common.ClientMessageNsPkt:
+		c.log.Debug("Processing NSPKT message")
+		c.server.RequestBroadcast(c, msg)
+
+	case common.ClientMessageReply:
+		c.log.Debug("Processing REPLY message")
+		c.server.RequestBroadcast(c, msg)
+
 	case common.ClientMessageBye:
 		c.log.Debug("Processing BYE message")
 		c.drop()
 
+	case common.ClientMessageGroups:
+		c.log.Debug("Processing GROUPS message")
+		if !c.direction().CanSubscribe() {
+			// Publish-only clients receive no frames, so their listeners
+			// must not attract traffic.
+			c.log.Debug("Ignoring GROUPS message from publish-only client")
+			break
+		}
+		groups, err := common.DecodeGroups(msg.Payload())
+		if err != nil {
+			c.log.Warn("Ignoring malformed GROUPS message", zap.Error(err))
+			break
+		}
+		c.server.UpdateGroups(c, msg, groups)
+
 	case common.ClientMessageInvalid:
 		c.log.Warn("Ignoring message with invalid type", zap.ByteString("payload", msg))
 	}
 }
 
+// direction returns the direction advertised by the client, which is
+// DirectionBoth until its handshake is received.
+func (c *Client) direction() common.Direction {
+	if hello := c.hello.Load(); hello != nil {
+		return hello.Direction
+	}
+	return common.DirectionBoth
+}
+
+// segment returns the segment the client is a candidate for, which is empty
+// in case it did not report any.
+func (c *Client) segment() string {
+	c.roleMu.Lock()
+	defer c.roleMu.Unlock()
+	return c.seg
+}
+
+// candidateKey returns the identity under which the client is a candidate
+// for its segment: its node and interface, or its id in case it did not
+// advertise a node, so reconnections of the same nodelet share a key.
+func (c *Client) candidateKey() string {
+	if hello := c.hello.Load(); hello != nil && hello.Node != "" {
+		return hello.Node + "/" + hello.Interface
+	}
+	return c.id
+}
+
+// standby determines whether the client lost the election of its segment,
+// in which case it neither emits nor receives frames.
+func (c *Client) standby() bool {
+	c.roleMu.Lock()
+	defer c.roleMu.Unlock()
+	return c.role == common.SegmentRoleStandby
+}
+
+// setRole informs the client about its role in its segment, in case it
+// changed since it was last informed.
+func (c *Client) setRole(role common.SegmentRole) {
+	c.roleMu.Lock()
+	defer c.roleMu.Unlock()
+	if c.role == role || c.stopped.Load() {
+		return
+	}
+	c.role = role
+	c.log.Info("Assigned segment role", zap.String("segment", c.seg), zap.Stringer("role", role))
+	c.Write(common.NewRoleMessage(role))
+}
+
+// namespaces returns namespaces the client is a member of, which is empty in
+// case it did not complete its handshake.
+func (c *Client) namespaces() []string {
+	return c.server.namespaces.Memberships(c)
+}
+
+// uniqueNamespaces returns non-empty namespaces from the provided list,
+// without duplicates.
+func uniqueNamespaces(namespaces []string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, ns := range namespaces {
+		if ns == "" || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		result = append(result, ns)
+	}
+	return result
+}
+
+// wantsGroup determines whether traffic destined to the provided address
+// must be delivered to this client.
+func (c *Client) wantsGroup(dst net.IP) bool {
+	groups := c.groups.Load()
+	if groups == nil {
+		return true
+	}
+	return groups.wantsGroup(dst)
+}
+
+// advertiseGroups informs the client about groups other members of its
+// namespaces have listeners for, in case the set changed since the last
+// advertisement. Clients that never advertised groups are ignored.
+func (c *Client) advertiseGroups(groups groupSet) {
+	if c.groups.Load() == nil {
+		return
+	}
+
+	c.groupsMu.Lock()
+	defer c.groupsMu.Unlock()
+	key := groups.Key()
+	if c.groupsAdvertised && c.advertisedGroups == key {
+		return
+	}
+	c.groupsAdvertised = true
+	c.advertisedGroups = key
+	c.log.Debug("Advertising remote groups", zap.Int("count", len(groups)))
+	c.Write(common.NewClientMessage(common.ClientMessageGroups, common.EncodeGroups(groups.List())))
+}
+
+// disconnect emits a BYE message with the provided reason and closes the
+// connection once it is written.
+func (c *Client) disconnect(reason common.ByeReason) {
+	if c.disconnecting.Swap(true) {
+		return
+	}
+	c.Write(common.NewByeMessage(reason))
+	c.Write(nil)
+}
+
 func (c *Client) Write(msg common.ClientMessage) {
 	c.writeQueue <- msg
 }
@@ -167,7 +509,10 @@ func NewClient(s *Server, id string, conn net.Conn) *Client {
 		log:         zap.L().With(zap.String("facility", "TCP"), zap.String("client", id)),
 		writeQueue:  make(chan common.ClientMessage, 64),
 		readySignal: make(chan bool),
+		closed:      make(chan struct{}),
 		assembler:   common.NewMessageAssembler(),
 		server:      s,
+		limiter:     s.quotas.newClientLimiter(time.Now()),
+		connectedAt: time.Now().UTC(),
 	}
 }
@@ -19,6 +19,19 @@ func (c *ClientMap) Len() int {
 	return r
 }
 
+func (c *ClientMap) Has(id string) bool {
+	_, ok := c.list.Load(id)
+	return ok
+}
+
+func (c *ClientMap) Get(id string) (*Client, bool) {
+	cli, ok := c.list.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return cli.(*Client), true
+}
+
 func (c *ClientMap) Delete(id string) {
 	c.list.Delete(id)
 }
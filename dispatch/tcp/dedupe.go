@@ -0,0 +1,82 @@
+package tcp
+
+import (
+	"github.com/udpfw/common"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// frameHash returns a hash identifying a frame regardless of the nodelet
+// which captured it. Frames are hashed from their IP header onwards, so
+// link-layer differences such as VLAN tags are ignored. The hash is stable
+// across dispatch instances, and never zero.
+func frameHash(frame []byte) uint64 {
+	data := frame
+	if info, ok := common.ParseFrame(frame); ok {
+		data = info.Network
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	if sum := h.Sum64(); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+type dedupeKey struct {
+	ns   string
+	hash uint64
+}
+
+type dedupeEntry struct {
+	src     string
+	expires time.Time
+}
+
+// dedupeWindow remembers frames published on each namespace for a short
+// window, so the same datagram captured by several nodelets attached to one
+// segment is only delivered once. Frames repeated by the client which first
+// emitted them are not considered duplicates.
+type dedupeWindow struct {
+	window    time.Duration
+	mu        sync.Mutex
+	entries   map[dedupeKey]dedupeEntry
+	lastPrune time.Time
+}
+
+// newDedupeWindow returns a dedupeWindow remembering frames for the provided
+// duration, or nil in case it is not positive, which disables suppression.
+func newDedupeWindow(window time.Duration) *dedupeWindow {
+	if window <= 0 {
+		return nil
+	}
+	return &dedupeWindow{window: window, entries: make(map[dedupeKey]dedupeEntry)}
+}
+
+// duplicate determines whether a frame identified by hash was published on
+// ns by a client other than src within the window. Frames which are not
+// duplicates are remembered.
+func (d *dedupeWindow) duplicate(ns string, hash uint64, src string, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastPrune) >= d.window {
+		for k, e := range d.entries {
+			if !now.Before(e.expires) {
+				delete(d.entries, k)
+			}
+		}
+		d.lastPrune = now
+	}
+
+	key := dedupeKey{ns, hash}
+	if e, ok := d.entries[key]; ok && now.Before(e.expires) && e.src != src {
+		return true
+	}
+	d.entries[key] = dedupeEntry{src: src, expires: now.Add(d.window)}
+	return false
+}
@@ -0,0 +1,66 @@
+package tcp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"github.com/udpfw/dispatch/config"
+	"github.com/udpfw/dispatch/pubsub"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFrameHash(t *testing.T) {
+	frame := udpFrame("224.0.0.251", 5353)
+	tagged := append(append(append([]byte{}, frame[:12]...), 0x81, 0x00, 0x00, 0x0A), frame[12:]...)
+	assert.Equal(t, frameHash(frame), frameHash(tagged))
+	assert.NotEqual(t, frameHash(frame), frameHash(udpFrame("224.0.0.251", 5354)))
+}
+
+func TestDedupeWindow(t *testing.T) {
+	now := time.Now()
+	d := newDedupeWindow(time.Second)
+
+	assert.False(t, d.duplicate("ns", 1, "a", now))
+	assert.True(t, d.duplicate("ns", 1, "b", now.Add(100*time.Millisecond)))
+	assert.False(t, d.duplicate("other", 1, "b", now), "namespaces are tracked independently")
+	assert.False(t, d.duplicate("ns", 1, "a", now.Add(200*time.Millisecond)), "repeats from the same client are kept")
+	assert.False(t, d.duplicate("ns", 1, "b", now.Add(2*time.Second)), "entries expire")
+
+	var disabled *dedupeWindow
+	assert.False(t, disabled.duplicate("ns", 1, "a", now))
+	assert.False(t, disabled.duplicate("ns", 1, "b", now))
+}
+
+func TestServer_Dedupe(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond, DedupeWindow: time.Minute})
+	defer func() { _ = srv.Shutdown() }()
+
+	first := connectClient(t, srv, "ns")
+	defer func() { _ = first.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, first).Type())
+	second := connectClient(t, srv, "ns")
+	defer func() { _ = second.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, second).Type())
+	receiver := connectClient(t, srv, "ns")
+	defer func() { _ = receiver.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, receiver).Type())
+
+	frame := common.NewClientMessage(common.ClientMessagePkt, udpFrame("224.0.0.251", 5353))
+	_, err := first.Write(frame)
+	require.NoError(t, err)
+	assert.Equal(t, frame, readMessage(t, receiver))
+	_, err = second.Write(frame)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return srv.Stats().DedupeDropped == 1 }, time.Second, 10*time.Millisecond)
+
+	// Copies captured by clients of other instances are suppressed as well.
+	remote := pubsub.MakePacket("LKJIHGFEDCBA9876543210", "0123456789ABCDEFGHIJKL", "ns", frame, frameHash(frame.Payload()), nil)
+	require.NoError(t, srv.pubSub.Broadcast(remote))
+	require.Eventually(t, func() bool { return srv.Stats().DedupeDropped == 2 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, receiver.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = receiver.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
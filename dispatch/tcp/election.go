@@ -0,0 +1,279 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/udpfw/common"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// segmentRefreshInterval is the interval in which dispatch instances
+// re-announce candidates connected to them. Candidates learned from other
+// instances are discarded when not refreshed within remoteSegmentTTL.
+const (
+	segmentRefreshInterval = 10 * time.Second
+	remoteSegmentTTL       = 3 * segmentRefreshInterval
+)
+
+type segmentCandidate struct {
+	id      string    // Client id of the candidate's current connection
+	since   int64     // Connection time, in nanoseconds since the epoch
+	expires time.Time // Zero for local clients
+}
+
+// SegmentElection tracks clients reporting the same segment across this and
+// other dispatch instances, electing a single active forwarder for each
+// segment. Candidates are keyed by the identity of the nodelet rather than
+// by connection, so a nodelet reconnecting to another instance replaces its
+// previous connection instead of competing with it. The leader is the
+// candidate connected for the longest time, ties being broken by identity,
+// so all instances elect the same leader once they learn about the same
+// candidates.
+type SegmentElection struct {
+	mu       sync.Mutex
+	segments map[string]map[string]segmentCandidate
+}
+
+func NewSegmentElection() *SegmentElection {
+	return &SegmentElection{segments: make(map[string]map[string]segmentCandidate)}
+}
+
+// Join registers the connection id of a candidate identified by key for a
+// segment. Connections older than the one already registered for the same
+// key are ignored, as they are about to be closed. Remote candidates expire
+// after remoteSegmentTTL unless joined again. Returns whether the segment
+// leader changed.
+func (e *SegmentElection) Join(segment, key, id string, since int64, remote bool, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	candidates, ok := e.segments[segment]
+	if !ok {
+		candidates = make(map[string]segmentCandidate)
+		e.segments[segment] = candidates
+	}
+	if c, ok := candidates[key]; ok && c.id != id && c.since > since {
+		return false
+	}
+	previous := leaderOf(candidates)
+	var expires time.Time
+	if remote {
+		expires = now.Add(remoteSegmentTTL)
+	}
+	candidates[key] = segmentCandidate{id: id, since: since, expires: expires}
+	return leaderOf(candidates) != previous
+}
+
+// Leave removes a candidate from a segment, in case it is still registered
+// with the provided connection id. Returns whether the segment leader
+// changed.
+func (e *SegmentElection) Leave(segment, key, id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	candidates, ok := e.segments[segment]
+	if !ok {
+		return false
+	}
+	if c, ok := candidates[key]; !ok || c.id != id {
+		return false
+	}
+	previous := leaderOf(candidates)
+	delete(candidates, key)
+	if len(candidates) == 0 {
+		delete(e.segments, segment)
+	}
+	return leaderOf(candidates) != previous
+}
+
+// Withdraw removes remote candidates registered with any of the provided
+// connection ids, returning segments whose leader changed.
+func (e *SegmentElection) Withdraw(ids []string) []string {
+	withdrawn := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		withdrawn[id] = true
+	}
+	return e.remove(func(c segmentCandidate) bool {
+		return !c.expires.IsZero() && withdrawn[c.id]
+	})
+}
+
+// Expire removes remote candidates that were not refreshed in time,
+// returning segments whose leader changed.
+func (e *SegmentElection) Expire(now time.Time) []string {
+	return e.remove(func(c segmentCandidate) bool {
+		return !c.expires.IsZero() && now.After(c.expires)
+	})
+}
+
+func (e *SegmentElection) remove(matches func(c segmentCandidate) bool) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var changed []string
+	for segment, candidates := range e.segments {
+		previous := leaderOf(candidates)
+		for key, c := range candidates {
+			if matches(c) {
+				delete(candidates, key)
+			}
+		}
+		if leaderOf(candidates) != previous {
+			changed = append(changed, segment)
+		}
+		if len(candidates) == 0 {
+			delete(e.segments, segment)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Leader returns the connection id of the elected forwarder for a segment,
+// or an empty string in case it has no candidates.
+func (e *SegmentElection) Leader(segment string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return leaderOf(e.segments[segment])
+}
+
+func leaderOf(candidates map[string]segmentCandidate) string {
+	var leader, leaderKey string
+	var leaderSince int64
+	for key, c := range candidates {
+		if leaderKey == "" || c.since < leaderSince || (c.since == leaderSince && key < leaderKey) {
+			leader, leaderKey, leaderSince = c.id, key, c.since
+		}
+	}
+	return leader
+}
+
+// encodeSegmentAnnouncement encodes a SEGMENT payload announcing a candidate
+// identified by key joining or leaving a segment to other dispatch
+// instances.
+func encodeSegmentAnnouncement(segment, key string, since int64, joined bool) []byte {
+	buf := make([]byte, 0, 11+len(key)+len(segment))
+	if joined {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(since))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+	buf = append(buf, key...)
+	return append(buf, segment...)
+}
+
+func decodeSegmentAnnouncement(payload []byte) (segment, key string, since int64, joined bool, err error) {
+	if len(payload) < 11 {
+		return "", "", 0, false, fmt.Errorf("truncated SEGMENT payload")
+	}
+	keyLen := int(binary.BigEndian.Uint16(payload[9:11]))
+	if len(payload) < 11+keyLen {
+		return "", "", 0, false, fmt.Errorf("truncated SEGMENT candidate")
+	}
+	key = string(payload[11 : 11+keyLen])
+	return string(payload[11+keyLen:]), key, int64(binary.BigEndian.Uint64(payload[1:9])), payload[0] == 1, nil
+}
+
+// joinSegment registers a local client as a candidate for the segment it
+// reported, announcing it to other instances.
+func (s *Server) joinSegment(c *Client, segment string) {
+	c.roleMu.Lock()
+	c.seg = segment
+	c.roleMu.Unlock()
+
+	since := c.connectedAt.UnixNano()
+	key := c.candidateKey()
+	s.elections.Join(segment, key, c.id, since, false, time.Now())
+	s.emitBroadcast(c.id, "", common.NewClientMessage(common.ClientMessageSegment,
+		encodeSegmentAnnouncement(segment, key, since, true)))
+	s.syncSegment(segment)
+}
+
+// leaveSegment withdraws a local client from the segment it reported.
+func (s *Server) leaveSegment(c *Client, segment string) {
+	key := c.candidateKey()
+	if s.elections.Leave(segment, key, c.id) {
+		s.syncSegment(segment)
+	}
+	s.emitBroadcast(c.id, "", common.NewClientMessage(common.ClientMessageSegment,
+		encodeSegmentAnnouncement(segment, key, 0, false)))
+}
+
+// handleRemoteSegment records candidates announced by other dispatch
+// instances.
+func (s *Server) handleRemoteSegment(src string, data common.ClientMessage) {
+	if s.clients.Has(src) {
+		// Local clients are registered upon their handshake.
+		return
+	}
+	segment, key, since, joined, err := decodeSegmentAnnouncement(data.Payload())
+	if err != nil {
+		s.log.Warn("Ignoring malformed remote SEGMENT message", zap.String("client", src), zap.Error(err))
+		return
+	}
+
+	var changed bool
+	if joined {
+		changed = s.elections.Join(segment, key, src, since, true, time.Now())
+	} else {
+		changed = s.elections.Leave(segment, key, src)
+	}
+	if changed {
+		s.syncSegment(segment)
+	}
+}
+
+// withdrawSegments removes candidates of remote clients whose presence
+// expired, so nodelets of a failed instance do not hold their
+// segments until remoteSegmentTTL elapses.
+func (s *Server) withdrawSegments(ids []string) {
+	for _, segment := range s.elections.Withdraw(ids) {
+		s.syncSegment(segment)
+	}
+}
+
+// syncSegment informs local clients reporting a segment about their role,
+// in case it changed.
+func (s *Server) syncSegment(segment string) {
+	leader := s.elections.Leader(segment)
+	s.clients.Range(func(_ string, c *Client) bool {
+		if c.segment() != segment {
+			return true
+		}
+		role := common.SegmentRoleStandby
+		if c.id == leader {
+			role = common.SegmentRoleActive
+		}
+		c.setRole(role)
+		return true
+	})
+}
+
+// refreshSegments re-announces local candidates to other instances, and
+// discards remote candidates that were not refreshed in time.
+func (s *Server) refreshSegments() {
+	tick := time.NewTicker(segmentRefreshInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-tick.C:
+			s.clients.Range(func(_ string, c *Client) bool {
+				if segment := c.segment(); segment != "" && !c.stopped.Load() {
+					s.emitBroadcast(c.id, "", common.NewClientMessage(common.ClientMessageSegment,
+						encodeSegmentAnnouncement(segment, c.candidateKey(), c.connectedAt.UnixNano(), true)))
+				}
+				return true
+			})
+			for _, segment := range s.elections.Expire(now) {
+				s.syncSegment(segment)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package tcp
+
+import (
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"github.com/udpfw/dispatch/config"
+	"github.com/udpfw/dispatch/pubsub"
+	"testing"
+	"time"
+)
+
+func TestSegmentElection(t *testing.T) {
+	now := time.Now()
+	e := NewSegmentElection()
+
+	assert.True(t, e.Join("seg", "node-b", "b", 20, false, now))
+	assert.Equal(t, "b", e.Leader("seg"))
+	assert.True(t, e.Join("seg", "node-a", "a", 10, true, now), "older candidates take over")
+	assert.Equal(t, "a", e.Leader("seg"))
+	assert.False(t, e.Join("seg", "node-c", "c", 30, false, now))
+	assert.False(t, e.Join("seg", "node-a", "a", 10, true, now), "refreshes keep the leader")
+	assert.Equal(t, "", e.Leader("other"))
+
+	assert.Equal(t, []string{"seg"}, e.Expire(now.Add(2*remoteSegmentTTL)))
+	assert.Equal(t, "b", e.Leader("seg"), "stale remote candidates expire")
+
+	assert.False(t, e.Leave("seg", "node-c", "other"), "leaving requires the registered connection")
+	assert.False(t, e.Leave("seg", "node-c", "c"))
+	assert.True(t, e.Leave("seg", "node-b", "b"))
+	assert.Equal(t, "", e.Leader("seg"))
+	assert.False(t, e.Leave("seg", "node-b", "b"))
+
+	assert.True(t, e.Join("tie", "y", "y", 5, false, now))
+	assert.True(t, e.Join("tie", "x", "x", 5, false, now), "ties are broken by key")
+}
+
+func TestSegmentElection_Reconnect(t *testing.T) {
+	now := time.Now()
+	e := NewSegmentElection()
+
+	// A nodelet reconnecting to another instance replaces its previous
+	// connection, and stale refreshes of the previous one are ignored.
+	assert.True(t, e.Join("seg", "node-a", "a1", 10, true, now))
+	assert.False(t, e.Join("seg", "node-b", "b", 20, false, now))
+	assert.True(t, e.Join("seg", "node-a", "a2", 30, false, now))
+	assert.Equal(t, "b", e.Leader("seg"))
+	assert.False(t, e.Join("seg", "node-a", "a1", 10, true, now))
+	assert.Equal(t, "b", e.Leader("seg"))
+	assert.False(t, e.Leave("seg", "node-a", "a1"))
+
+	// Candidates of clients whose presence expired are withdrawn.
+	e = NewSegmentElection()
+	assert.True(t, e.Join("seg", "node-a", "a", 10, true, now))
+	assert.False(t, e.Join("seg", "node-b", "b", 20, false, now))
+	assert.Empty(t, e.Withdraw([]string{"b"}), "local candidates are kept")
+	assert.Equal(t, []string{"seg"}, e.Withdraw([]string{"a"}))
+	assert.Equal(t, "b", e.Leader("seg"))
+}
+
+func TestSegmentAnnouncement(t *testing.T) {
+	segment, key, since, joined, err := decodeSegmentAnnouncement(encodeSegmentAnnouncement("10.0.1.0/24", "node/eth0", 42, true))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.1.0/24", segment)
+	assert.Equal(t, "node/eth0", key)
+	assert.Equal(t, int64(42), since)
+	assert.True(t, joined)
+
+	_, _, _, _, err = decodeSegmentAnnouncement([]byte{1, 2})
+	assert.Error(t, err)
+	_, _, _, _, err = decodeSegmentAnnouncement([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5, 'a'})
+	assert.Error(t, err)
+}
+
+func TestServer_SegmentPresenceExpiry(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond, PresenceInterval: 50 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	// A candidate of another instance leads the segment until its presence
+	// expires, as its instance stopped announcing it.
+	remote := ClusterClientInfo{Instance: nuid.Next(), ClientInfo: ClientInfo{ID: nuid.Next()}}
+	msg, err := encodePresence(presenceJoin, remote)
+	require.NoError(t, err)
+	srv.dispatchPubSubMessage(pubsub.MakePacket(remote.Instance, remote.ID, "", msg, 0, nil))
+	srv.dispatchPubSubMessage(pubsub.MakePacket(remote.Instance, remote.ID, "",
+		common.NewClientMessage(common.ClientMessageSegment, encodeSegmentAnnouncement("lan", "node-a/eth0", 1, true)), 0, nil))
+
+	local := connectHello(t, srv, common.Hello{Namespaces: []string{"ns"}, Segment: "lan", Node: "node-b"})
+	defer func() { _ = local.Close() }()
+	msg = readMessage(t, local)
+	require.Equal(t, common.ClientMessageRole, msg.Type())
+	assert.Equal(t, common.SegmentRoleStandby, common.DecodeRole(msg.Payload()))
+
+	msg = readMessage(t, local)
+	require.Equal(t, common.ClientMessageRole, msg.Type())
+	assert.Equal(t, common.SegmentRoleActive, common.DecodeRole(msg.Payload()))
+}
+
+func TestServer_SegmentFailover(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	hello := common.Hello{Namespaces: []string{"ns"}, Segment: "lan"}
+	first := connectHello(t, srv, hello)
+	defer func() { _ = first.Close() }()
+	msg := readMessage(t, first)
+	require.Equal(t, common.ClientMessageRole, msg.Type())
+	assert.Equal(t, common.SegmentRoleActive, common.DecodeRole(msg.Payload()))
+
+	second := connectHello(t, srv, hello)
+	defer func() { _ = second.Close() }()
+	msg = readMessage(t, second)
+	assert.Equal(t, common.SegmentRoleStandby, common.DecodeRole(msg.Payload()))
+
+	listener := connectHello(t, srv, common.Hello{Namespaces: []string{"ns"}})
+	defer func() { _ = listener.Close() }()
+
+	// Frames emitted by the standby forwarder are dropped.
+	_, err := second.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("standby")))
+	require.NoError(t, err)
+	_, err = first.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("active")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("active"), []byte(readMessage(t, listener).Payload()))
+	assert.Eventually(t, func() bool { return srv.Stats().StandbyDropped == 1 }, time.Second, 10*time.Millisecond)
+
+	// The standby forwarder takes over once the active one disconnects.
+	_, err = first.Write(common.NewClientMessage(common.ClientMessageBye, nil))
+	require.NoError(t, err)
+	msg = readMessage(t, second)
+	require.Equal(t, common.ClientMessageRole, msg.Type())
+	assert.Equal(t, common.SegmentRoleActive, common.DecodeRole(msg.Payload()))
+}
@@ -0,0 +1,184 @@
+package tcp
+
+import (
+	"github.com/udpfw/common"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// remoteGroupsTTL determines for how long memberships learned from other
+// dispatch instances are kept without being refreshed.
+const remoteGroupsTTL = 3 * common.GroupsRefreshInterval
+
+var alwaysForwardedGroups = []net.IP{
+	net.IPv4allsys,
+	net.IPv6linklocalallnodes,
+}
+
+// groupSet represents the multicast groups a client has listeners for.
+type groupSet map[string]struct{}
+
+func newGroupSet(groups []net.IP) groupSet {
+	set := make(groupSet, len(groups))
+	for _, g := range groups {
+		set[string(g.To16())] = struct{}{}
+	}
+	return set
+}
+
+func (g groupSet) Contains(ip net.IP) bool {
+	_, ok := g[string(ip.To16())]
+	return ok
+}
+
+func (g groupSet) List() []net.IP {
+	list := make([]net.IP, 0, len(g))
+	for k := range g {
+		list = append(list, net.IP(k))
+	}
+	sort.Slice(list, func(i, j int) bool { return string(list[i]) < string(list[j]) })
+	return list
+}
+
+// Key returns a string uniquely identifying the set's contents.
+func (g groupSet) Key() string {
+	keys := make([]string, 0, len(g))
+	for k := range g {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	key := ""
+	for _, k := range keys {
+		key += k
+	}
+	return key
+}
+
+// wantsGroup determines whether a client with the provided set should
+// receive traffic destined to the provided address. Clients that never
+// advertised groups (nil sets) receive all traffic.
+func (g groupSet) wantsGroup(dst net.IP) bool {
+	if g == nil || dst == nil {
+		return true
+	}
+	for _, ip := range alwaysForwardedGroups {
+		if ip.Equal(dst) {
+			return true
+		}
+	}
+	return g.Contains(dst)
+}
+
+type groupMembership struct {
+	groups  groupSet
+	expires time.Time // Zero for memberships of local clients
+}
+
+// GroupRegistry tracks multicast group memberships advertised by clients
+// connected to this and other dispatch instances, by namespace.
+type GroupRegistry struct {
+	mu         sync.Mutex
+	namespaces map[string]map[string]*groupMembership
+}
+
+func NewGroupRegistry() *GroupRegistry {
+	return &GroupRegistry{
+		namespaces: make(map[string]map[string]*groupMembership),
+	}
+}
+
+// Update replaces memberships of a given client in a namespace. Memberships
+// of remote clients expire after remoteGroupsTTL. Returns whether the
+// registry changed.
+func (r *GroupRegistry) Update(ns, id string, groups []net.IP, remote bool, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members, ok := r.namespaces[ns]
+	if !ok {
+		members = make(map[string]*groupMembership)
+		r.namespaces[ns] = members
+	}
+
+	set := newGroupSet(groups)
+	var expires time.Time
+	if remote {
+		expires = now.Add(remoteGroupsTTL)
+	}
+
+	previous, ok := members[id]
+	members[id] = &groupMembership{groups: set, expires: expires}
+	return !ok || previous.groups.Key() != set.Key()
+}
+
+// Remove removes memberships of a given client from a namespace. Returns
+// whether the registry changed.
+func (r *GroupRegistry) Remove(ns, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members, ok := r.namespaces[ns]
+	if !ok {
+		return false
+	}
+	if _, ok = members[id]; !ok {
+		return false
+	}
+	delete(members, id)
+	if len(members) == 0 {
+		delete(r.namespaces, ns)
+	}
+	return true
+}
+
+// Expire removes remote memberships that were not refreshed in time,
+// returning the namespaces affected by the removal.
+func (r *GroupRegistry) Expire(now time.Time) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changed []string
+	for ns, members := range r.namespaces {
+		removed := false
+		for id, m := range members {
+			if !m.expires.IsZero() && now.After(m.expires) {
+				delete(members, id)
+				removed = true
+			}
+		}
+		if removed {
+			changed = append(changed, ns)
+		}
+		if len(members) == 0 {
+			delete(r.namespaces, ns)
+		}
+	}
+	return changed
+}
+
+// RemoteGroupsFor returns the union of groups advertised by all clients in a
+// namespace, except the one identified by the provided id. Groups advertised
+// by clients subscribed through wildcard patterns matching the namespace are
+// included.
+func (r *GroupRegistry) RemoteGroupsFor(ns, id string) groupSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	set := groupSet{}
+	for key, members := range r.namespaces {
+		if !common.NamespaceMatches(key, ns) {
+			continue
+		}
+		for memberID, m := range members {
+			if memberID == id {
+				continue
+			}
+			for g := range m.groups {
+				set[g] = struct{}{}
+			}
+		}
+	}
+	return set
+}
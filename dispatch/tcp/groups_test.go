@@ -0,0 +1,49 @@
+package tcp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	mdnsGroup = net.ParseIP("224.0.0.251")
+	ssdpGroup = net.ParseIP("239.255.255.250")
+)
+
+func TestGroupRegistry(t *testing.T) {
+	r := NewGroupRegistry()
+	now := time.Now()
+
+	assert.True(t, r.Update("ns", "a", []net.IP{mdnsGroup}, false, now))
+	assert.False(t, r.Update("ns", "a", []net.IP{mdnsGroup}, false, now))
+	assert.True(t, r.Update("ns", "b", []net.IP{ssdpGroup}, true, now))
+
+	remote := r.RemoteGroupsFor("ns", "a")
+	assert.True(t, remote.Contains(ssdpGroup))
+	assert.False(t, remote.Contains(mdnsGroup))
+	assert.Empty(t, r.RemoteGroupsFor("other", "a"))
+
+	t.Run("remote memberships expire", func(t *testing.T) {
+		assert.Empty(t, r.Expire(now))
+		assert.Equal(t, []string{"ns"}, r.Expire(now.Add(remoteGroupsTTL+time.Second)))
+		assert.Empty(t, r.RemoteGroupsFor("ns", "a"))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		assert.True(t, r.Remove("ns", "a"))
+		assert.False(t, r.Remove("ns", "a"))
+	})
+}
+
+func TestGroupSet_wantsGroup(t *testing.T) {
+	var unset groupSet
+	assert.True(t, unset.wantsGroup(mdnsGroup))
+
+	set := newGroupSet([]net.IP{mdnsGroup})
+	assert.True(t, set.wantsGroup(mdnsGroup))
+	assert.False(t, set.wantsGroup(ssdpGroup))
+	assert.True(t, set.wantsGroup(net.IPv4allsys))
+	assert.True(t, set.wantsGroup(nil))
+}
@@ -1,23 +1,91 @@
 package tcp
 
 import (
+	"github.com/udpfw/common"
 	"sync"
 )
 
+// NSMap holds clients registered on each namespace. A client may be a member
+// of several namespaces at once, and memberships are tracked per client in
+// the order they were registered. Namespaces holding wildcard patterns are
+// additionally listed in patterns, so matching only scans them.
 type NSMap struct {
-	mu   sync.RWMutex
-	data map[string][]*Client
+	mu          sync.RWMutex
+	data        map[string][]*Client
+	patterns    []string
+	memberships map[*Client][]string
+}
+
+func (m *NSMap) init() {
+	if m.data == nil {
+		m.data = make(map[string][]*Client)
+		m.memberships = make(map[*Client][]string)
+	}
+}
+
+func (m *NSMap) add(key string, value *Client) {
+	if _, ok := m.data[key]; !ok && common.IsNamespacePattern(key) {
+		m.patterns = append(m.patterns, key)
+	}
+	m.data[key] = append(m.data[key], value)
+	m.memberships[value] = append(m.memberships[value], key)
 }
 
 func (m *NSMap) Add(key string, value *Client) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.init()
+	m.add(key, value)
+}
 
-	if m.data == nil {
-		m.data = make(map[string][]*Client)
+// AddLimited adds a client to a namespace in case it holds less than limit
+// clients, returning whether the client was added. A zero limit accepts any
+// amount of clients.
+func (m *NSMap) AddLimited(key string, value *Client, limit int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	if limit > 0 && len(m.data[key]) >= limit {
+		return false
 	}
+	m.add(key, value)
+	return true
+}
 
-	m.data[key] = append(m.data[key], value)
+// AddAllLimited adds a client to all provided namespaces in case none of them
+// holds limit clients or more. Otherwise, the client is not added to any of
+// them, and the first full namespace is returned.
+func (m *NSMap) AddAllLimited(keys []string, value *Client, limit int) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	if limit > 0 {
+		for _, key := range keys {
+			if len(m.data[key]) >= limit {
+				return key, false
+			}
+		}
+	}
+	for _, key := range keys {
+		m.add(key, value)
+	}
+	return "", true
+}
+
+func (m *NSMap) Len(key string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data[key])
+}
+
+func (m *NSMap) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+	return keys
 }
 
 func (m *NSMap) Get(key string) []*Client {
@@ -31,6 +99,56 @@ func (m *NSMap) Get(key string) []*Client {
 	return append([]*Client{}, obj...)
 }
 
+// Match returns clients registered on namespaces matching the provided one,
+// either exactly or through a wildcard pattern. Clients matching through
+// several memberships are returned once.
+func (m *NSMap) Match(key string) []*Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := append([]*Client(nil), m.data[key]...)
+	if len(m.patterns) == 0 {
+		return result
+	}
+	seen := make(map[*Client]bool, len(result))
+	for _, c := range result {
+		seen[c] = true
+	}
+	for _, pattern := range m.patterns {
+		if pattern == key || !common.NamespaceMatches(pattern, key) {
+			continue
+		}
+		for _, c := range m.data[pattern] {
+			if !seen[c] {
+				seen[c] = true
+				result = append(result, c)
+			}
+		}
+	}
+	return result
+}
+
+// Memberships returns namespaces the provided client is a member of.
+func (m *NSMap) Memberships(value *Client) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.memberships == nil {
+		return nil
+	}
+	return append([]string(nil), m.memberships[value]...)
+}
+
+// IsMember determines whether the provided client is a member of a namespace.
+func (m *NSMap) IsMember(key string, value *Client) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, ns := range m.memberships[value] {
+		if ns == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *NSMap) Delete(key string, valueToDelete *Client) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -46,8 +164,26 @@ func (m *NSMap) Delete(key string, valueToDelete *Client) {
 			break
 		}
 	}
-
 	if len(m.data[key]) == 0 {
 		delete(m.data, key)
+		for i, p := range m.patterns {
+			if p == key {
+				m.patterns = append(m.patterns[:i], m.patterns[i+1:]...)
+				break
+			}
+		}
+	}
+
+	keys := m.memberships[valueToDelete]
+	for i, k := range keys {
+		if k == key {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(m.memberships, valueToDelete)
+	} else {
+		m.memberships[valueToDelete] = keys
 	}
 }
@@ -0,0 +1,28 @@
+package tcp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNSMap_Match(t *testing.T) {
+	m := &NSMap{}
+	exact, single, tail, other := &Client{}, &Client{}, &Client{}, &Client{}
+	m.Add("site-a.floor-2", exact)
+	m.Add("site-a.*", single)
+	m.Add("site-a.>", tail)
+	m.Add("site-a.floor-2", tail)
+	m.Add("site-b", other)
+	assert.Equal(t, []string{"site-a.*", "site-a.>"}, m.patterns)
+
+	assert.ElementsMatch(t, []*Client{exact, single, tail}, m.Match("site-a.floor-2"))
+	assert.ElementsMatch(t, []*Client{tail}, m.Match("site-a.floor-2.room-1"))
+	assert.ElementsMatch(t, []*Client{other}, m.Match("site-b"))
+	assert.Empty(t, m.Match("site-c"))
+
+	m.Delete("site-a.*", single)
+	m.Delete("site-a.>", tail)
+	assert.Empty(t, m.patterns)
+	assert.ElementsMatch(t, []*Client{exact, tail}, m.Match("site-a.floor-2"))
+	assert.Empty(t, m.Match("site-a.floor-2.room-1"))
+}
@@ -0,0 +1,263 @@
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/udpfw/common"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// presenceTTLFactor is the amount of presence intervals after which clients
+// announced by other instances are discarded unless announced again. All
+// instances of a cluster are expected to use the same interval.
+const presenceTTLFactor = 3
+
+type presenceEvent byte
+
+const (
+	presenceJoin presenceEvent = iota + 1
+	presenceHeartbeat
+	presenceLeave
+)
+
+var presenceEventToString = map[presenceEvent]string{
+	presenceJoin:      "join",
+	presenceHeartbeat: "heartbeat",
+	presenceLeave:     "leave",
+}
+
+func (e presenceEvent) String() string {
+	if s, ok := presenceEventToString[e]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// ClusterClientInfo describes a client connected to any dispatch instance of
+// the cluster, along with the instance it is connected to.
+type ClusterClientInfo struct {
+	Instance string `json:"instance"`
+	Host     string `json:"host"`
+	ClientInfo
+}
+
+// ClusterNamespaceInfo describes a namespace joined by clients across the
+// cluster. SingleMember is set for namespaces joined by a single client, on
+// which no traffic can be exchanged.
+type ClusterNamespaceInfo struct {
+	Name         string   `json:"name"`
+	Clients      []string `json:"clients"`
+	Instances    []string `json:"instances"`
+	SingleMember bool     `json:"single_member"`
+}
+
+type remotePresence struct {
+	info    ClusterClientInfo
+	expires time.Time
+}
+
+// PresenceRegistry holds clients connected to other dispatch instances, as
+// announced through the pubsub.
+type PresenceRegistry struct {
+	mu      sync.Mutex
+	clients map[string]remotePresence
+}
+
+func NewPresenceRegistry() *PresenceRegistry {
+	return &PresenceRegistry{clients: make(map[string]remotePresence)}
+}
+
+// Update registers or refreshes a remote client until the provided time.
+func (r *PresenceRegistry) Update(info ClusterClientInfo, expires time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[info.ID] = remotePresence{info: info, expires: expires}
+}
+
+// Remove discards a remote client, returning whether it was known.
+func (r *PresenceRegistry) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.clients[id]
+	delete(r.clients, id)
+	return ok
+}
+
+// Expire discards remote clients that were not refreshed in time, returning
+// their ids.
+func (r *PresenceRegistry) Expire(now time.Time) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expired []string
+	for id, p := range r.clients {
+		if now.After(p.expires) {
+			delete(r.clients, id)
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
+
+// Len returns the amount of known remote clients.
+func (r *PresenceRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.clients)
+}
+
+// List returns all known remote clients.
+func (r *PresenceRegistry) List() []ClusterClientInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]ClusterClientInfo, 0, len(r.clients))
+	for _, p := range r.clients {
+		result = append(result, p.info)
+	}
+	return result
+}
+
+func encodePresence(event presenceEvent, info ClusterClientInfo) (common.ClientMessage, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return common.NewClientMessage(common.ClientMessagePresence, append([]byte{byte(event)}, data...)), nil
+}
+
+func decodePresence(payload []byte) (presenceEvent, ClusterClientInfo, error) {
+	var info ClusterClientInfo
+	if len(payload) < 1 {
+		return 0, info, fmt.Errorf("truncated PRESENCE payload")
+	}
+	if err := json.Unmarshal(payload[1:], &info); err != nil {
+		return 0, info, err
+	}
+	return presenceEvent(payload[0]), info, nil
+}
+
+// announcePresence publishes a presence event about a local client to other
+// dispatch instances, in case presence is enabled.
+func (s *Server) announcePresence(c *Client, event presenceEvent) {
+	if s.presenceInterval <= 0 {
+		return
+	}
+	msg, err := encodePresence(event, ClusterClientInfo{Instance: s.instanceID, Host: s.hostname, ClientInfo: c.Info()})
+	if err != nil {
+		s.log.Error("Failed encoding presence", zap.String("client", c.id), zap.Error(err))
+		return
+	}
+	s.emitBroadcast(c.id, "", msg)
+}
+
+// handleRemotePresence records clients announced by other dispatch
+// instances.
+func (s *Server) handleRemotePresence(src string, data common.ClientMessage) {
+	event, info, err := decodePresence(data.Payload())
+	if err != nil {
+		s.log.Warn("Ignoring malformed remote PRESENCE message", zap.String("client", src), zap.Error(err))
+		return
+	}
+	if info.Instance == s.instanceID {
+		// Local clients are listed from the client map.
+		return
+	}
+
+	switch event {
+	case presenceJoin, presenceHeartbeat:
+		s.presence.Update(info, time.Now().Add(presenceTTLFactor*s.presenceInterval))
+	case presenceLeave:
+		s.presence.Remove(info.ID)
+	default:
+		s.log.Warn("Ignoring remote PRESENCE message with unknown event", zap.String("client", src))
+	}
+}
+
+// heartbeatPresence periodically re-announces local clients to other
+// instances, so instances started later learn about them, and discards
+// remote clients that were not announced in time.
+func (s *Server) heartbeatPresence() {
+	if s.presenceInterval <= 0 {
+		return
+	}
+	tick := time.NewTicker(s.presenceInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-tick.C:
+			s.clients.Range(func(_ string, c *Client) bool {
+				if c.hello.Load() != nil && !c.stopped.Load() {
+					s.announcePresence(c, presenceHeartbeat)
+				}
+				return true
+			})
+			if expired := s.presence.Expire(now); len(expired) > 0 {
+				s.log.Debug("Expired remote clients", zap.Int("count", len(expired)))
+				s.withdrawSegments(expired)
+			}
+		}
+	}
+}
+
+// ClusterClients returns information about clients connected to this and
+// other dispatch instances. Clients of other instances are only known when
+// presence is enabled, and may lag by up to a presence interval.
+func (s *Server) ClusterClients() []ClusterClientInfo {
+	var clients []ClusterClientInfo
+	s.clients.Range(func(_ string, c *Client) bool {
+		clients = append(clients, ClusterClientInfo{Instance: s.instanceID, Host: s.hostname, ClientInfo: c.Info()})
+		return true
+	})
+	clients = append(clients, s.presence.List()...)
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// ClusterNamespaces returns namespaces joined by clients across the cluster,
+// flagging those joined by a single client. Wildcard patterns are not listed
+// themselves; their subscribers are members of each namespace they match.
+func (s *Server) ClusterNamespaces() []ClusterNamespaceInfo {
+	clients := s.ClusterClients()
+	byName := map[string]*ClusterNamespaceInfo{}
+	for _, c := range clients {
+		for _, ns := range c.Namespaces {
+			if _, ok := byName[ns]; !ok && !common.IsNamespacePattern(ns) {
+				byName[ns] = &ClusterNamespaceInfo{Name: ns, Clients: []string{}, Instances: []string{}}
+			}
+		}
+	}
+
+	result := make([]ClusterNamespaceInfo, 0, len(byName))
+	for ns, info := range byName {
+		instances := map[string]bool{}
+		for _, c := range clients {
+			if !matchesAny(c.Namespaces, ns) {
+				continue
+			}
+			info.Clients = append(info.Clients, c.ID)
+			if !instances[c.Instance] {
+				instances[c.Instance] = true
+				info.Instances = append(info.Instances, c.Instance)
+			}
+		}
+		info.SingleMember = len(info.Clients) == 1
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// matchesAny determines whether any of the provided namespaces or patterns
+// matches ns.
+func matchesAny(namespaces []string, ns string) bool {
+	for _, pattern := range namespaces {
+		if common.NamespaceMatches(pattern, ns) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package tcp
+
+import (
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/dispatch/config"
+	"github.com/udpfw/dispatch/pubsub"
+	"testing"
+	"time"
+)
+
+func TestPresenceRegistry(t *testing.T) {
+	now := time.Now()
+	r := NewPresenceRegistry()
+	r.Update(ClusterClientInfo{Instance: "a", ClientInfo: ClientInfo{ID: "1"}}, now.Add(time.Second))
+	r.Update(ClusterClientInfo{Instance: "b", ClientInfo: ClientInfo{ID: "2"}}, now.Add(time.Minute))
+	assert.Equal(t, 2, r.Len())
+
+	assert.Equal(t, []string{"1"}, r.Expire(now.Add(2*time.Second)))
+	assert.Equal(t, []ClusterClientInfo{{Instance: "b", ClientInfo: ClientInfo{ID: "2"}}}, r.List())
+	assert.True(t, r.Remove("2"))
+	assert.False(t, r.Remove("2"))
+}
+
+func TestServer_ClusterPresence(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond, PresenceInterval: time.Minute})
+	defer func() { _ = srv.Shutdown() }()
+
+	local := connectClient(t, srv, "shared")
+	defer func() { _ = local.Close() }()
+	readMessage(t, local)
+
+	remote := ClusterClientInfo{
+		Instance:   nuid.Next(),
+		Host:       "dispatch-2",
+		ClientInfo: ClientInfo{ID: nuid.Next(), Namespaces: []string{"shared", "lonely"}},
+	}
+	announce := func(event presenceEvent) {
+		msg, err := encodePresence(event, remote)
+		require.NoError(t, err)
+		srv.dispatchPubSubMessage(pubsub.MakePacket(remote.Instance, remote.ID, "", msg, 0, nil))
+	}
+
+	announce(presenceJoin)
+	clients := srv.ClusterClients()
+	require.Len(t, clients, 2)
+	instances := map[string]string{}
+	for _, c := range clients {
+		instances[c.ID] = c.Instance
+	}
+	assert.Equal(t, remote.Instance, instances[remote.ID])
+	assert.Equal(t, 2, srv.Stats().ClusterClients)
+
+	namespaces := srv.ClusterNamespaces()
+	require.Len(t, namespaces, 2)
+	assert.Equal(t, "lonely", namespaces[0].Name)
+	assert.True(t, namespaces[0].SingleMember)
+	assert.Equal(t, "shared", namespaces[1].Name)
+	assert.False(t, namespaces[1].SingleMember)
+	assert.ElementsMatch(t, []string{srv.instanceID, remote.Instance}, namespaces[1].Instances)
+
+	announce(presenceLeave)
+	assert.Len(t, srv.ClusterClients(), 1)
+}
+
+func TestServer_ClusterNamespacesPatterns(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond, PresenceInterval: time.Minute})
+	defer func() { _ = srv.Shutdown() }()
+
+	local := connectClient(t, srv, "site-a.floor-2")
+	defer func() { _ = local.Close() }()
+	readMessage(t, local)
+
+	monitor := ClusterClientInfo{
+		Instance:   nuid.Next(),
+		ClientInfo: ClientInfo{ID: nuid.Next(), Namespaces: []string{"site-a.>", "site-b.*"}},
+	}
+	msg, err := encodePresence(presenceJoin, monitor)
+	require.NoError(t, err)
+	srv.dispatchPubSubMessage(pubsub.MakePacket(monitor.Instance, monitor.ID, "", msg, 0, nil))
+
+	// Patterns are resolved against concrete namespaces, and not listed.
+	namespaces := srv.ClusterNamespaces()
+	require.Len(t, namespaces, 1)
+	assert.Equal(t, "site-a.floor-2", namespaces[0].Name)
+	assert.Contains(t, namespaces[0].Clients, monitor.ID)
+	assert.Len(t, namespaces[0].Clients, 2)
+	assert.False(t, namespaces[0].SingleMember)
+	assert.ElementsMatch(t, []string{srv.instanceID, monitor.Instance}, namespaces[0].Instances)
+}
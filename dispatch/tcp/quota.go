@@ -0,0 +1,188 @@
+package tcp
+
+import (
+	"github.com/udpfw/dispatch/config"
+	"sync"
+	"time"
+)
+
+// quotaViolationGap is the maximum interval between two over-quota packets
+// for them to be considered part of the same violation.
+const quotaViolationGap = time.Second
+
+// rateLimiter enforces packets-per-second and bytes-per-second limits through
+// token buckets allowing bursts of up to one second worth of traffic. Zero
+// limits are not enforced.
+type rateLimiter struct {
+	mu         sync.Mutex
+	pps        float64
+	bps        float64
+	pktTokens  float64
+	byteTokens float64
+	last       time.Time
+}
+
+func newRateLimiter(pps, bps int, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		pps:        float64(pps),
+		bps:        float64(bps),
+		pktTokens:  float64(pps),
+		byteTokens: float64(bps),
+		last:       now,
+	}
+}
+
+func (r *rateLimiter) enabled() bool { return r.pps > 0 || r.bps > 0 }
+
+// allow determines whether a packet of the provided size fits the limits,
+// consuming tokens in case it does.
+func (r *rateLimiter) allow(size int, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.fits(size, now) {
+		return false
+	}
+	r.consume(size)
+	return true
+}
+
+// fits refills tokens and determines whether a packet of the provided size
+// fits the limits, without consuming tokens. mu must be held.
+func (r *rateLimiter) fits(size int, now time.Time) bool {
+	elapsed := now.Sub(r.last).Seconds()
+	r.last = now
+	r.pktTokens = min(r.pps, r.pktTokens+elapsed*r.pps)
+	r.byteTokens = min(r.bps, r.byteTokens+elapsed*r.bps)
+
+	if r.pps > 0 && r.pktTokens < 1 {
+		return false
+	}
+	return r.bps == 0 || r.byteTokens >= float64(size)
+}
+
+// consume spends tokens for a packet of the provided size. mu must be held.
+func (r *rateLimiter) consume(size int) {
+	if r.pps > 0 {
+		r.pktTokens--
+	}
+	if r.bps > 0 {
+		r.byteTokens -= float64(size)
+	}
+}
+
+// quotaVerdict indicates whether a message fits quotas, or which of them it
+// exceeds.
+type quotaVerdict int
+
+const (
+	quotaAllowed quotaVerdict = iota
+	quotaClientExceeded
+	quotaNamespaceExceeded
+)
+
+// quotaViolation tracks how long a client has been continuously exceeding
+// its quotas.
+type quotaViolation struct {
+	mu    sync.Mutex
+	start time.Time
+	last  time.Time
+}
+
+// record registers an over-quota packet, returning for how long the current
+// violation has been going on.
+func (v *quotaViolation) record(now time.Time) time.Duration {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.last.IsZero() || now.Sub(v.last) > quotaViolationGap {
+		v.start = now
+	}
+	v.last = now
+	return now.Sub(v.start)
+}
+
+// QuotaManager enforces per-namespace and per-client quotas configured
+// through config.QuotaConfig. Namespace limits apply to traffic emitted
+// through this instance only.
+type QuotaManager struct {
+	config     config.QuotaConfig
+	mu         sync.Mutex
+	namespaces map[string]*rateLimiter
+}
+
+func NewQuotaManager(cfg config.QuotaConfig) *QuotaManager {
+	return &QuotaManager{
+		config:     cfg,
+		namespaces: make(map[string]*rateLimiter),
+	}
+}
+
+// newClientLimiter returns a limiter for a new client, or nil in case no
+// client limits are configured.
+func (q *QuotaManager) newClientLimiter(now time.Time) *rateLimiter {
+	l := newRateLimiter(q.config.ClientMaxPPS, q.config.ClientMaxBPS, now)
+	if !l.enabled() {
+		return nil
+	}
+	return l
+}
+
+// Allow determines on which of the provided namespaces a message of the
+// provided size emitted by a client may be published. The client's quota is
+// charged once per message, regardless of the amount of namespaces, and only
+// in case a namespace's quota admits the message, so messages denied by
+// namespaces do not count against the client. The returned verdict is
+// quotaAllowed in case the message may be published on any namespace.
+func (q *QuotaManager) Allow(client *Client, namespaces []string, size int, now time.Time) ([]string, quotaVerdict) {
+	if client.limiter != nil {
+		client.limiter.mu.Lock()
+		defer client.limiter.mu.Unlock()
+		if !client.limiter.fits(size, now) {
+			return nil, quotaClientExceeded
+		}
+	}
+
+	allowed := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if l := q.namespaceLimiter(ns, now); l != nil && !l.allow(size, now) {
+			continue
+		}
+		allowed = append(allowed, ns)
+	}
+	if len(allowed) == 0 {
+		return nil, quotaNamespaceExceeded
+	}
+	if client.limiter != nil {
+		client.limiter.consume(size)
+	}
+	return allowed, quotaAllowed
+}
+
+// ShouldDisconnect records a quota violation by the provided client, which
+// must only be called when the client's own quota was exceeded, returning
+// whether it has been exceeding quotas for long enough to be disconnected.
+func (q *QuotaManager) ShouldDisconnect(client *Client, now time.Time) bool {
+	duration := client.violation.record(now)
+	return q.config.DisconnectAfter > 0 && duration >= q.config.DisconnectAfter
+}
+
+// Release discards state kept for a namespace without clients.
+func (q *QuotaManager) Release(ns string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.namespaces, ns)
+}
+
+func (q *QuotaManager) namespaceLimiter(ns string, now time.Time) *rateLimiter {
+	if q.config.NamespaceMaxPPS == 0 && q.config.NamespaceMaxBPS == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l, ok := q.namespaces[ns]
+	if !ok {
+		l = newRateLimiter(q.config.NamespaceMaxPPS, q.config.NamespaceMaxBPS, now)
+		q.namespaces[ns] = l
+	}
+	return l
+}
@@ -0,0 +1,148 @@
+package tcp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"github.com/udpfw/dispatch/config"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, 100, now)
+
+	assert.True(t, l.allow(40, now))
+	assert.True(t, l.allow(40, now))
+	assert.False(t, l.allow(10, now), "packet limit")
+
+	now = now.Add(time.Second)
+	assert.True(t, l.allow(90, now))
+	assert.False(t, l.allow(20, now), "byte limit")
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.allow(50, now))
+}
+
+func TestQuotaManager(t *testing.T) {
+	now := time.Now()
+	q := NewQuotaManager(config.QuotaConfig{
+		ClientMaxPPS:    1,
+		NamespaceMaxPPS: 2,
+		DisconnectAfter: 2 * time.Second,
+	})
+	a := &Client{limiter: q.newClientLimiter(now)}
+	b := &Client{limiter: q.newClientLimiter(now)}
+	c := &Client{limiter: q.newClientLimiter(now)}
+	d := &Client{limiter: q.newClientLimiter(now)}
+
+	assertAllowed := func(c *Client, ns string, want quotaVerdict, msgAndArgs ...any) {
+		allowed, verdict := q.Allow(c, []string{ns}, 10, now)
+		assert.Equal(t, want, verdict, msgAndArgs...)
+		if want == quotaAllowed {
+			assert.Equal(t, []string{ns}, allowed, msgAndArgs...)
+		} else {
+			assert.Empty(t, allowed, msgAndArgs...)
+		}
+	}
+	assertAllowed(a, "ns", quotaAllowed)
+	assertAllowed(a, "ns", quotaClientExceeded)
+	assertAllowed(b, "ns", quotaAllowed)
+	assertAllowed(c, "ns", quotaNamespaceExceeded, "namespace limit")
+	assertAllowed(d, "other", quotaAllowed)
+
+	// Denials by the namespace do not consume the client's tokens.
+	assertAllowed(c, "other", quotaAllowed)
+
+	assert.False(t, q.ShouldDisconnect(a, now))
+	assert.False(t, q.ShouldDisconnect(a, now.Add(900*time.Millisecond)))
+	assert.False(t, q.ShouldDisconnect(a, now.Add(1800*time.Millisecond)))
+	assert.True(t, q.ShouldDisconnect(a, now.Add(2700*time.Millisecond)))
+
+	// Violations separated by more than quotaViolationGap start over.
+	assert.False(t, q.ShouldDisconnect(b, now))
+	assert.False(t, q.ShouldDisconnect(b, now.Add(5*time.Second)))
+}
+
+func TestServer_NamespaceQuotaKeepsQuietClients(t *testing.T) {
+	srv := startServer(t, &config.Context{
+		DrainTimeout: 100 * time.Millisecond,
+		Quotas:       config.QuotaConfig{NamespaceMaxPPS: 1, ClientMaxPPS: 1000, DisconnectAfter: time.Nanosecond},
+	})
+	defer func() { _ = srv.Shutdown() }()
+
+	noisy := connectClient(t, srv, "ns")
+	defer func() { _ = noisy.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, noisy).Type())
+	quiet := connectClient(t, srv, "ns")
+	defer func() { _ = quiet.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, quiet).Type())
+
+	_, err := noisy.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("flood")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("flood"), []byte(readMessage(t, quiet).Payload()))
+	for i := 0; i < 2; i++ {
+		_, err = quiet.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("quiet")))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return srv.Stats().QuotaDropped == 2 }, time.Second, 10*time.Millisecond)
+	assert.Zero(t, srv.Stats().QuotaDisconnects)
+}
+
+func TestNSMap_AddLimited(t *testing.T) {
+	m := &NSMap{}
+	assert.True(t, m.AddLimited("ns", &Client{}, 2))
+	assert.True(t, m.AddLimited("ns", &Client{}, 2))
+	assert.False(t, m.AddLimited("ns", &Client{}, 2))
+	assert.True(t, m.AddLimited("ns", &Client{}, 0))
+	assert.Equal(t, 3, m.Len("ns"))
+}
+
+func TestQuotaManager_SeveralNamespaces(t *testing.T) {
+	now := time.Now()
+	q := NewQuotaManager(config.QuotaConfig{ClientMaxPPS: 1, NamespaceMaxPPS: 1})
+	a := &Client{limiter: q.newClientLimiter(now)}
+	b := &Client{limiter: q.newClientLimiter(now)}
+
+	// A single message published on several namespaces is charged once to
+	// the client.
+	allowed, verdict := q.Allow(a, []string{"x", "y"}, 10, now)
+	assert.Equal(t, quotaAllowed, verdict)
+	assert.Equal(t, []string{"x", "y"}, allowed)
+
+	allowed, verdict = q.Allow(b, []string{"y", "z"}, 10, now)
+	assert.Equal(t, quotaAllowed, verdict)
+	assert.Equal(t, []string{"z"}, allowed)
+
+	_, verdict = q.Allow(a, []string{"z"}, 10, now)
+	assert.Equal(t, quotaClientExceeded, verdict)
+}
+
+func TestServer_ClientQuotaChargedOncePerMessage(t *testing.T) {
+	srv := startServer(t, &config.Context{
+		DrainTimeout: 100 * time.Millisecond,
+		Quotas:       config.QuotaConfig{ClientMaxPPS: 1, DisconnectAfter: time.Nanosecond},
+	})
+	defer func() { _ = srv.Shutdown() }()
+
+	sender := connectHello(t, srv, common.Hello{Namespaces: []string{"a", "b"}})
+	defer func() { _ = sender.Close() }()
+	receivers := []net.Conn{
+		connectHello(t, srv, common.Hello{Namespaces: []string{"a"}}),
+		connectHello(t, srv, common.Hello{Namespaces: []string{"b"}}),
+	}
+	for _, r := range receivers {
+		defer func(r net.Conn) { _ = r.Close() }(r)
+	}
+
+	_, err := sender.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("once")))
+	require.NoError(t, err)
+	for _, r := range receivers {
+		assert.Equal(t, []byte("once"), []byte(readMessage(t, r).Payload()))
+	}
+	stats := srv.Stats()
+	assert.Zero(t, stats.QuotaDropped)
+	assert.Zero(t, stats.QuotaDisconnects)
+}
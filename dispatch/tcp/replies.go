@@ -0,0 +1,102 @@
+package tcp
+
+import (
+	"bytes"
+	"github.com/udpfw/common"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQueryOrigins bounds the amount of queriers tracked by
+	// queryOrigins. Queries from further queriers are not tracked, and
+	// replies to them are dropped.
+	maxQueryOrigins = 4096
+
+	// queryOriginTimeout determines for how long replies to a query are
+	// delivered to the client which published it. It must exceed the reply
+	// relay timeout of nodelets.
+	queryOriginTimeout = time.Minute
+)
+
+var ssdpSearchPrefix = []byte("M-SEARCH")
+
+// isUnicastQuery determines whether a frame may be a query whose replies are
+// sent through unicast to the querier, namely a mDNS query or a SSDP
+// M-SEARCH request. Nodelets relaying replies apply stricter rules.
+func isUnicastQuery(info common.FrameInfo) bool {
+	switch info.DstPort {
+	case 5353:
+		// Replies have the QR bit of the DNS header set.
+		return len(info.Payload) >= 3 && info.Payload[2]&0x80 == 0
+	case 1900:
+		return bytes.HasPrefix(info.Payload, ssdpSearchPrefix)
+	default:
+		return false
+	}
+}
+
+type queryOrigin struct {
+	client  string
+	expires time.Time
+}
+
+// queryOrigins remembers which client published queries emitted by each
+// querier, so replies relayed by nodelets injecting them are delivered back
+// to that client only. Replies are matched through their destination, which
+// nodelets set to the original querier.
+type queryOrigins struct {
+	mu      sync.Mutex
+	origins map[string]queryOrigin
+}
+
+func newQueryOrigins() *queryOrigins {
+	return &queryOrigins{origins: make(map[string]queryOrigin)}
+}
+
+// Observe records the client publishing a frame, in case it is a query.
+func (q *queryOrigins) Observe(src string, frame []byte, now time.Time) {
+	info, ok := common.ParseFrame(frame)
+	if !ok || !isUnicastQuery(info) {
+		return
+	}
+	key := (&net.UDPAddr{IP: info.Src, Port: int(info.SrcPort)}).String()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.origins[key]; !ok && len(q.origins) >= maxQueryOrigins {
+		q.prune(now)
+		if len(q.origins) >= maxQueryOrigins {
+			return
+		}
+	}
+	q.origins[key] = queryOrigin{client: src, expires: now.Add(queryOriginTimeout)}
+}
+
+// Origin returns the client which published the query the provided reply
+// frame answers.
+func (q *queryOrigins) Origin(frame []byte, now time.Time) (string, bool) {
+	info, ok := common.ParseFrame(frame)
+	if !ok {
+		return "", false
+	}
+	key := (&net.UDPAddr{IP: info.Dst, Port: int(info.DstPort)}).String()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	origin, ok := q.origins[key]
+	if !ok || !now.Before(origin.expires) {
+		return "", false
+	}
+	return origin.client, true
+}
+
+// prune discards expired origins. mu must be held.
+func (q *queryOrigins) prune(now time.Time) {
+	for k, o := range q.origins {
+		if !now.Before(o.expires) {
+			delete(q.origins, k)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"github.com/udpfw/dispatch/config"
+	"github.com/udpfw/dispatch/pubsub"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	mdnsQuery    = []byte{0, 0, 0x00, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	mdnsResponse = []byte{0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0}
+)
+
+// datagramFrame returns an Ethernet frame carrying an IPv4 UDP datagram with
+// the provided addressing and payload.
+func datagramFrame(src string, srcPort uint16, dst string, dstPort uint16, payload []byte) []byte {
+	frame := make([]byte, 14+20+8, 14+20+8+len(payload))
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	ip[9] = 17
+	copy(ip[12:16], net.ParseIP(src).To4())
+	copy(ip[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(ip[20:22], srcPort)
+	binary.BigEndian.PutUint16(ip[22:24], dstPort)
+	return append(frame, payload...)
+}
+
+func TestQueryOrigins(t *testing.T) {
+	now := time.Now()
+	q := newQueryOrigins()
+	q.Observe("a", datagramFrame("192.168.0.10", 40000, "224.0.0.251", 5353, mdnsQuery), now)
+	q.Observe("b", datagramFrame("192.168.0.11", 5353, "224.0.0.251", 5353, mdnsResponse), now)
+	q.Observe("c", datagramFrame("192.168.0.12", 40000, "239.255.255.250", 1900, []byte("M-SEARCH * HTTP/1.1\r\n")), now)
+	q.Observe("d", datagramFrame("192.168.0.13", 1900, "239.255.255.250", 1900, []byte("NOTIFY * HTTP/1.1\r\n")), now)
+
+	origin, ok := q.Origin(datagramFrame("10.0.0.5", 5353, "192.168.0.10", 40000, mdnsResponse), now)
+	assert.True(t, ok)
+	assert.Equal(t, "a", origin)
+	origin, ok = q.Origin(datagramFrame("10.0.0.5", 1900, "192.168.0.12", 40000, []byte("HTTP/1.1 200 OK\r\n")), now)
+	assert.True(t, ok)
+	assert.Equal(t, "c", origin)
+	_, ok = q.Origin(datagramFrame("10.0.0.5", 5353, "192.168.0.11", 5353, mdnsResponse), now)
+	assert.False(t, ok, "responses are not queries")
+	_, ok = q.Origin(datagramFrame("10.0.0.5", 1900, "192.168.0.13", 1900, nil), now)
+	assert.False(t, ok, "notifications are not queries")
+
+	_, ok = q.Origin(datagramFrame("10.0.0.5", 5353, "192.168.0.10", 40000, mdnsResponse), now.Add(queryOriginTimeout))
+	assert.False(t, ok, "expired query")
+}
+
+func TestQueryOrigins_Bounded(t *testing.T) {
+	now := time.Now()
+	q := newQueryOrigins()
+	for i := 0; i < maxQueryOrigins; i++ {
+		q.Observe("a", datagramFrame("192.168.0.10", uint16(1024+i), "224.0.0.251", 5353, mdnsQuery), now)
+	}
+	late := datagramFrame("192.168.0.11", 40000, "224.0.0.251", 5353, mdnsQuery)
+	reply := datagramFrame("10.0.0.5", 5353, "192.168.0.11", 40000, mdnsResponse)
+	q.Observe("b", late, now)
+	_, ok := q.Origin(reply, now)
+	assert.False(t, ok)
+
+	// Expired queries make room for new ones.
+	later := now.Add(queryOriginTimeout)
+	q.Observe("b", late, later)
+	origin, ok := q.Origin(reply, later)
+	assert.True(t, ok)
+	assert.Equal(t, "b", origin)
+	assert.Len(t, q.origins, 1)
+}
+
+func TestServer_ReplyToOrigin(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn := connectClient(t, srv, "lan")
+		defer func() { _ = conn.Close() }()
+		assert.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+		conns = append(conns, conn)
+	}
+	querier, responder, bystander := conns[0], conns[1], conns[2]
+
+	query := common.NewClientMessage(common.ClientMessagePkt,
+		datagramFrame("192.168.0.10", 40000, "224.0.0.251", 5353, mdnsQuery))
+	_, err := querier.Write(query)
+	require.NoError(t, err)
+	assert.Equal(t, query, readMessage(t, responder))
+	assert.Equal(t, query, readMessage(t, bystander))
+
+	reply := common.NewClientMessage(common.ClientMessageReply,
+		datagramFrame("10.0.0.5", 5353, "192.168.0.10", 40000, mdnsResponse))
+	_, err = responder.Write(reply)
+	require.NoError(t, err)
+	assert.Equal(t, reply, readMessage(t, querier))
+
+	// Replies to queries published by clients of other instances, or to
+	// unknown queries, are not delivered locally.
+	remoteQuery := common.NewClientMessage(common.ClientMessagePkt,
+		datagramFrame("192.168.0.20", 40000, "224.0.0.251", 5353, mdnsQuery))
+	require.NoError(t, srv.pubSub.Broadcast(pubsub.MakePacket(
+		"LKJIHGFEDCBA9876543210", "0123456789ABCDEFGHIJKL", "lan", remoteQuery, 0, nil)))
+	for _, conn := range conns {
+		assert.Equal(t, remoteQuery, readMessage(t, conn))
+	}
+	for _, dst := range []string{"192.168.0.20", "192.168.0.30"} {
+		_, err = responder.Write(common.NewClientMessage(common.ClientMessageReply,
+			datagramFrame("10.0.0.5", 5353, dst, 40000, mdnsResponse)))
+		require.NoError(t, err)
+	}
+
+	for _, conn := range []net.Conn{querier, bystander} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	}
+}
@@ -0,0 +1,147 @@
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/udpfw/common"
+	"net"
+	"os"
+)
+
+// RoutingTable bridges namespaces, delivering PKT frames published on a
+// namespace to members of other namespaces. Routes are one-way, and frames
+// delivered through a route are not routed any further.
+type RoutingTable struct {
+	Routes []Route `json:"routes"`
+}
+
+// Route delivers frames published on namespaces matching From, which may be a
+// wildcard pattern, to members of each namespace in To. In case a filter is
+// provided, only matching frames are routed.
+type Route struct {
+	From   string      `json:"from"`
+	To     []string    `json:"to"`
+	Filter RouteFilter `json:"filter,omitempty"`
+}
+
+// RouteFilter restricts frames routed through a Route. Frames must be destined
+// to one of the provided ports and one of the provided groups; empty lists
+// match any port or group.
+type RouteFilter struct {
+	Ports  []uint16 `json:"ports,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	groups []net.IP
+}
+
+// LoadRoutingTable reads and validates a routing table from a JSON file.
+func LoadRoutingTable(path string) (*RoutingTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRoutingTable(data)
+}
+
+// ParseRoutingTable parses and validates a JSON routing table.
+func ParseRoutingTable(data []byte) (*RoutingTable, error) {
+	var table RoutingTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("invalid routing table: %w", err)
+	}
+	for i := range table.Routes {
+		r := &table.Routes[i]
+		if err := common.ValidateNamespace(r.From); err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+		if len(r.To) == 0 {
+			return nil, fmt.Errorf("route %d: no destination namespaces", i)
+		}
+		for _, ns := range r.To {
+			if err := common.ValidateNamespace(ns); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			if common.IsNamespacePattern(ns) {
+				return nil, fmt.Errorf("route %d: destination %q must not be a wildcard pattern", i, ns)
+			}
+		}
+		for _, g := range r.Filter.Groups {
+			ip := net.ParseIP(g)
+			if ip == nil {
+				return nil, fmt.Errorf("route %d: invalid group %q", i, g)
+			}
+			r.Filter.groups = append(r.Filter.groups, ip)
+		}
+	}
+	return &table, nil
+}
+
+// Destinations returns namespaces a frame published on ns must be routed to,
+// without duplicates. info holds addressing information of the frame, and ok
+// indicates whether it could be parsed; unparsed frames only match routes
+// without filters.
+func (t *RoutingTable) Destinations(ns string, info common.FrameInfo, ok bool) []string {
+	if t == nil {
+		return nil
+	}
+	var result []string
+	seen := map[string]bool{ns: true}
+	for _, r := range t.Routes {
+		if !common.NamespaceMatches(r.From, ns) || !r.Filter.matches(info, ok) {
+			continue
+		}
+		for _, dst := range r.To {
+			if !seen[dst] {
+				seen[dst] = true
+				result = append(result, dst)
+			}
+		}
+	}
+	return result
+}
+
+func (f RouteFilter) matches(info common.FrameInfo, ok bool) bool {
+	if len(f.Ports) == 0 && len(f.groups) == 0 {
+		return true
+	}
+	if !ok {
+		return false
+	}
+	if len(f.Ports) > 0 {
+		found := false
+		for _, p := range f.Ports {
+			if p == info.DstPort {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.groups) > 0 {
+		found := false
+		for _, g := range f.groups {
+			if g.Equal(info.Dst) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// SetRoutingTable replaces the routing table applied to frames. A nil table
+// disables routing.
+func (s *Server) SetRoutingTable(table *RoutingTable) {
+	s.routes.Store(table)
+}
+
+// RoutingTable returns the routing table currently applied to frames, or nil
+// in case routing is disabled.
+func (s *Server) RoutingTable() *RoutingTable {
+	return s.routes.Load()
+}
@@ -0,0 +1,118 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"github.com/udpfw/dispatch/config"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// udpFrame returns an Ethernet frame carrying an IPv4 UDP datagram destined
+// to the provided address and port.
+func udpFrame(dst string, port uint16) []byte {
+	frame := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	ip[9] = 17
+	copy(ip[12:16], net.ParseIP("192.168.0.10").To4())
+	copy(ip[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(ip[20:22], port)
+	binary.BigEndian.PutUint16(ip[22:24], port)
+	return frame
+}
+
+func TestParseRoutingTable(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		table, err := ParseRoutingTable([]byte(`{"routes": [
+			{"from": "printers", "to": ["office-a", "office-b"], "filter": {"ports": [5353], "groups": ["224.0.0.251"]}},
+			{"from": "site-a.>", "to": ["monitoring"]}
+		]}`))
+		require.NoError(t, err)
+		require.Len(t, table.Routes, 2)
+		assert.Equal(t, []string{"office-a", "office-b"}, table.Routes[0].To)
+	})
+
+	for name, data := range map[string]string{
+		"malformed":            `{"routes": [`,
+		"invalid source":       `{"routes": [{"from": "a..b", "to": ["b"]}]}`,
+		"missing destinations": `{"routes": [{"from": "a"}]}`,
+		"pattern destination":  `{"routes": [{"from": "a", "to": ["b.*"]}]}`,
+		"invalid group":        `{"routes": [{"from": "a", "to": ["b"], "filter": {"groups": ["nope"]}}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseRoutingTable([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRoutingTable_Destinations(t *testing.T) {
+	table, err := ParseRoutingTable([]byte(`{"routes": [
+		{"from": "printers", "to": ["office-a", "office-b"], "filter": {"ports": [5353], "groups": ["224.0.0.251"]}},
+		{"from": "site-a.*", "to": ["office-b", "monitoring"]}
+	]}`))
+	require.NoError(t, err)
+
+	mdns, ok := common.ParseFrame(udpFrame("224.0.0.251", 5353))
+	require.True(t, ok)
+	ssdp, ok := common.ParseFrame(udpFrame("239.255.255.250", 1900))
+	require.True(t, ok)
+
+	assert.Equal(t, []string{"office-a", "office-b"}, table.Destinations("printers", mdns, true))
+	assert.Empty(t, table.Destinations("printers", ssdp, true))
+	assert.Empty(t, table.Destinations("printers", common.FrameInfo{}, false))
+	assert.Empty(t, table.Destinations("office-a", mdns, true))
+	assert.Equal(t, []string{"office-b", "monitoring"}, table.Destinations("site-a.floor-2", ssdp, true))
+
+	var disabled *RoutingTable
+	assert.Empty(t, disabled.Destinations("printers", mdns, true))
+}
+
+func TestServer_Routing(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+	table, err := ParseRoutingTable([]byte(`{"routes": [{"from": "printers", "to": ["office-a"]}]}`))
+	require.NoError(t, err)
+	srv.SetRoutingTable(table)
+
+	printers := connectClient(t, srv, "printers")
+	defer func() { _ = printers.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, printers).Type())
+	office := connectClient(t, srv, "office-a")
+	defer func() { _ = office.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, office).Type())
+	both := connectHello(t, srv, common.Hello{Namespaces: []string{"printers", "office-a"}})
+	defer func() { _ = both.Close() }()
+
+	frame := udpFrame("224.0.0.251", 5353)
+	_, err = printers.Write(common.NewClientMessage(common.ClientMessagePkt, frame))
+	require.NoError(t, err)
+	msg := readMessage(t, office)
+	assert.Equal(t, common.ClientMessagePkt, msg.Type())
+	assert.Equal(t, frame, []byte(msg.Payload()))
+
+	// Clients reached both directly and through a route receive the frame
+	// once, tagged with the namespace it was published on.
+	msg = readMessage(t, both)
+	require.Equal(t, common.ClientMessageNsPkt, msg.Type())
+	ns, _, err := common.DecodeNsPkt(msg.Payload())
+	require.NoError(t, err)
+	assert.Equal(t, "printers", ns)
+	require.NoError(t, both.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = both.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// Routes are one-way.
+	_, err = office.Write(common.NewClientMessage(common.ClientMessagePkt, frame))
+	require.NoError(t, err)
+	require.NoError(t, printers.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = printers.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, uint64(1), srv.Stats().RoutedFrames)
+}
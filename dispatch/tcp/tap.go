@@ -0,0 +1,75 @@
+package tcp
+
+import (
+	"github.com/udpfw/common"
+	"sync"
+	"time"
+)
+
+// tapBufferSize is the amount of frames buffered for each tap subscriber.
+// Frames are dropped for subscribers falling behind.
+const tapBufferSize = 256
+
+// TappedFrame is a frame forwarded on a namespace, delivered to subscribers
+// registered through Server.Tap.
+type TappedFrame struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Client    string    `json:"client"`
+	Reply     bool      `json:"reply,omitempty"`
+	Frame     []byte    `json:"frame"`
+}
+
+type tapRegistry struct {
+	mu   sync.RWMutex
+	taps map[string]map[chan TappedFrame]struct{}
+}
+
+func newTapRegistry() *tapRegistry {
+	return &tapRegistry{taps: make(map[string]map[chan TappedFrame]struct{})}
+}
+
+func (t *tapRegistry) subscribe(ns string) (<-chan TappedFrame, func()) {
+	ch := make(chan TappedFrame, tapBufferSize)
+	t.mu.Lock()
+	if t.taps[ns] == nil {
+		t.taps[ns] = make(map[chan TappedFrame]struct{})
+	}
+	t.taps[ns][ch] = struct{}{}
+	t.mu.Unlock()
+
+	once := sync.Once{}
+	return ch, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			delete(t.taps[ns], ch)
+			if len(t.taps[ns]) == 0 {
+				delete(t.taps, ns)
+			}
+		})
+	}
+}
+
+func (t *tapRegistry) publish(ns string, frame TappedFrame) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for pattern, subscribers := range t.taps {
+		if !common.NamespaceMatches(pattern, ns) {
+			continue
+		}
+		for ch := range subscribers {
+			select {
+			case ch <- frame:
+			default:
+			}
+		}
+	}
+}
+
+// Tap subscribes to frames forwarded on a namespace through this instance,
+// including those emitted by clients of other instances. The namespace may be
+// a wildcard pattern. The returned function releases the subscription.
+func (s *Server) Tap(ns string) (<-chan TappedFrame, func()) {
+	return s.taps.subscribe(ns)
+}
@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"errors"
+	"fmt"
 	"github.com/nats-io/nuid"
 	"github.com/udpfw/common"
 	"github.com/udpfw/dispatch/config"
@@ -10,9 +11,15 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var DrainTimeoutErr = fmt.Errorf("clients did not disconnect before the drain deadline")
+
+// forceCloseGrace is the time given to forcibly closed clients to stop.
+const forceCloseGrace = 2 * time.Second
+
 func New(ctx *config.Context, pubSub pubsub.PubSub) (*Server, error) {
 	listener, err := net.Listen("tcp", ctx.BindAddress)
 	if err != nil {
@@ -21,6 +28,14 @@ func New(ctx *config.Context, pubSub pubsub.PubSub) (*Server, error) {
 
 	log := zap.L().With(zap.String("facility", "TCP"))
 
+	var recorder *common.Recorder
+	if ctx.Recording != nil {
+		if recorder, err = common.NewRecorder(*ctx.Recording); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Warn("Failed obtaining hostname", zap.Error(err))
@@ -28,39 +43,198 @@ func New(ctx *config.Context, pubSub pubsub.PubSub) (*Server, error) {
 	}
 
 	return &Server{
-		hostname:   hostname,
-		log:        log,
-		listener:   listener,
-		clients:    &ClientMap{},
-		namespaces: &NSMap{},
-		idGen:      nuid.New(),
-		pubSub:     pubSub,
-		wg:         &sync.WaitGroup{},
+		hostname:         hostname,
+		instanceID:       nuid.Next(),
+		log:              log,
+		listener:         listener,
+		clients:          &ClientMap{},
+		namespaces:       &NSMap{},
+		idGen:            nuid.New(),
+		pubSub:           pubSub,
+		wg:               &sync.WaitGroup{},
+		groups:           NewGroupRegistry(),
+		quotas:           NewQuotaManager(ctx.Quotas),
+		recorder:         recorder,
+		drainTimeout:     ctx.DrainTimeout,
+		handover:         ctx.Handover,
+		keepalive:        ctx.Keepalive,
+		taps:             newTapRegistry(),
+		dedupe:           newDedupeWindow(ctx.DedupeWindow),
+		queries:          newQueryOrigins(),
+		elections:        NewSegmentElection(),
+		presence:         NewPresenceRegistry(),
+		presenceInterval: ctx.PresenceInterval,
+		stop:             make(chan bool),
 	}, nil
 }
 
 type Server struct {
-	listener   net.Listener
-	clients    *ClientMap
-	log        *zap.Logger
-	idGen      *nuid.NUID
-	pubSub     pubsub.PubSub
-	wg         *sync.WaitGroup
-	hostname   string
-	namespaces *NSMap
+	listener         net.Listener
+	clients          *ClientMap
+	log              *zap.Logger
+	idGen            *nuid.NUID
+	pubSub           pubsub.PubSub
+	wg               *sync.WaitGroup
+	hostname         string
+	instanceID       string
+	namespaces       *NSMap
+	groups           *GroupRegistry
+	quotas           *QuotaManager
+	recorder         *common.Recorder
+	drainTimeout     time.Duration
+	handover         common.ByeRedirect
+	keepalive        config.KeepaliveConfig
+	taps             *tapRegistry
+	dedupe           *dedupeWindow
+	queries          *queryOrigins
+	elections        *SegmentElection
+	presence         *PresenceRegistry
+	presenceInterval time.Duration
+	stop             chan bool
+
+	quotaDropped        atomic.Uint64
+	quotaDroppedBytes   atomic.Uint64
+	quotaDisconnects    atomic.Uint64
+	namespaceRejections atomic.Uint64
+	keepaliveTimeouts   atomic.Uint64
+	pausedDropped       atomic.Uint64
+	directionDropped    atomic.Uint64
+	routedFrames        atomic.Uint64
+	dedupeDropped       atomic.Uint64
+	standbyDropped      atomic.Uint64
+
+	// paused holds namespaces paused through PauseNamespace.
+	paused sync.Map
+
+	// routes holds the routing table applied to frames, and is nil when
+	// routing is disabled.
+	routes atomic.Pointer[RoutingTable]
+}
+
+// ServerStats contains counters describing the operation of a Server.
+type ServerStats struct {
+	Instance            string `json:"instance"`
+	Clients             int    `json:"clients"`
+	ClusterClients      int    `json:"cluster_clients"`
+	QuotaDropped        uint64 `json:"quota_dropped"`
+	QuotaDroppedBytes   uint64 `json:"quota_dropped_bytes"`
+	QuotaDisconnects    uint64 `json:"quota_disconnects"`
+	NamespaceRejections uint64 `json:"namespace_rejections"`
+	KeepaliveTimeouts   uint64 `json:"keepalive_timeouts"`
+	PausedDropped       uint64 `json:"paused_dropped"`
+	DirectionDropped    uint64 `json:"direction_dropped"`
+	RoutedFrames        uint64 `json:"routed_frames"`
+	DedupeDropped       uint64 `json:"dedupe_dropped"`
+	StandbyDropped      uint64 `json:"standby_dropped"`
+	AvgRTTMicros        int64  `json:"avg_rtt_us"`
+	MaxRTTMicros        int64  `json:"max_rtt_us"`
+
+	// ClientVersions counts connected clients per advertised version.
+	ClientVersions map[string]int `json:"client_versions"`
 }
 
 func (s *Server) CountConnected() int {
 	return s.clients.Len()
 }
 
+// Stats returns a snapshot of the server's counters.
+func (s *Server) Stats() ServerStats {
+	stats := ServerStats{
+		Instance:            s.instanceID,
+		Clients:             s.CountConnected(),
+		ClusterClients:      s.CountConnected() + s.presence.Len(),
+		QuotaDropped:        s.quotaDropped.Load(),
+		QuotaDroppedBytes:   s.quotaDroppedBytes.Load(),
+		QuotaDisconnects:    s.quotaDisconnects.Load(),
+		NamespaceRejections: s.namespaceRejections.Load(),
+		KeepaliveTimeouts:   s.keepaliveTimeouts.Load(),
+		PausedDropped:       s.pausedDropped.Load(),
+		DirectionDropped:    s.directionDropped.Load(),
+		RoutedFrames:        s.routedFrames.Load(),
+		DedupeDropped:       s.dedupeDropped.Load(),
+		StandbyDropped:      s.standbyDropped.Load(),
+		ClientVersions:      make(map[string]int),
+	}
+
+	var total time.Duration
+	measured := 0
+	s.clients.Range(func(_ string, c *Client) bool {
+		if hello := c.hello.Load(); hello != nil {
+			version := hello.Version
+			if version == "" {
+				version = "unknown"
+			}
+			stats.ClientVersions[version]++
+		}
+		if rtt := c.RTT(); rtt > 0 {
+			total += rtt
+			measured++
+			stats.MaxRTTMicros = max(stats.MaxRTTMicros, rtt.Microseconds())
+		}
+		return true
+	})
+	if measured > 0 {
+		stats.AvgRTTMicros = (total / time.Duration(measured)).Microseconds()
+	}
+	return stats
+}
+
+// Clients returns information about all connected clients.
+func (s *Server) Clients() []ClientInfo {
+	var clients []ClientInfo
+	s.clients.Range(func(_ string, c *Client) bool {
+		clients = append(clients, c.Info())
+		return true
+	})
+	return clients
+}
+
+// emitBroadcast delivers a message emitted by a local client to other local
+// clients, and publishes it to other dispatch instances. Published packets
+// carry this instance's identifier, so they are not delivered again once
+// they are read back from the pubsub, along with the hash of their frame, so
+// other instances suppress duplicates captured by their own clients.
 func (s *Server) emitBroadcast(id string, ns string, data common.ClientMessage) {
-	pkt := pubsub.MakePacket(id, ns, data)
-	if err := s.pubSub.Broadcast(pkt); err != nil {
-		s.log.Error("CRITICAL: Failed emitting broadcast",
-			zap.String("client", id),
-			zap.ByteString("payload", data),
-			zap.Error(err))
+	s.emitFanOut(id, []string{ns}, data)
+}
+
+// emitFanOut is emitBroadcast for a message published on several namespaces
+// at once. Local clients which are members of several of them receive it
+// once. Each namespace is published as a distinct packet listing all of
+// them, so other instances apply the same rule.
+func (s *Server) emitFanOut(id string, namespaces []string, data common.ClientMessage) {
+	var hash uint64
+	if data.Type() == common.ClientMessagePkt {
+		hash = frameHash(data.Payload())
+		now := time.Now()
+		var fresh []string
+		for _, ns := range namespaces {
+			if s.dedupe.duplicate(ns, hash, id, now) {
+				s.dedupeDropped.Add(1)
+				continue
+			}
+			fresh = append(fresh, ns)
+		}
+		namespaces = fresh
+	}
+
+	var delivered map[*Client]bool
+	var fanOut []string
+	if len(namespaces) > 1 {
+		delivered = make(map[*Client]bool)
+		fanOut = namespaces
+	}
+	for _, ns := range namespaces {
+		s.dispatchMessage(id, ns, data, delivered)
+	}
+	for _, ns := range namespaces {
+		pkt := pubsub.MakePacket(s.instanceID, id, ns, data, hash, fanOut)
+		if err := s.pubSub.Broadcast(pkt); err != nil {
+			s.log.Error("CRITICAL: Failed emitting broadcast",
+				zap.String("client", id),
+				zap.ByteString("payload", data),
+				zap.Error(err))
+		}
 	}
 }
 
@@ -71,10 +245,262 @@ func (s *Server) unregisterClient(id string) {
 }
 
 func (s *Server) dispatchPubSubMessage(msg pubsub.PacketData) {
+	if msg.Instance() == s.instanceID {
+		// Already delivered to local clients by emitBroadcast.
+		return
+	}
 	src, ns, data := msg.Deconstruct()
-	for _, cli := range s.namespaces.Get(ns) {
-		if cli.id != src {
+	if common.ClientMessage(data).Type() == common.ClientMessagePkt {
+		hash := msg.Hash()
+		if hash == 0 {
+			hash = frameHash(common.ClientMessage(data).Payload())
+		}
+		if s.dedupe.duplicate(ns, hash, src, time.Now()) {
+			s.dedupeDropped.Add(1)
+			return
+		}
+	}
+
+	var delivered map[*Client]bool
+	if fanOut := msg.FanOut(); len(fanOut) > 1 {
+		delivered = s.deliveredBefore(src, ns, fanOut, data)
+	}
+	s.dispatchMessage(src, ns, data, delivered)
+}
+
+// deliveredBefore returns local clients which received a frame published on
+// several namespaces through those preceding ns in its fan-out list, as each
+// of them is read from the pubsub as a distinct packet.
+func (s *Server) deliveredBefore(src, ns string, fanOut []string, data []byte) map[*Client]bool {
+	delivered := make(map[*Client]bool)
+	for _, prev := range fanOut {
+		if prev == ns {
+			break
+		}
+		if s.isPaused(prev) {
+			continue
+		}
+		dst, routed := s.destinations(prev, data)
+		s.recipients(src, prev, dst, delivered)
+		for _, target := range routed {
+			if !s.isPaused(target) {
+				s.recipients(src, target, dst, delivered)
+			}
+		}
+	}
+	return delivered
+}
+
+// dispatchMessage delivers a message published on a namespace to local
+// clients, either emitted by a local client or read from the pubsub. Clients
+// present in delivered are skipped, and clients written to are added to it,
+// in case it is not nil.
+func (s *Server) dispatchMessage(src, ns string, data []byte, delivered map[*Client]bool) {
+	kind := common.ClientMessage(data).Type()
+	if kind == common.ClientMessageGroups {
+		s.handleRemoteGroups(src, ns, data)
+		return
+	}
+	if kind == common.ClientMessageSegment {
+		s.handleRemoteSegment(src, data)
+		return
+	}
+	if kind == common.ClientMessagePresence {
+		s.handleRemotePresence(src, data)
+		return
+	}
+
+	if kind == common.ClientMessagePkt || kind == common.ClientMessageReply {
+		s.record(src, ns, common.ClientMessage(data).Payload())
+	}
+
+	if s.isPaused(ns) {
+		s.pausedDropped.Add(1)
+		return
+	}
+
+	if kind == common.ClientMessagePkt || kind == common.ClientMessageReply {
+		s.taps.publish(ns, TappedFrame{
+			Time:      time.Now().UTC(),
+			Namespace: ns,
+			Client:    src,
+			Reply:     kind == common.ClientMessageReply,
+			Frame:     common.ClientMessage(data).Payload(),
+		})
+	}
+
+	switch kind {
+	case common.ClientMessagePkt:
+		s.queries.Observe(src, common.ClientMessage(data).Payload(), time.Now())
+	case common.ClientMessageReply:
+		s.deliverReply(src, ns, data, delivered)
+		return
+	}
+
+	dst, routed := s.destinations(ns, data)
+
+	// Clients reached through several routes receive the frame once.
+	if delivered == nil && len(routed) > 0 {
+		delivered = make(map[*Client]bool)
+	}
+	s.deliver(src, ns, kind, data, dst, delivered)
+	for _, target := range routed {
+		if s.isPaused(target) {
+			s.pausedDropped.Add(1)
+			continue
+		}
+		s.routedFrames.Add(1)
+		s.deliver(src, target, kind, data, dst, delivered)
+	}
+}
+
+// destinations returns the destination address of a frame published on a
+// namespace, used for group filtering, and namespaces it is routed to.
+// Replies are unicast frames meant to a single querier, and are therefore
+// not subject to group filtering nor routing.
+func (s *Server) destinations(ns string, data []byte) (net.IP, []string) {
+	if common.ClientMessage(data).Type() != common.ClientMessagePkt {
+		return nil, nil
+	}
+	var dst net.IP
+	info, ok := common.ParseFrame(common.ClientMessage(data).Payload())
+	if ok {
+		dst = info.Dst
+	}
+	return dst, s.routes.Load().Destinations(ns, info, ok)
+}
+
+// deliver writes a message published on a namespace to local clients
+// subscribed to it. Clients present in delivered are skipped, and clients
+// written to are added to it, in case it is not nil.
+func (s *Server) deliver(src, ns string, kind common.ClientMessageType, data []byte, dst net.IP, delivered map[*Client]bool) {
+	var tagged common.ClientMessage
+	for _, cli := range s.recipients(src, ns, dst, delivered) {
+		if kind == common.ClientMessagePkt && cli.tagged.Load() {
+			if tagged == nil {
+				tagged = common.NewNsPktMessage(ns, common.ClientMessage(data).Payload())
+			}
+			if tagged == nil {
+				// Frames close to the maximum payload size cannot fit
+				// their namespace tag.
+				cli.log.Warn("Dropped frame too large to be tagged",
+					zap.String("namespace", ns),
+					zap.Int("size", len(common.ClientMessage(data).Payload())))
+				continue
+			}
+			cli.Write(tagged)
+			continue
+		}
+		cli.Write(data)
+	}
+}
+
+// deliverReply writes a reply published on a namespace to the client which
+// published the query it answers, in case it is connected to this instance
+// and subscribed to the namespace. Replies to unknown queries are dropped.
+func (s *Server) deliverReply(src, ns string, data []byte, delivered map[*Client]bool) {
+	origin, ok := s.queries.Origin(common.ClientMessage(data).Payload(), time.Now())
+	if !ok {
+		s.log.Debug("Dropped reply to unknown query", zap.String("client", src), zap.String("namespace", ns))
+		return
+	}
+	for _, cli := range s.recipients(src, ns, nil, delivered) {
+		if cli.id == origin {
 			cli.Write(data)
+			return
+		}
+	}
+}
+
+// recipients returns local clients a message published on a namespace must
+// be written to, skipping and updating delivered as deliver does.
+func (s *Server) recipients(src, ns string, dst net.IP, delivered map[*Client]bool) []*Client {
+	var result []*Client
+	for _, cli := range s.namespaces.Match(ns) {
+		if cli.id == src || !cli.direction().CanSubscribe() || cli.standby() || !cli.wantsGroup(dst) {
+			continue
+		}
+		if delivered != nil {
+			if delivered[cli] {
+				continue
+			}
+			delivered[cli] = true
+		}
+		result = append(result, cli)
+	}
+	return result
+}
+
+// record writes a frame emitted by a client to the recorder, in case one is
+// set. Each namespace is recorded as a distinct interface.
+func (s *Server) record(src, ns string, frame []byte) {
+	if s.recorder == nil {
+		return
+	}
+	iface := common.RecorderInterface{Name: ns, Description: "Frames forwarded on namespace " + ns}
+	// Frames forwarded while shutting down are not recorded.
+	if err := s.recorder.Record(iface, time.Now(), frame, "client="+src); err != nil && !errors.Is(err, os.ErrClosed) {
+		s.log.Error("Failed recording frame", zap.Error(err))
+	}
+}
+
+// handleRemoteGroups records groups advertised by clients connected to other
+// dispatch instances.
+func (s *Server) handleRemoteGroups(src, ns string, data common.ClientMessage) {
+	if s.clients.Has(src) {
+		// Local clients are registered as soon as their message arrives.
+		return
+	}
+
+	groups, err := common.DecodeGroups(data.Payload())
+	if err != nil {
+		s.log.Warn("Ignoring malformed remote GROUPS message", zap.String("client", src), zap.Error(err))
+		return
+	}
+
+	var changed bool
+	if len(groups) == 0 {
+		changed = s.groups.Remove(ns, src)
+	} else {
+		changed = s.groups.Update(ns, src, groups, true, time.Now())
+	}
+	if changed {
+		s.syncGroups(ns)
+	}
+}
+
+// syncGroups advertises groups wanted by other members of a namespace to each
+// of its local clients. Clients joining several namespaces are advertised the
+// union of groups wanted across all of them. When ns is a wildcard pattern,
+// all namespaces it matches are synchronised.
+func (s *Server) syncGroups(ns string) {
+	for _, key := range s.namespaces.Keys() {
+		if !common.NamespaceMatches(ns, key) {
+			continue
+		}
+		for _, cli := range s.namespaces.Get(key) {
+			set := groupSet{}
+			for _, member := range s.namespaces.Memberships(cli) {
+				for g := range s.groups.RemoteGroupsFor(member, cli.id) {
+					set[g] = struct{}{}
+				}
+			}
+			cli.advertiseGroups(set)
+		}
+	}
+}
+
+func (s *Server) expireGroups() {
+	tick := time.NewTicker(common.GroupsRefreshInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-tick.C:
+			for _, ns := range s.groups.Expire(now) {
+				s.syncGroups(ns)
+			}
 		}
 	}
 }
@@ -90,6 +516,9 @@ func (s *Server) Run() error {
 			s.dispatchPubSubMessage(msg)
 		}
 	}()
+	go s.expireGroups()
+	go s.refreshSegments()
+	go s.heartbeatPresence()
 
 	for {
 		conn, err := s.listener.Accept()
@@ -112,30 +541,129 @@ func (s *Server) Run() error {
 	}
 }
 
+// RequestBroadcast publishes a message emitted by a client. NSPKT messages
+// are published as PKT messages on the namespace they are tagged with, which
+// the client must be a member of. Other messages are published on all
+// namespaces the client is a member of. Wildcard patterns only subscribe to
+// traffic, so nothing is published on them.
 func (s *Server) RequestBroadcast(client *Client, msg common.ClientMessage) {
-	s.emitBroadcast(client.id, *client.ns, msg)
+	namespaces := s.namespaces.Memberships(client)
+	if msg.Type() == common.ClientMessageNsPkt {
+		ns, frame, err := common.DecodeNsPkt(msg.Payload())
+		if err != nil {
+			client.log.Warn("Ignoring malformed NSPKT message", zap.Error(err))
+			return
+		}
+		if !s.namespaces.IsMember(ns, client) || common.IsNamespacePattern(ns) {
+			client.log.Warn("Ignoring NSPKT message tagged with foreign namespace", zap.String("namespace", ns))
+			return
+		}
+		namespaces = []string{ns}
+		msg = common.NewClientMessage(common.ClientMessagePkt, frame)
+	}
+
+	candidates := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if common.IsNamespacePattern(ns) {
+			continue
+		}
+		if s.isPaused(ns) {
+			s.pausedDropped.Add(1)
+			continue
+		}
+		candidates = append(candidates, ns)
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	now := time.Now()
+	allowed, verdict := s.quotas.Allow(client, candidates, len(msg), now)
+	if dropped := len(candidates) - len(allowed); dropped > 0 {
+		s.quotaDropped.Add(uint64(dropped))
+		s.quotaDroppedBytes.Add(uint64(dropped * len(msg)))
+		client.log.Debug("Dropped message exceeding quota",
+			zap.Int("size", len(msg)),
+			zap.Int("namespaces", dropped))
+	}
+	// Clients are only held responsible for their own quota, not for others
+	// flooding the namespace.
+	if verdict == quotaClientExceeded && s.quotas.ShouldDisconnect(client, now) {
+		s.quotaDisconnects.Add(1)
+		client.log.Warn("Disconnecting client persistently exceeding quotas")
+		client.disconnect(common.ByeReasonQuotaExceeded)
+		return
+	}
+	if len(allowed) > 0 {
+		s.emitFanOut(client.id, allowed, msg)
+	}
 }
 
 func (s *Server) SignalDone(client *Client) {
 	s.unregisterClient(client.id)
-	if client.ns != nil {
-		s.namespaces.Delete(*client.ns, client)
+	if segment := client.segment(); segment != "" {
+		s.leaveSegment(client, segment)
+	}
+	if client.hello.Load() != nil {
+		s.announcePresence(client, presenceLeave)
+	}
+	for _, ns := range s.namespaces.Memberships(client) {
+		s.leaveNamespace(client, ns)
 	}
 }
 
-func (s *Server) AssocNamespace(client *Client, ns string) {
-	s.namespaces.Add(ns, client)
+// leaveNamespace removes a client from a namespace, withdrawing groups it
+// advertised there.
+func (s *Server) leaveNamespace(client *Client, ns string) {
+	s.namespaces.Delete(ns, client)
+	if s.namespaces.Len(ns) == 0 {
+		s.quotas.Release(ns)
+	}
+	if client.groups.Load() != nil && s.groups.Remove(ns, client.id) {
+		s.emitBroadcast(client.id, ns, common.NewClientMessage(common.ClientMessageGroups, nil))
+		s.syncGroups(ns)
+	}
 }
 
-func (s *Server) Shutdown() {
+// UpdateGroups registers groups advertised by a client and relays them to
+// other dispatch instances.
+func (s *Server) UpdateGroups(client *Client, msg common.ClientMessage, groups []net.IP) {
+	set := newGroupSet(groups)
+	client.groups.Store(&set)
+	now := time.Now()
+	for _, ns := range s.namespaces.Memberships(client) {
+		s.groups.Update(ns, client.id, groups, false, now)
+		s.syncGroups(ns)
+		s.emitBroadcast(client.id, ns, msg)
+	}
+}
+
+// AssocNamespaces registers a client in all provided namespaces. In case any
+// of them has reached its maximum amount of clients, the client is not
+// registered in any of them, and the full namespace is returned along with
+// false.
+func (s *Server) AssocNamespaces(client *Client, namespaces []string) (string, bool) {
+	full, ok := s.namespaces.AddAllLimited(namespaces, client, s.quotas.config.NamespaceMaxClients)
+	if !ok {
+		s.namespaceRejections.Add(1)
+	}
+	return full, ok
+}
+
+// Shutdown stops accepting clients, asks connected clients to disconnect and
+// waits for them to do so. Clients still connected after the configured drain
+// timeout are forcibly closed, in which case DrainTimeoutErr is returned.
+func (s *Server) Shutdown() error {
+	close(s.stop)
 	s.log.Info("Stopping listener...")
 	if err := s.listener.Close(); err != nil {
 		s.log.Error("Failed stopping listener", zap.Error(err))
 	}
 
-	s.log.Info("Dispatching shutdown packet to clients")
+	s.log.Info("Dispatching shutdown packet to clients", zap.Stringer("redirect", s.handover.Kind))
+	bye := common.NewByeRedirectMessage(common.ByeReasonShutdown, s.handover)
 	s.clients.Range(func(id string, c *Client) bool {
-		c.Write(common.NewClientMessage(common.ClientMessageBye, nil))
+		c.Write(bye)
 		s.log.Debug("Dispatched shutdown", zap.String("client", id))
 		return true
 	})
@@ -154,6 +682,41 @@ func (s *Server) Shutdown() {
 			}
 		}
 	}()
-	s.wg.Wait()
+
+	var err error
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	var deadline <-chan time.Time
+	if s.drainTimeout > 0 {
+		deadline = time.After(s.drainTimeout)
+	}
+	select {
+	case <-drained:
+	case <-deadline:
+		s.log.Warn("Drain deadline exceeded. Forcibly closing remaining clients...",
+			zap.Int("clients_left", s.CountConnected()))
+		s.clients.Range(func(id string, c *Client) bool {
+			c.drop()
+			return true
+		})
+		select {
+		case <-drained:
+		case <-time.After(forceCloseGrace):
+			s.log.Error("Clients failed to stop after being forcibly closed", zap.Int("clients_left", s.CountConnected()))
+		}
+		err = DrainTimeoutErr
+	}
 	close(done)
+	tick.Stop()
+
+	if s.recorder != nil {
+		if err := s.recorder.Close(); err != nil {
+			s.log.Error("Failed closing recorder", zap.Error(err))
+		}
+	}
+	return err
 }
@@ -0,0 +1,445 @@
+package tcp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"github.com/udpfw/dispatch/config"
+	"github.com/udpfw/dispatch/pubsub"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// loopbackPubSub delivers broadcasts back to the emitting server.
+type loopbackPubSub struct {
+	ch chan pubsub.PacketData
+}
+
+func newLoopbackPubSub() *loopbackPubSub {
+	return &loopbackPubSub{ch: make(chan pubsub.PacketData, 64)}
+}
+
+func (l *loopbackPubSub) Start() error { return nil }
+func (l *loopbackPubSub) Broadcast(data pubsub.PacketData) error {
+	l.ch <- data
+	return nil
+}
+func (l *loopbackPubSub) ReadNext() (pubsub.PacketData, error) {
+	data, ok := <-l.ch
+	if !ok {
+		return nil, pubsub.ClosedErr
+	}
+	return data, nil
+}
+func (l *loopbackPubSub) Shutdown() error {
+	close(l.ch)
+	return nil
+}
+
+func startServer(t *testing.T, ctx *config.Context) *Server {
+	ctx.BindAddress = "127.0.0.1:0"
+	srv, err := New(ctx, newLoopbackPubSub())
+	require.NoError(t, err)
+	go func() { _ = srv.Run() }()
+	return srv
+}
+
+func connectClient(t *testing.T, srv *Server, ns string) net.Conn {
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write(common.NewClientMessage(common.ClientMessageHello, []byte(ns)))
+	require.NoError(t, err)
+	return conn
+}
+
+// connectHello connects to the server, emitting the provided HELLO and
+// waiting for its acknowledgement.
+func connectHello(t *testing.T, srv *Server, hello common.Hello) net.Conn {
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write(common.NewClientMessage(common.ClientMessageHello, hello.Encode()))
+	require.NoError(t, err)
+	require.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+	return conn
+}
+
+func readMessage(t *testing.T, conn net.Conn) common.ClientMessage {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	asm := common.NewMessageAssembler()
+	buf := make([]byte, 1)
+	for {
+		_, err := conn.Read(buf)
+		require.NoError(t, err)
+		if msg := asm.Feed(buf[0]); msg != nil {
+			return msg
+		}
+	}
+}
+
+func TestServer_ShutdownDrainTimeout(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	conn := connectClient(t, srv, "ns")
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+
+	// The client never disconnects after receiving BYE.
+	start := time.Now()
+	err := srv.Shutdown()
+	assert.ErrorIs(t, err, DrainTimeoutErr)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Zero(t, srv.CountConnected())
+}
+
+func TestServer_NamespaceFull(t *testing.T) {
+	srv := startServer(t, &config.Context{
+		DrainTimeout: 100 * time.Millisecond,
+		Quotas:       config.QuotaConfig{NamespaceMaxClients: 1},
+	})
+	defer func() { _ = srv.Shutdown() }()
+
+	first := connectClient(t, srv, "ns")
+	defer func() { _ = first.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, first).Type())
+
+	second := connectClient(t, srv, "ns")
+	defer func() { _ = second.Close() }()
+	msg := readMessage(t, second)
+	assert.Equal(t, common.ClientMessageBye, msg.Type())
+	assert.Equal(t, common.ByeReasonNamespaceFull, common.DecodeByeReason(msg.Payload()))
+}
+
+func TestServer_ShutdownRedirect(t *testing.T) {
+	redirect := common.ByeRedirect{Kind: common.ByeRedirectAddress, Address: "dispatch-2:3030"}
+	srv := startServer(t, &config.Context{DrainTimeout: time.Second, Handover: redirect})
+	conn := connectClient(t, srv, "ns")
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+
+	shutdown := make(chan error)
+	go func() { shutdown <- srv.Shutdown() }()
+
+	msg := readMessage(t, conn)
+	require.Equal(t, common.ClientMessageBye, msg.Type())
+	reason, got := common.DecodeBye(msg.Payload())
+	assert.Equal(t, common.ByeReasonShutdown, reason)
+	assert.Equal(t, redirect, got)
+
+	require.NoError(t, conn.Close())
+	assert.NoError(t, <-shutdown)
+}
+
+func TestServer_KeepaliveTimeout(t *testing.T) {
+	srv := startServer(t, &config.Context{
+		DrainTimeout: 100 * time.Millisecond,
+		Keepalive:    config.KeepaliveConfig{Interval: 20 * time.Millisecond, MaxMissed: 2},
+	})
+	defer func() { _ = srv.Shutdown() }()
+
+	conn := connectClient(t, srv, "ns")
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+	assert.Equal(t, common.ClientMessagePing, readMessage(t, conn).Type())
+
+	require.Eventually(t, func() bool {
+		return srv.Stats().KeepaliveTimeouts == 1 && srv.CountConnected() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_KeepaliveRTT(t *testing.T) {
+	srv := startServer(t, &config.Context{
+		DrainTimeout: 100 * time.Millisecond,
+		Keepalive:    config.KeepaliveConfig{Interval: 20 * time.Millisecond, MaxMissed: 2},
+	})
+	defer func() { _ = srv.Shutdown() }()
+
+	conn := connectClient(t, srv, "ns")
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, common.ClientMessagePing, readMessage(t, conn).Type())
+		_, err := conn.Write(common.NewClientMessage(common.ClientMessagePong, nil))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool { return srv.Stats().MaxRTTMicros > 0 }, time.Second, 10*time.Millisecond)
+	stats := srv.Stats()
+	assert.Zero(t, stats.KeepaliveTimeouts)
+	assert.Equal(t, 1, stats.Clients)
+}
+
+func TestServer_ClientIdentity(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	hello := common.Hello{
+		Namespaces: []string{"ns"},
+		Node:       "worker-1",
+		Interface:  "eth0",
+		Version:    "1.2.3",
+		Labels:     map[string]string{"zone": "a"},
+	}
+	_, err = conn.Write(common.NewClientMessage(common.ClientMessageHello, hello.Encode()))
+	require.NoError(t, err)
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, conn).Type())
+
+	legacy := connectClient(t, srv, "ns")
+	defer func() { _ = legacy.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, legacy).Type())
+
+	var identified ClientInfo
+	for _, c := range srv.Clients() {
+		if c.Node != "" {
+			identified = c
+		}
+	}
+	assert.Equal(t, []string{"ns"}, identified.Namespaces)
+	assert.Equal(t, "worker-1", identified.Node)
+	assert.Equal(t, "eth0", identified.Interface)
+	assert.Equal(t, map[string]string{"zone": "a"}, identified.Labels)
+	assert.Equal(t, map[string]int{"1.2.3": 1, "unknown": 1}, srv.Stats().ClientVersions)
+}
+
+func TestServer_MultipleNamespaces(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	multi := connectHello(t, srv, common.Hello{Namespaces: []string{"a", "b", "a"}})
+	defer func() { _ = multi.Close() }()
+
+	a := connectClient(t, srv, "a")
+	defer func() { _ = a.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, a).Type())
+	b := connectClient(t, srv, "b")
+	defer func() { _ = b.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, b).Type())
+
+	// Frames delivered to the multi-namespace client are tagged.
+	_, err := b.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("from-b")))
+	require.NoError(t, err)
+	msg := readMessage(t, multi)
+	require.Equal(t, common.ClientMessageNsPkt, msg.Type())
+	ns, frame, err := common.DecodeNsPkt(msg.Payload())
+	require.NoError(t, err)
+	assert.Equal(t, "b", ns)
+	assert.Equal(t, []byte("from-b"), frame)
+
+	// Tagged frames are only published on the namespace they carry.
+	_, err = multi.Write(common.NewNsPktMessage("a", []byte("to-a")))
+	require.NoError(t, err)
+	msg = readMessage(t, a)
+	assert.Equal(t, common.ClientMessagePkt, msg.Type())
+	assert.Equal(t, []byte("to-a"), msg.Payload())
+
+	// Untagged frames are published on all namespaces.
+	_, err = multi.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("to-all")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("to-all"), readMessage(t, a).Payload())
+	msg = readMessage(t, b)
+	assert.Equal(t, common.ClientMessagePkt, msg.Type())
+	assert.Equal(t, []byte("to-all"), msg.Payload())
+
+	var multiInfo ClientInfo
+	for _, info := range srv.Clients() {
+		if len(info.Namespaces) > 1 {
+			multiInfo = info
+		}
+	}
+	assert.Equal(t, []string{"a", "b"}, multiInfo.Namespaces)
+	assert.ErrorIs(t, srv.MoveClient(multiInfo.ID, "", "c"), AmbiguousMoveErr)
+	require.NoError(t, srv.MoveClient(multiInfo.ID, "b", "c"))
+	assert.NotContains(t, clientIDs(srv, "b"), multiInfo.ID)
+	assert.Contains(t, clientIDs(srv, "c"), multiInfo.ID)
+}
+
+func TestServer_FanOutOnce(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	sender := connectHello(t, srv, common.Hello{Namespaces: []string{"a", "b"}})
+	defer func() { _ = sender.Close() }()
+	receiver := connectHello(t, srv, common.Hello{Namespaces: []string{"a", "b"}})
+	defer func() { _ = receiver.Close() }()
+	b := connectClient(t, srv, "b")
+	defer func() { _ = b.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, b).Type())
+
+	// Local frames published on both namespaces are delivered once.
+	_, err := sender.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("local")))
+	require.NoError(t, err)
+	_, frame, err := common.DecodeNsPkt(readMessage(t, receiver).Payload())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("local"), frame)
+	assert.Equal(t, []byte("local"), readMessage(t, b).Payload())
+
+	// Frames published on both namespaces by another instance arrive as
+	// one packet per namespace, and are delivered once as well.
+	remote := common.NewClientMessage(common.ClientMessagePkt, []byte("remote"))
+	for _, ns := range []string{"a", "b"} {
+		require.NoError(t, srv.pubSub.Broadcast(pubsub.MakePacket("LKJIHGFEDCBA9876543210",
+			"0123456789ABCDEFGHIJKL", ns, remote, 0, []string{"a", "b"})))
+	}
+	_, frame, err = common.DecodeNsPkt(readMessage(t, receiver).Payload())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("remote"), frame)
+	assert.Equal(t, []byte("remote"), readMessage(t, b).Payload())
+
+	for _, conn := range []net.Conn{receiver, b} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestServer_UntaggableFrame(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	multi := connectHello(t, srv, common.Hello{Namespaces: []string{"a", "b"}})
+	defer func() { _ = multi.Close() }()
+	a := connectClient(t, srv, "a")
+	defer func() { _ = a.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, a).Type())
+	sender := connectClient(t, srv, "a")
+	defer func() { _ = sender.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, sender).Type())
+
+	// Frames filling the payload leave no room for the namespace tag, and
+	// are only delivered to untagged clients.
+	frame := make([]byte, common.MaxPayloadSize)
+	_, err := sender.Write(common.NewClientMessage(common.ClientMessagePkt, frame))
+	require.NoError(t, err)
+	assert.Len(t, readMessage(t, a).Payload(), common.MaxPayloadSize)
+
+	require.NoError(t, multi.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = multi.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestServer_Direction(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	publisher := connectHello(t, srv, common.Hello{Namespaces: []string{"ns"}, Direction: common.DirectionPublish})
+	defer func() { _ = publisher.Close() }()
+	subscriber := connectHello(t, srv, common.Hello{Namespaces: []string{"ns"}, Direction: common.DirectionSubscribe})
+	defer func() { _ = subscriber.Close() }()
+	both := connectClient(t, srv, "ns")
+	defer func() { _ = both.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, both).Type())
+
+	// Frames emitted by subscribe-only clients are dropped.
+	_, err := subscriber.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("from-subscriber")))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return srv.Stats().DirectionDropped == 1 }, time.Second, 10*time.Millisecond)
+
+	// Frames are not delivered to publish-only clients.
+	_, err = publisher.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("from-publisher")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("from-publisher"), readMessage(t, subscriber).Payload())
+	assert.Equal(t, []byte("from-publisher"), readMessage(t, both).Payload())
+
+	_, err = both.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("from-both")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("from-both"), readMessage(t, subscriber).Payload())
+	require.NoError(t, publisher.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = publisher.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestServer_WildcardNamespaces(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	monitor := connectHello(t, srv, common.Hello{Namespaces: []string{"site-a.>", "site-a.floor-2"}})
+	defer func() { _ = monitor.Close() }()
+	floor := connectClient(t, srv, "site-a.floor-2")
+	defer func() { _ = floor.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, floor).Type())
+	room := connectClient(t, srv, "site-a.floor-3.room-1")
+	defer func() { _ = room.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, room).Type())
+	other := connectClient(t, srv, "site-b.floor-2")
+	defer func() { _ = other.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, other).Type())
+
+	tap, release := srv.Tap("site-a.*")
+	defer release()
+
+	for _, conn := range []net.Conn{other, floor, room} {
+		_, err := conn.Write(common.NewClientMessage(common.ClientMessagePkt, []byte(conn.LocalAddr().String())))
+		require.NoError(t, err)
+	}
+
+	// Frames are delivered once, tagged with the namespace they were
+	// published on, in case they match any of the monitor subscriptions.
+	var received []string
+	for i := 0; i < 2; i++ {
+		msg := readMessage(t, monitor)
+		require.Equal(t, common.ClientMessageNsPkt, msg.Type())
+		ns, _, err := common.DecodeNsPkt(msg.Payload())
+		require.NoError(t, err)
+		received = append(received, ns)
+	}
+	assert.ElementsMatch(t, []string{"site-a.floor-2", "site-a.floor-3.room-1"}, received)
+	assert.Equal(t, "site-a.floor-2", (<-tap).Namespace)
+
+	// Nothing is published on patterns.
+	_, err := monitor.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("from-monitor")))
+	require.NoError(t, err)
+	msg := readMessage(t, floor)
+	assert.Equal(t, []byte("from-monitor"), msg.Payload())
+	require.NoError(t, room.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = room.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestServer_InvalidNamespace(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	hello := common.Hello{Namespaces: []string{"site-a.>.floor-2"}}
+	_, err = conn.Write(common.NewClientMessage(common.ClientMessageHello, hello.Encode()))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	require.Eventually(t, func() bool { return srv.CountConnected() == 0 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, srv.Shutdown())
+}
+
+func TestServer_LocalFastPath(t *testing.T) {
+	srv := startServer(t, &config.Context{DrainTimeout: 100 * time.Millisecond})
+	defer func() { _ = srv.Shutdown() }()
+
+	sender := connectClient(t, srv, "ns")
+	defer func() { _ = sender.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, sender).Type())
+	receiver := connectClient(t, srv, "ns")
+	defer func() { _ = receiver.Close() }()
+	assert.Equal(t, common.ClientMessageAck, readMessage(t, receiver).Type())
+
+	// Frames emitted locally are delivered once, even though the pubsub
+	// echoes them back.
+	_, err := sender.Write(common.NewClientMessage(common.ClientMessagePkt, []byte("local")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("local"), readMessage(t, receiver).Payload())
+
+	// Frames emitted by other instances are delivered.
+	remote := pubsub.MakePacket("LKJIHGFEDCBA9876543210", "0123456789ABCDEFGHIJKL", "ns",
+		common.NewClientMessage(common.ClientMessagePkt, []byte("remote")), 0, nil)
+	require.NoError(t, srv.pubSub.Broadcast(remote))
+	assert.Equal(t, []byte("remote"), readMessage(t, receiver).Payload())
+
+	require.NoError(t, receiver.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = receiver.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
@@ -1,23 +1,33 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
+	"github.com/udpfw/common"
+	"github.com/udpfw/nodelet/ip"
 	"github.com/udpfw/nodelet/log"
 	"github.com/udpfw/nodelet/services"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// version is reported to the Dispatch service during the handshake, and is
+// set at build time through -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {
 	app := cli.App{
-		Name: "udpfw",
+		Name:    "udpfw",
+		Version: version,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:     "iface",
-				Usage:    "The interface name from which UDP packets will be captured",
-				EnvVars:  []string{"UDPFW_NODELET_IFACE", "NODELET_IFACE"},
-				Required: true,
+				Name:    "iface",
+				Usage:   "The interface name from which UDP packets will be captured",
+				EnvVars: []string{"UDPFW_NODELET_IFACE", "NODELET_IFACE"},
 			},
 			&cli.StringFlag{
 				Name:    "dispatch-address",
@@ -25,18 +35,203 @@ func main() {
 				EnvVars: []string{"UDPFW_DISPATCH_ADDRESS", "NODELET_DISPATCH_ADDRESS"},
 				Value:   "udpfw-dispatch.svc.cluster.local",
 			},
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:    "namespace",
-				Usage:   "Namespace to listen to",
+				Usage:   "Namespace to listen to and publish into. Namespaces are hierarchical, as in site-a.floor-2, and wildcard patterns such as site-a.* or site-a.> only receive traffic. May be repeated to join several namespaces over a single connection",
 				EnvVars: []string{"UDPFW_NODELET_NAMESPACE", "NODELET_NAMESPACE"},
 			},
+			&cli.StringSliceFlag{
+				Name:    "ttl-policy",
+				Usage:   "TTL/HopLimit policy for injected packets, as [group][:port]=preserve|decrement|fixed:N. Rules are evaluated in order, and rules without a group or port apply to all packets. Packets matching no rule keep their original TTL",
+				EnvVars: []string{"UDPFW_NODELET_TTL_POLICY", "NODELET_TTL_POLICY"},
+			},
+			&cli.DurationFlag{
+				Name:    "defrag-timeout",
+				Usage:   "Time to wait for missing fragments of an IPv4 datagram before discarding it",
+				EnvVars: []string{"UDPFW_NODELET_DEFRAG_TIMEOUT", "NODELET_DEFRAG_TIMEOUT"},
+				Value:   10 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:    "defrag-max-bytes",
+				Usage:   "Maximum amount of memory held by fragments awaiting reassembly. Set to zero to disable reassembly",
+				EnvVars: []string{"UDPFW_NODELET_DEFRAG_MAX_BYTES", "NODELET_DEFRAG_MAX_BYTES"},
+				Value:   4 * 1024 * 1024,
+			},
+			&cli.BoolFlag{
+				Name:    "group-proxy",
+				Usage:   "Tracks IGMP/MLD memberships on the interface, advertising them to the Dispatch service, and joins groups having listeners on remote segments",
+				EnvVars: []string{"UDPFW_NODELET_GROUP_PROXY", "NODELET_GROUP_PROXY"},
+			},
+			&cli.DurationFlag{
+				Name:    "group-membership-timeout",
+				Usage:   "Time after which a group is considered to have no listeners in case no reports are observed for it",
+				EnvVars: []string{"UDPFW_NODELET_GROUP_MEMBERSHIP_TIMEOUT", "NODELET_GROUP_MEMBERSHIP_TIMEOUT"},
+				Value:   260 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name:    "reply-relay",
+				Usage:   "Relays unicast replies to mDNS and SSDP queries injected by this nodelet back to the querier's segment",
+				EnvVars: []string{"UDPFW_NODELET_REPLY_RELAY", "NODELET_REPLY_RELAY"},
+			},
+			&cli.DurationFlag{
+				Name:    "reply-relay-timeout",
+				Usage:   "Time to wait for unicast replies after a query is injected",
+				EnvVars: []string{"UDPFW_NODELET_REPLY_RELAY_TIMEOUT", "NODELET_REPLY_RELAY_TIMEOUT"},
+				Value:   10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "loop-window",
+				Usage:   "Time during which packets captured on the interface are prevented from being injected back into it",
+				EnvVars: []string{"UDPFW_NODELET_LOOP_WINDOW", "NODELET_LOOP_WINDOW"},
+				Value:   2 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:    "loop-capacity",
+				Usage:   "Maximum amount of captured packets remembered for loop suppression",
+				EnvVars: []string{"UDPFW_NODELET_LOOP_CAPACITY", "NODELET_LOOP_CAPACITY"},
+				Value:   65536,
+			},
+			&cli.UintFlag{
+				Name:    "mark-dscp",
+				Usage:   "DSCP value (1-63) set on injected packets, which are then excluded from capture to prevent forwarding loops. Set to zero to disable marking",
+				EnvVars: []string{"UDPFW_NODELET_MARK_DSCP", "NODELET_MARK_DSCP"},
+			},
+			&cli.IntFlag{
+				Name:    "storm-global-pps",
+				Usage:   "Maximum amount of captured packets per second forwarded to the Dispatch service. Set to zero to disable the limit",
+				EnvVars: []string{"UDPFW_NODELET_STORM_GLOBAL_PPS", "NODELET_STORM_GLOBAL_PPS"},
+			},
+			&cli.IntFlag{
+				Name:    "storm-source-pps",
+				Usage:   "Maximum amount of captured packets per second forwarded from a single source address. Set to zero to disable the limit",
+				EnvVars: []string{"UDPFW_NODELET_STORM_SOURCE_PPS", "NODELET_STORM_SOURCE_PPS"},
+			},
+			&cli.IntFlag{
+				Name:    "storm-group-pps",
+				Usage:   "Maximum amount of captured packets per second forwarded to a single multicast group. Set to zero to disable the limit",
+				EnvVars: []string{"UDPFW_NODELET_STORM_GROUP_PPS", "NODELET_STORM_GROUP_PPS"},
+			},
+			&cli.StringFlag{
+				Name:    "record-dir",
+				Usage:   "Directory in which captured and injected packets are recorded as pcapng files. Recording is disabled when unset",
+				EnvVars: []string{"UDPFW_NODELET_RECORD_DIR", "NODELET_RECORD_DIR"},
+			},
+			&cli.Int64Flag{
+				Name:    "record-max-file-size",
+				Usage:   "Size in bytes after which recording files are rotated",
+				EnvVars: []string{"UDPFW_NODELET_RECORD_MAX_FILE_SIZE", "NODELET_RECORD_MAX_FILE_SIZE"},
+				Value:   64 * 1024 * 1024,
+			},
+			&cli.IntFlag{
+				Name:    "record-max-files",
+				Usage:   "Maximum amount of recording files kept. Older files are removed",
+				EnvVars: []string{"UDPFW_NODELET_RECORD_MAX_FILES", "NODELET_RECORD_MAX_FILES"},
+				Value:   10,
+			},
+			&cli.StringFlag{
+				Name:    "node-name",
+				Usage:   "Name of the node this nodelet runs on, advertised to the Dispatch service. Defaults to the hostname",
+				EnvVars: []string{"UDPFW_NODELET_NODE_NAME", "NODELET_NODE_NAME", "NODE_NAME"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "label",
+				Usage:   "Label advertised to the Dispatch service, in the key=value format. May be repeated",
+				EnvVars: []string{"UDPFW_NODELET_LABELS", "NODELET_LABELS"},
+			},
+			&cli.StringFlag{
+				Name:    "direction",
+				Usage:   "Traffic direction for this nodelet: both, publish (only announce local traffic) or subscribe (only receive remote traffic)",
+				EnvVars: []string{"UDPFW_NODELET_DIRECTION", "NODELET_DIRECTION"},
+				Value:   "both",
+			},
+			&cli.StringFlag{
+				Name:    "segment",
+				Usage:   "Segment this nodelet forwards traffic for. Nodelets reporting the same segment elect a single active forwarder. Use \"subnet\" to derive it from the interface's IPv4 network. Election is disabled when unset",
+				EnvVars: []string{"UDPFW_NODELET_SEGMENT", "NODELET_SEGMENT"},
+			},
+			&cli.DurationFlag{
+				Name:    "keepalive-interval",
+				Usage:   "Interval between PING messages emitted to the Dispatch service. Keepalive is disabled when zero",
+				EnvVars: []string{"UDPFW_NODELET_KEEPALIVE_INTERVAL", "NODELET_KEEPALIVE_INTERVAL"},
+				Value:   5 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:    "keepalive-max-missed",
+				Usage:   "Amount of consecutive PING messages left unanswered after which the Dispatch service is reconnected",
+				EnvVars: []string{"UDPFW_NODELET_KEEPALIVE_MAX_MISSED", "NODELET_KEEPALIVE_MAX_MISSED"},
+				Value:   3,
+			},
+			&cli.DurationFlag{
+				Name:    "drain-timeout",
+				Usage:   "Time to wait for pending packets to be delivered to the Dispatch service upon shutdown",
+				EnvVars: []string{"UDPFW_NODELET_DRAIN_TIMEOUT", "NODELET_DRAIN_TIMEOUT"},
+				Value:   10 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:    "metrics-bind",
+				Usage:   "Address on which metrics are exposed under /debug/vars. Metrics are not exposed when unset",
+				EnvVars: []string{"UDPFW_NODELET_METRICS_BIND", "NODELET_METRICS_BIND"},
+			},
 			&cli.BoolFlag{
 				Name:    "debug",
 				Usage:   "Enables debug logging",
 				EnvVars: []string{"UDPFW_NODELET_DEBUG", "NODELET_DEBUG"},
 			},
 		},
+		Commands: []*cli.Command{
+			{
+				Name:  "replay",
+				Usage: "Publishes UDP multicast frames from a pcap or pcapng file into a namespace",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "file",
+						Usage:    "Path to the pcap or pcapng file to replay",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "dispatch-address",
+						Usage:   "IP and port to the Dispatch service",
+						EnvVars: []string{"UDPFW_DISPATCH_ADDRESS", "NODELET_DISPATCH_ADDRESS"},
+						Value:   "udpfw-dispatch.svc.cluster.local",
+					},
+					&cli.StringFlag{
+						Name:    "namespace",
+						Usage:   "Namespace to publish frames to",
+						EnvVars: []string{"UDPFW_NODELET_NAMESPACE", "NODELET_NAMESPACE"},
+					},
+					&cli.Float64Flag{
+						Name:  "speed",
+						Usage: "Timing multiplier applied to the original capture. Set to zero to emit frames as fast as possible",
+						Value: 1,
+					},
+					&cli.BoolFlag{
+						Name:    "debug",
+						Usage:   "Enables debug logging",
+						EnvVars: []string{"UDPFW_NODELET_DEBUG", "NODELET_DEBUG"},
+					},
+				},
+				Action: replay,
+			},
+		},
 		Action: func(ctx *cli.Context) error {
+			// Not marked as required, as it would also be enforced for
+			// subcommands.
+			if !ctx.IsSet("iface") {
+				return cli.Exit(`Required flag "iface" not set`, 1)
+			}
+			if window := ctx.Duration("loop-window"); window < services.MinLoopWindow {
+				return cli.Exit(fmt.Sprintf("loop-window must be at least %s", services.MinLoopWindow), 1)
+			}
+			if ctx.Int("loop-capacity") <= 0 {
+				return cli.Exit("loop-capacity must be positive", 1)
+			}
+			if ctx.Duration("defrag-timeout") <= 0 {
+				return cli.Exit("defrag-timeout must be positive", 1)
+			}
+			if ctx.Int("defrag-max-bytes") < 0 {
+				return cli.Exit("defrag-max-bytes must be positive, or zero to disable reassembly", 1)
+			}
+
 			fmt.Println("Initialize logging...")
 			if err := log.InitializeLogging(ctx.Bool("debug")); err != nil {
 				panic(err)
@@ -45,13 +240,127 @@ func main() {
 			logger := zap.L()
 
 			logger.Info("Initialize loop handler")
-			loopHandler := services.NewLoopHandler()
+			loopHandler := services.NewLoopHandler(ctx.Duration("loop-window"), ctx.Int("loop-capacity"))
 			loopHandler.Start()
+			defer loopHandler.Stop()
+			expvar.Publish("loop", expvar.Func(func() any { return loopHandler.Stats() }))
 			logger.Info("Loop handler initialization complete")
 
+			ttlRules, err := services.ParseTTLRules(ctx.StringSlice("ttl-policy"))
+			if err != nil {
+				logger.Fatal("Failed parsing TTL policies", zap.Error(err))
+			}
+
 			iface := ctx.String("iface")
+
+			markDSCP := ctx.Uint("mark-dscp")
+			if markDSCP > ip.MaxDSCP {
+				logger.Fatal("Invalid DSCP mark", zap.Uint("mark-dscp", markDSCP))
+			}
+			if ctx.Int("keepalive-max-missed") < 1 {
+				logger.Fatal("Invalid keepalive settings", zap.Int("keepalive-max-missed", ctx.Int("keepalive-max-missed")))
+			}
+
+			labels, err := common.ParseLabels(ctx.StringSlice("label"))
+			if err != nil {
+				logger.Fatal("Failed parsing labels", zap.Error(err))
+			}
+			direction, err := common.ParseDirection(ctx.String("direction"))
+			if err != nil {
+				logger.Fatal("Failed parsing direction", zap.Error(err))
+			}
+			namespaces := ctx.StringSlice("namespace")
+			for _, ns := range namespaces {
+				if err = common.ValidateNamespace(ns); err != nil {
+					logger.Fatal("Invalid namespace", zap.Error(err))
+				}
+			}
+			segment := ctx.String("segment")
+			if segment == services.SegmentSubnet {
+				if segment, err = services.InterfaceSegment(iface); err != nil {
+					logger.Fatal("Failed deriving segment from interface", zap.Error(err))
+				}
+				logger.Info("Derived segment from interface", zap.String("segment", segment))
+			}
+			nodeName := ctx.String("node-name")
+			if nodeName == "" {
+				if nodeName, err = os.Hostname(); err != nil {
+					logger.Warn("Failed obtaining hostname", zap.Error(err))
+				}
+			}
+
+			var (
+				groupTracker *services.GroupTracker
+				groupJoiner  *services.GroupJoiner
+			)
+			if ctx.Bool("group-proxy") {
+				logger.Info("Initialize group proxy...", zap.String("iface", iface))
+				groupTracker, err = services.NewGroupTracker(iface, ctx.Duration("group-membership-timeout"))
+				if err != nil {
+					logger.Fatal("Failed initializing group tracker", zap.Error(err))
+				}
+				groupJoiner, err = services.NewGroupJoiner(iface)
+				if err != nil {
+					logger.Fatal("Failed initializing group joiner", zap.Error(err))
+				}
+				groupTracker.Start()
+				defer groupTracker.Stop()
+				defer groupJoiner.Shutdown()
+				logger.Info("Group proxy initialization complete")
+			}
+
+			var replyRelay *services.ReplyRelay
+			if ctx.Bool("reply-relay") {
+				logger.Info("Initialize reply relay...", zap.String("iface", iface))
+				replyRelay, err = services.NewReplyRelay(iface, ctx.Duration("reply-relay-timeout"))
+				if err != nil {
+					logger.Fatal("Failed initializing reply relay", zap.Error(err))
+				}
+				logger.Info("Reply relay initialization complete")
+			}
+
+			stormControl := services.NewStormControl(services.StormControlOptions{
+				GlobalRate: ctx.Int("storm-global-pps"),
+				SourceRate: ctx.Int("storm-source-pps"),
+				GroupRate:  ctx.Int("storm-group-pps"),
+			})
+			if !stormControl.Enabled() {
+				stormControl = nil
+			} else {
+				expvar.Publish("storm", expvar.Func(func() any { return stormControl.Stats() }))
+			}
+
+			var recorder *common.Recorder
+			if dir := ctx.String("record-dir"); dir != "" {
+				recorder, err = common.NewRecorder(common.RecorderOptions{
+					Dir:         dir,
+					Prefix:      "udpfw-nodelet-" + iface,
+					Application: "udpfw-nodelet",
+					MaxFileSize: ctx.Int64("record-max-file-size"),
+					MaxFiles:    ctx.Int("record-max-files"),
+				})
+				if err != nil {
+					logger.Fatal("Failed initializing recorder", zap.Error(err))
+				}
+				defer func() {
+					if err := recorder.Close(); err != nil {
+						logger.Error("Failed closing recorder", zap.Error(err))
+					}
+				}()
+				logger.Info("Recording packets", zap.String("dir", dir))
+			}
+
 			logger.Info("Initialize packet handler...", zap.String("iface", iface))
-			handler, err := services.NewPacketHandler(iface, loopHandler)
+			handler, err := services.NewPacketHandler(iface, loopHandler, services.PacketHandlerOptions{
+				TTLRules:       ttlRules,
+				DefragTimeout:  ctx.Duration("defrag-timeout"),
+				DefragMaxBytes: ctx.Int("defrag-max-bytes"),
+				GroupTracker:   groupTracker,
+				ReplyRelay:     replyRelay,
+				MarkDSCP:       uint8(markDSCP),
+				StormControl:   stormControl,
+				Recorder:       recorder,
+			})
 			if err != nil {
 				logger.Fatal("Failed initializing packet handler", zap.Error(err))
 			}
@@ -61,24 +370,37 @@ func main() {
 					handler.Shutdown()
 				}
 			}()
-			defer handler.Shutdown()
 
 			logger.Info("Packet handler initialization complete")
 
 			addrs := ctx.String("dispatch-address")
 			logger.Info("Initialize Dispatch connector", zap.String("address", addrs))
-			var ns *string = nil
-			if ctx.IsSet("namespace") {
-				nv := ctx.String("namespace")
-				ns = &nv
+			dispatch := services.NewDispatch(addrs, namespaces)
+			dispatch.SetIdentity(nodeName, iface, version, labels)
+			dispatch.SetDirection(direction)
+			dispatch.SetSegment(segment)
+			dispatch.SetKeepalive(ctx.Duration("keepalive-interval"), ctx.Int("keepalive-max-missed"))
+			expvar.Publish("keepalive", expvar.Func(func() any { return dispatch.KeepaliveStats() }))
+			if segment != "" {
+				expvar.Publish("segment", expvar.Func(func() any {
+					return map[string]string{"segment": segment, "role": dispatch.Role().String()}
+				}))
+				// Standby forwarders do not capture until they take over.
+				go func() {
+					for range dispatch.OnRole {
+						handler.SetCapturing(dispatch.Role() != common.SegmentRoleStandby)
+					}
+				}()
 			}
-			dispatch := services.NewDispatch(addrs, ns)
 
 			emitterDone := make(chan bool)
 			go func() {
 				defer close(emitterDone)
 				for {
-					pkt := handler.NextPacket()
+					pkt, ok := handler.NextPacket()
+					if !ok {
+						return
+					}
 					if err := dispatch.Write(pkt); err != nil {
 						logger.Error("Failed enqueueing packet", zap.ByteString("data", pkt))
 					}
@@ -94,18 +416,128 @@ func main() {
 					}
 				}
 			}()
+			go func() {
+				for frame := range dispatch.OnReply {
+					if err := handler.InjectReply(frame); err != nil {
+						logger.Error("Failed injecting reply", zap.Error(err))
+					}
+				}
+			}()
+			if replyRelay != nil {
+				go func() {
+					for frame := range replyRelay.Replies {
+						if err := dispatch.WriteReply(frame); err != nil {
+							logger.Error("Failed relaying reply", zap.Error(err))
+						}
+					}
+				}()
+			}
+			if groupTracker != nil {
+				go func() {
+					for range groupTracker.Changes {
+						if err := dispatch.SetGroups(groupTracker.Groups()); err != nil {
+							logger.Error("Failed advertising groups", zap.Error(err))
+						}
+					}
+				}()
+				go func() {
+					for groups := range dispatch.OnGroups {
+						groupJoiner.Sync(groups)
+					}
+				}()
+			}
 			logger.Info("Dispatch connector initialization complete")
+			if bind := ctx.String("metrics-bind"); bind != "" {
+				go func() {
+					if err := services.ServeMetrics(bind); err != nil {
+						logger.Error("Metrics server failed", zap.Error(err))
+					}
+				}()
+			}
 			go dispatch.Run()
 
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+			var exitErr error
 			select {
+			case sig := <-sigChan:
+				logger.Info("Received shutdown signal. Draining...", zap.Stringer("signal", sig))
 			case <-emitterDone:
+				exitErr = cli.Exit("packet capture stopped unexpectedly", 1)
 			case <-injectorDone:
+				exitErr = cli.Exit("dispatch connector stopped unexpectedly", 1)
 			}
 
-			return nil
+			// Stop capturing, deliver packets captured so far, and notify the
+			// dispatcher before releasing sockets.
+			drained := make(chan struct{})
+			go func() {
+				handler.Shutdown()
+				<-emitterDone
+				if replyRelay != nil {
+					replyRelay.Close()
+				}
+				dispatch.Shutdown()
+				<-injectorDone
+				close(drained)
+			}()
+
+			select {
+			case <-drained:
+				handler.Close()
+				logger.Info("Shutdown complete")
+			case <-time.After(ctx.Duration("drain-timeout")):
+				logger.Error("Drain did not complete in time", zap.Duration("timeout", ctx.Duration("drain-timeout")))
+				exitErr = cli.Exit("drain did not complete in time", 1)
+			}
+
+			return exitErr
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
 		panic(err)
 	}
 }
+
+func replay(ctx *cli.Context) error {
+	if err := log.InitializeLogging(ctx.Bool("debug")); err != nil {
+		panic(err)
+	}
+	logger := zap.L()
+
+	replayer, err := services.NewReplayer(ctx.String("file"), ctx.Float64("speed"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var namespaces []string
+	if ctx.IsSet("namespace") {
+		ns := ctx.String("namespace")
+		if err = common.ValidateNamespace(ns); err != nil {
+			return cli.Exit(err, 1)
+		}
+		if common.IsNamespacePattern(ns) {
+			return cli.Exit("frames cannot be published on wildcard namespaces", 1)
+		}
+		namespaces = []string{ns}
+	}
+	addrs := ctx.String("dispatch-address")
+	dispatch := services.NewDispatch(addrs, namespaces)
+	dispatch.SetDirection(common.DirectionPublish)
+	go func() {
+		// Frames received from other members are not of interest.
+		for range dispatch.OnPacket {
+		}
+	}()
+	logger.Info("Connecting to Dispatch", zap.String("address", addrs))
+	go dispatch.Run()
+	<-dispatch.OnConnect
+
+	emitted, err := replayer.Run(dispatch.Write)
+	dispatch.Shutdown()
+	if err != nil {
+		return cli.Exit(fmt.Errorf("replay failed after %d frames: %w", emitted, err), 1)
+	}
+	logger.Info("Replay complete", zap.Int("frames", emitted))
+	return nil
+}
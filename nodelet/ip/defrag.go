@@ -0,0 +1,229 @@
+package ip
+
+import (
+	"fmt"
+	"github.com/gopacket/gopacket/layers"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxDatagramSize is the largest reassembled datagram, including its IPv4
+// header, that can still be wrapped into a PKT message along with its
+// Ethernet header.
+const MaxDatagramSize = 65535 - 14
+
+// maxFragmentsPerDatagram bounds how many fragments a single datagram may be
+// split into before being discarded.
+const maxFragmentsPerDatagram = 64
+
+var (
+	FragmentOverlapErr   = fmt.Errorf("overlapping fragment")
+	DatagramTooLargeErr  = fmt.Errorf("reassembled datagram exceeds maximum size")
+	TooManyFragmentsErr  = fmt.Errorf("datagram exceeds maximum amount of fragments")
+	DefragMemoryLimitErr = fmt.Errorf("fragment does not fit reassembly memory limit")
+)
+
+type fragmentKey struct {
+	src   [4]byte
+	dst   [4]byte
+	id    uint16
+	proto layers.IPProtocol
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+type fragmentList struct {
+	header    *layers.IPv4
+	fragments []fragment
+	size      int
+	total     int
+	firstSeen time.Time
+}
+
+// IsFragment indicates whether the provided IPv4 layer is part of a
+// fragmented datagram.
+func IsFragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// NewDefragmenter returns a new Defragmenter discarding incomplete datagrams
+// after the provided timeout, and holding at most maxBytes of fragment data
+// at any given time. Both must be positive.
+func NewDefragmenter(timeout time.Duration, maxBytes int) *Defragmenter {
+	return &Defragmenter{
+		timeout:  timeout,
+		maxBytes: maxBytes,
+		flows:    make(map[fragmentKey]*fragmentList),
+	}
+}
+
+// Defragmenter reassembles fragmented IPv4 datagrams.
+type Defragmenter struct {
+	mu        sync.Mutex
+	timeout   time.Duration
+	maxBytes  int
+	used      int
+	lastSweep time.Time
+	flows     map[fragmentKey]*fragmentList
+}
+
+// Pending returns the amount of datagrams awaiting fragments, and the amount
+// of bytes held by them.
+func (d *Defragmenter) Pending() (datagrams int, bytes int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.flows), d.used
+}
+
+// Defrag feeds a fragment into the defragmenter. It returns the reassembled
+// datagram once all of its fragments were received, or nil in case fragments
+// are still missing. Non-fragmented packets are returned as is.
+func (d *Defragmenter) Defrag(ip *layers.IPv4, now time.Time) (*layers.IPv4, error) {
+	if !IsFragment(ip) {
+		return ip, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastSweep) >= d.timeout/2 {
+		d.expire(now)
+		d.lastSweep = now
+	}
+
+	key := fragmentKey{
+		src:   [4]byte(ip.SrcIP.To4()),
+		dst:   [4]byte(ip.DstIP.To4()),
+		id:    ip.Id,
+		proto: ip.Protocol,
+	}
+
+	data := ip.Payload
+	offset := int(ip.FragOffset) * 8
+	if offset+len(data)+int(ip.IHL)*4 > MaxDatagramSize {
+		d.discard(key)
+		return nil, DatagramTooLargeErr
+	}
+
+	for d.used+len(data) > d.maxBytes && len(d.flows) > 0 {
+		d.evictOldest()
+	}
+	if d.used+len(data) > d.maxBytes {
+		return nil, DefragMemoryLimitErr
+	}
+
+	list, ok := d.flows[key]
+	if !ok {
+		list = &fragmentList{total: -1, firstSeen: now}
+		d.flows[key] = list
+	}
+
+	if len(list.fragments) == maxFragmentsPerDatagram {
+		d.discard(key)
+		return nil, TooManyFragmentsErr
+	}
+
+	if offset == 0 {
+		list.header = ip
+	}
+	if ip.Flags&layers.IPv4MoreFragments == 0 {
+		list.total = offset + len(data)
+	}
+
+	frag := fragment{offset: offset, data: append([]byte{}, data...)}
+	idx := sort.Search(len(list.fragments), func(i int) bool {
+		return list.fragments[i].offset >= offset
+	})
+	if idx < len(list.fragments) && list.fragments[idx].offset == offset && len(list.fragments[idx].data) == len(data) {
+		// Duplicated fragment; nothing to do.
+		return nil, nil
+	}
+	list.fragments = append(list.fragments, fragment{})
+	copy(list.fragments[idx+1:], list.fragments[idx:])
+	list.fragments[idx] = frag
+	list.size += len(data)
+	d.used += len(data)
+
+	payload, err := list.reassemble()
+	if err != nil {
+		d.discard(key)
+		return nil, err
+	}
+	if payload == nil {
+		return nil, nil
+	}
+	d.discard(key)
+
+	header := list.header
+	return &layers.IPv4{
+		BaseLayer:  layers.BaseLayer{Payload: payload},
+		Version:    header.Version,
+		IHL:        header.IHL,
+		TOS:        header.TOS,
+		Id:         header.Id,
+		Flags:      header.Flags &^ layers.IPv4MoreFragments,
+		FragOffset: 0,
+		TTL:        header.TTL,
+		Protocol:   header.Protocol,
+		SrcIP:      header.SrcIP,
+		DstIP:      header.DstIP,
+		Options:    header.Options,
+	}, nil
+}
+
+// reassemble returns the datagram's payload in case all fragments are
+// present, or nil otherwise.
+func (l *fragmentList) reassemble() ([]byte, error) {
+	cursor := 0
+	for _, f := range l.fragments {
+		if f.offset > cursor {
+			return nil, nil
+		}
+		if f.offset < cursor {
+			return nil, FragmentOverlapErr
+		}
+		cursor += len(f.data)
+	}
+
+	if l.header == nil || l.total == -1 || cursor != l.total {
+		return nil, nil
+	}
+
+	payload := make([]byte, 0, l.total)
+	for _, f := range l.fragments {
+		payload = append(payload, f.data...)
+	}
+	return payload, nil
+}
+
+func (d *Defragmenter) discard(key fragmentKey) {
+	if list, ok := d.flows[key]; ok {
+		d.used -= list.size
+		delete(d.flows, key)
+	}
+}
+
+func (d *Defragmenter) evictOldest() {
+	var (
+		oldestKey fragmentKey
+		oldest    *fragmentList
+	)
+	for k, v := range d.flows {
+		if oldest == nil || v.firstSeen.Before(oldest.firstSeen) {
+			oldestKey, oldest = k, v
+		}
+	}
+	d.discard(oldestKey)
+}
+
+func (d *Defragmenter) expire(now time.Time) {
+	for k, v := range d.flows {
+		if now.Sub(v.firstSeen) > d.timeout {
+			d.discard(k)
+		}
+	}
+}
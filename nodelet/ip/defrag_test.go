@@ -0,0 +1,120 @@
+package ip
+
+import (
+	"bytes"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func makeDatagram(t *testing.T, size int) []byte {
+	payload := bytes.Repeat([]byte{0xCA, 0xFE}, size/2)
+	data, err := serializeIPv4(&layers.IPv4{
+		Version:  4,
+		Id:       1234,
+		TTL:      255,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("192.168.0.10"),
+		DstIP:    net.ParseIP("239.255.255.250"),
+	}, payload)
+	require.NoError(t, err)
+	return data
+}
+
+func decodeIPv4(t *testing.T, data []byte) *layers.IPv4 {
+	ip := &layers.IPv4{}
+	require.NoError(t, ip.DecodeFromBytes(data, nil))
+	return ip
+}
+
+func TestFragmentAndDefrag(t *testing.T) {
+	datagram := makeDatagram(t, 4000)
+	fragments, err := Fragment(datagram, 1500)
+	require.NoError(t, err)
+	require.Len(t, fragments, 3)
+	for _, f := range fragments {
+		assert.LessOrEqual(t, len(f), 1500)
+	}
+
+	d := NewDefragmenter(time.Second, 1024*1024)
+	now := time.Now()
+
+	// Feed fragments out of order
+	res, err := d.Defrag(decodeIPv4(t, fragments[2]), now)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	res, err = d.Defrag(decodeIPv4(t, fragments[0]), now)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	res, err = d.Defrag(decodeIPv4(t, fragments[1]), now)
+	require.NoError(t, err)
+	require.NotNil(t, res)
+
+	assert.False(t, IsFragment(res))
+	assert.Equal(t, decodeIPv4(t, datagram).Payload, res.Payload)
+
+	pending, used := d.Pending()
+	assert.Zero(t, pending)
+	assert.Zero(t, used)
+}
+
+func TestDefragmenter_Timeout(t *testing.T) {
+	fragments, err := Fragment(makeDatagram(t, 4000), 1500)
+	require.NoError(t, err)
+
+	d := NewDefragmenter(time.Second, 1024*1024)
+	now := time.Now()
+	_, err = d.Defrag(decodeIPv4(t, fragments[0]), now)
+	require.NoError(t, err)
+
+	pending, _ := d.Pending()
+	assert.Equal(t, 1, pending)
+
+	now = now.Add(2 * time.Second)
+	res, err := d.Defrag(decodeIPv4(t, fragments[1]), now)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	// First fragment expired, so the datagram must never complete.
+	res, err = d.Defrag(decodeIPv4(t, fragments[2]), now)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestDefragmenter_MemoryLimit(t *testing.T) {
+	d := NewDefragmenter(time.Minute, 2000)
+	now := time.Now()
+
+	first, err := Fragment(makeDatagram(t, 4000), 1500)
+	require.NoError(t, err)
+	_, err = d.Defrag(decodeIPv4(t, first[0]), now)
+	require.NoError(t, err)
+
+	second := makeDatagram(t, 4000)
+	header := decodeIPv4(t, second)
+	header.Id = 4321
+	second, err = serializeIPv4(header, header.Payload)
+	require.NoError(t, err)
+	fragments, err := Fragment(second, 1500)
+	require.NoError(t, err)
+	_, err = d.Defrag(decodeIPv4(t, fragments[0]), now.Add(time.Millisecond))
+	require.NoError(t, err)
+
+	// The oldest datagram must have been evicted to make room.
+	pending, used := d.Pending()
+	assert.Equal(t, 1, pending)
+	assert.LessOrEqual(t, used, 2000)
+}
+
+func TestFragment_DontFragment(t *testing.T) {
+	ip := decodeIPv4(t, makeDatagram(t, 4000))
+	ip.Flags |= layers.IPv4DontFragment
+	data, err := serializeIPv4(ip, ip.Payload)
+	require.NoError(t, err)
+
+	_, err = Fragment(data, 1500)
+	assert.Error(t, err)
+}
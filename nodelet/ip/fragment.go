@@ -0,0 +1,105 @@
+package ip
+
+import (
+	"fmt"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// Fragment splits the provided IPv4 packet into fragments fitting the
+// provided MTU. Packets already fitting the MTU are returned unchanged.
+func Fragment(data []byte, mtu int) ([][]byte, error) {
+	if len(data) <= mtu {
+		return [][]byte{data}, nil
+	}
+
+	ip := &layers.IPv4{}
+	if err := ip.DecodeFromBytes(data, nil); err != nil {
+		return nil, err
+	}
+	if ip.Flags&layers.IPv4DontFragment != 0 {
+		return nil, fmt.Errorf("packet with %d bytes exceeds MTU of %d and has DF set", len(data), mtu)
+	}
+
+	var copiedOptions []layers.IPv4Option
+	for _, opt := range ip.Options {
+		// Only options with the "copied" flag set are replicated to
+		// fragments other than the first one.
+		if opt.OptionType&0x80 != 0 {
+			copiedOptions = append(copiedOptions, opt)
+		}
+	}
+
+	payload := ip.Payload
+	baseOffset := int(ip.FragOffset) * 8
+	moreFragments := ip.Flags&layers.IPv4MoreFragments != 0
+
+	var result [][]byte
+	for offset := 0; offset < len(payload); {
+		header := *ip
+		header.Payload = nil
+		if offset > 0 {
+			header.Options = copiedOptions
+		}
+		headerLen := 20
+		for _, opt := range header.Options {
+			if opt.OptionType <= 1 {
+				headerLen += 1
+			} else {
+				headerLen += int(opt.OptionLength)
+			}
+		}
+		headerLen = (headerLen + 3) &^ 3
+
+		chunk := (mtu - headerLen) &^ 7
+		if chunk <= 0 {
+			return nil, fmt.Errorf("MTU of %d is too small to fragment packet", mtu)
+		}
+		end := offset + chunk
+		if end >= len(payload) {
+			end = len(payload)
+		}
+
+		header.FragOffset = uint16((baseOffset + offset) / 8)
+		header.Flags &^= layers.IPv4MoreFragments
+		if end < len(payload) || moreFragments {
+			header.Flags |= layers.IPv4MoreFragments
+		}
+
+		buf, err := serializeIPv4(&header, payload[offset:end])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, buf)
+		offset = end
+	}
+
+	return result, nil
+}
+
+func serializeIPv4(header *layers.IPv4, payload []byte) ([]byte, error) {
+	options := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, options, header, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rebuildFrame serializes a reassembled datagram back into an Ethernet frame
+// using the provided link layer.
+func rebuildFrame(eth *layers.Ethernet, datagram *layers.IPv4) ([]byte, error) {
+	options := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, options, eth, datagram, gopacket.Payload(datagram.Payload))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
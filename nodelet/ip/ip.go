@@ -1,24 +1,69 @@
 package ip
 
 import (
+	"fmt"
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcap"
+	"go.uber.org/zap"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type PacketReader struct {
 	handle *pcap.Handle
 	ch     chan []byte
 	iface  string
+	log    *zap.Logger
 	Recv   func(packet gopacket.Packet)
+
+	// Defrag, when set, reassembles fragmented IPv4 datagrams before they
+	// are handed to Recv.
+	Defrag *Defragmenter
+
+	paused atomic.Bool
+}
+
+const (
+	// MulticastFilter matches UDP datagrams destined to multicast groups.
+	MulticastFilter = "udp and (ip multicast or ip6 multicast)"
+
+	// MembershipFilter matches IGMP and MLD messages.
+	MembershipFilter = "igmp or (ip6 multicast and ip6 protochain 58)"
+)
+
+// CombineFilters returns a BPF expression matching packets matched by any of
+// the provided expressions.
+func CombineFilters(filters ...string) string {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return "(" + strings.Join(filters, ") or (") + ")"
+}
+
+// MaxDSCP is the largest Differentiated Services Code Point value.
+const MaxDSCP = 63
+
+// ExcludeDSCP returns a BPF expression matching packets matched by filter,
+// except IPv4 and IPv6 packets marked with the provided DSCP value.
+func ExcludeDSCP(filter string, dscp uint8) string {
+	return fmt.Sprintf("(%s) and not (ip and ip[1] & 0xfc = %d) and not (ip6 and ip6[0:2] & 0x0fc0 = %d)",
+		filter, uint16(dscp)<<2, uint16(dscp)<<6)
 }
 
-func NewReader(iface string) (*PacketReader, error) {
+// WithDSCP returns the provided TOS or Traffic Class value with its DSCP
+// bits replaced by dscp, preserving ECN bits.
+func WithDSCP(tos uint8, dscp uint8) uint8 {
+	return tos&0x03 | dscp<<2
+}
+
+func NewReader(iface string, filter string) (*PacketReader, error) {
 	handle, err := pcap.OpenLive(iface, 4096, false, pcap.BlockForever)
 	if err != nil {
 		return nil, err
 	}
-	err = handle.SetBPFFilter("udp and (ip multicast or ip6 multicast)")
+	err = handle.SetBPFFilter(filter)
 	if err != nil {
 		return nil, err
 	}
@@ -27,6 +72,7 @@ func NewReader(iface string) (*PacketReader, error) {
 		handle: handle,
 		ch:     make(chan []byte, 512),
 		iface:  iface,
+		log:    zap.L().With(zap.String("facility", "packet_reader")),
 	}, nil
 }
 
@@ -36,23 +82,77 @@ func (p *PacketReader) Shutdown() {
 	p.handle.Close()
 }
 
+// SetPaused pauses or resumes the capture. Packets read while paused are
+// discarded as soon as they are read from the handle, before being decoded,
+// reassembled or handed to Recv.
+func (p *PacketReader) SetPaused(paused bool) {
+	p.paused.Store(paused)
+}
+
+// Run reads packets from the interface until Shutdown is called or the
+// capture fails, returning after all read packets were handed to Recv.
 func (p *PacketReader) Run() error {
-	go p.read()
+	readDone := make(chan struct{})
+	go p.read(readDone)
 
+	defer func() { <-readDone }()
 	defer close(p.ch)
 	for {
 		data, _, err := p.handle.ReadPacketData()
 		if err != nil {
 			return err
 		}
+		if p.paused.Load() {
+			continue
+		}
 
 		p.ch <- data
 	}
 }
 
-func (p *PacketReader) read() {
+func (p *PacketReader) read(done chan struct{}) {
+	defer close(done)
 	for rawData := range p.ch {
 		packet := gopacket.NewPacket(rawData, layers.LayerTypeEthernet, gopacket.Default)
+		if p.Defrag != nil {
+			if packet = p.defrag(packet); packet == nil {
+				continue
+			}
+		}
 		p.Recv(packet)
 	}
 }
+
+// defrag feeds IPv4 fragments into the defragmenter, returning nil until the
+// datagram is complete, after which a packet containing the whole datagram is
+// returned instead.
+func (p *PacketReader) defrag(packet gopacket.Packet) gopacket.Packet {
+	ipLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || !IsFragment(ipLayer) {
+		return packet
+	}
+
+	datagram, err := p.Defrag.Defrag(ipLayer, time.Now())
+	if err != nil {
+		p.log.Debug("Dropped fragmented datagram",
+			zap.Stringer("src", ipLayer.SrcIP),
+			zap.Stringer("dst", ipLayer.DstIP),
+			zap.Uint16("id", ipLayer.Id),
+			zap.Error(err))
+		return nil
+	}
+	if datagram == nil {
+		return nil
+	}
+
+	eth, ok := packet.LinkLayer().(*layers.Ethernet)
+	if !ok {
+		return nil
+	}
+	data, err := rebuildFrame(eth, datagram)
+	if err != nil {
+		p.log.Error("Failed rebuilding reassembled datagram", zap.Error(err))
+		return nil
+	}
+	return gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+}
@@ -0,0 +1,18 @@
+package ip
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWithDSCP(t *testing.T) {
+	assert.Equal(t, uint8(0xB8), WithDSCP(0x00, 46))
+	assert.Equal(t, uint8(0xBB), WithDSCP(0x03, 46))
+	assert.Equal(t, uint8(0x01), WithDSCP(0xFD, 0))
+}
+
+func TestExcludeDSCP(t *testing.T) {
+	assert.Equal(t,
+		"(udp) and not (ip and ip[1] & 0xfc = 184) and not (ip6 and ip6[0:2] & 0x0fc0 = 2944)",
+		ExcludeDSCP("udp", 46))
+}
@@ -5,28 +5,107 @@ import (
 	"fmt"
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
+	"github.com/udpfw/common"
 	"github.com/udpfw/nodelet/ip"
 	"go.uber.org/zap"
 	"io"
+	"net"
+	"os"
 	"sync"
 	"syscall"
+	"time"
 )
 
-func NewPacketHandler(iface string, loopHandler *LoopHandler) (*PacketHandler, error) {
+type PacketHandlerOptions struct {
+	TTLRules TTLRules
+
+	// DefragTimeout and DefragMaxBytes configure reassembly of fragmented
+	// IPv4 datagrams. Reassembly is disabled when DefragMaxBytes is zero.
+	DefragTimeout  time.Duration
+	DefragMaxBytes int
+
+	// GroupTracker, when set, receives IGMP and MLD messages captured on the
+	// interface.
+	GroupTracker *GroupTracker
+
+	// ReplyRelay, when set, rewrites injected queries expecting unicast
+	// replies and delivers relayed replies to local queriers.
+	ReplyRelay *ReplyRelay
+
+	// MarkDSCP, when non-zero, is set as the DSCP value of injected packets,
+	// and packets carrying it are excluded from capture, so injected
+	// packets are never forwarded again regardless of changes to their
+	// contents. Marking is disabled when zero.
+	MarkDSCP uint8
+
+	// StormControl, when set, limits the rate of captured packets forwarded
+	// to the Dispatch service.
+	StormControl *StormControl
+
+	// Recorder, when set, receives captured and injected frames.
+	Recorder *common.Recorder
+}
+
+func NewPacketHandler(iface string, loopHandler *LoopHandler, opts PacketHandlerOptions) (*PacketHandler, error) {
 	packetChan := make(chan []byte, 4096)
-	reader, err := ip.NewReader(iface)
+	filter := ip.MulticastFilter
+	if opts.GroupTracker != nil {
+		filter = ip.CombineFilters(ip.MulticastFilter, ip.MembershipFilter)
+	}
+	if opts.MarkDSCP > ip.MaxDSCP {
+		return nil, fmt.Errorf("invalid DSCP mark %d", opts.MarkDSCP)
+	}
+	if opts.MarkDSCP != 0 {
+		filter = ip.ExcludeDSCP(filter, opts.MarkDSCP)
+	}
+	reader, err := ip.NewReader(iface, filter)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.DefragMaxBytes > 0 {
+		reader.Defrag = ip.NewDefragmenter(opts.DefragTimeout, opts.DefragMaxBytes)
+	}
+
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &PacketHandler{
+		log:         zap.L().With(zap.String("facility", "packet_handler")),
+		reader:      reader,
+		packetChan:  packetChan,
+		writeLock:   &sync.Mutex{},
+		iface:       iface,
+		ifIndex:     netIface.Index,
+		mtu:         netIface.MTU,
+		loopHandler: loopHandler,
+		ttlRules:    opts.TTLRules,
+		replyRelay:  opts.ReplyRelay,
+		markDSCP:    opts.MarkDSCP,
+		recorder:    opts.Recorder,
+	}
+
 	reader.Recv = func(packet gopacket.Packet) {
-		network := ""
-		if packet.Layer(layers.LayerTypeIPv4) != nil {
-			network = "ipv4"
-		} else {
-			network = "ipv6"
+		if opts.GroupTracker != nil && opts.GroupTracker.Observe(packet) {
+			return
+		}
+		if packet.Layer(layers.LayerTypeUDP) == nil {
+			return
 		}
-		loopHandler.RegisterPacket(network, packet.Data()[len(packet.LinkLayer().LayerContents()):])
+		if opts.ReplyRelay != nil && opts.ReplyRelay.ObserveCaptured(packet) {
+			return
+		}
+		if opts.StormControl != nil {
+			flow := packet.NetworkLayer().NetworkFlow()
+			if !opts.StormControl.Allow(flow.Src().Raw(), flow.Dst().Raw()) {
+				return
+			}
+		}
+
+		loopHandler.RegisterPacket(packetNetwork(packet), packet.Data()[len(packet.LinkLayer().LayerContents()):])
+		handler.record(directionCaptured, packet.Data())
 		packetChan <- packet.Data()
 	}
 
@@ -40,16 +119,9 @@ func NewPacketHandler(iface string, loopHandler *LoopHandler) (*PacketHandler, e
 		return nil, err
 	}
 
-	return &PacketHandler{
-		log:         zap.L().With(zap.String("facility", "packet_handler")),
-		reader:      reader,
-		packetChan:  packetChan,
-		writeLock:   &sync.Mutex{},
-		sock4Fd:     fd4,
-		sock6Fd:     fd6,
-		iface:       iface,
-		loopHandler: loopHandler,
-	}, nil
+	handler.sock4Fd = fd4
+	handler.sock6Fd = fd6
+	return handler, nil
 }
 
 type PacketHandler struct {
@@ -61,11 +133,52 @@ type PacketHandler struct {
 	sock6Fd     int
 	log         *zap.Logger
 	iface       string
+	ifIndex     int
+	mtu         int
 	loopHandler *LoopHandler
+	ttlRules    TTLRules
+	replyRelay  *ReplyRelay
+	markDSCP    uint8
+	recorder    *common.Recorder
 }
 
+const (
+	directionCaptured = "captured"
+	directionInjected = "injected"
+)
+
+// record writes a frame to the recorder, in case one is set. Each direction
+// is recorded as a distinct interface.
+func (c *PacketHandler) record(direction string, frame []byte) {
+	if c.recorder == nil {
+		return
+	}
+	iface := common.RecorderInterface{
+		Name:        c.iface + ":" + direction,
+		Description: "Packets " + direction + " on " + c.iface,
+	}
+	// Packets handled while shutting down are not recorded.
+	if err := c.recorder.Record(iface, time.Now(), frame, "direction="+direction); err != nil && !errors.Is(err, os.ErrClosed) {
+		c.log.Error("Failed recording packet", zap.Error(err))
+	}
+}
+
+// recordInjected records a datagram as written to the raw socket, carried in
+// the link-layer header of the frame it was received in.
+func (c *PacketHandler) recordInjected(link, datagram []byte) {
+	if c.recorder == nil {
+		return
+	}
+	frame := make([]byte, 0, len(link)+len(datagram))
+	c.record(directionInjected, append(append(frame, link...), datagram...))
+}
+
+// Start captures packets until Shutdown is called or the capture fails.
+// Once it returns, NextPacket reports the end of the capture after all
+// captured packets were consumed.
 func (c *PacketHandler) Start() error {
 	c.log.Info("Packet handler now capturing and injecting packets", zap.String("iface", c.iface))
+	defer close(c.packetChan)
 	err := c.reader.Run()
 	if err == io.EOF {
 		err = nil
@@ -73,53 +186,123 @@ func (c *PacketHandler) Start() error {
 	return err
 }
 
-func (c *PacketHandler) NextPacket() []byte { return <-c.packetChan }
+// NextPacket returns the next captured packet, or false in case the capture
+// is over.
+func (c *PacketHandler) NextPacket() ([]byte, bool) {
+	pkt, ok := <-c.packetChan
+	return pkt, ok
+}
+
+// SetCapturing pauses or resumes the capture, such as when this nodelet
+// stands by for another forwarder of its segment. Packets are still
+// injected while paused.
+func (c *PacketHandler) SetCapturing(capturing bool) {
+	c.reader.SetPaused(!capturing)
+}
 
+// Shutdown stops capturing packets.
 func (c *PacketHandler) Shutdown() { c.reader.Shutdown() }
 
+// Close releases sockets used to inject packets. Inject must not be called
+// afterwards.
+func (c *PacketHandler) Close() {
+	for _, fd := range []int{c.sock4Fd, c.sock6Fd} {
+		if err := syscall.Close(fd); err != nil {
+			c.log.Error("Failed closing raw socket", zap.Error(err))
+		}
+	}
+}
+
 func (c *PacketHandler) Inject(pkt []byte) error {
-	network, target, addr, data := c.routePacket(pkt)
+	network, target, addr, data, link := c.routePacket(pkt)
+	if target == -1 {
+		return nil
+	}
 	c.log.Debug("Routed package",
 		zap.Any("target_fd", target),
 		zap.String("network", network),
 		zap.Any("addr", addr),
 		zap.ByteString("data", data))
 
-	if c.loopHandler.ShouldDropPacket(network, data) {
-		c.log.Debug("Dropped packet blocked by Loop Handler")
-		return nil
+	fragments := [][]byte{data}
+	if network == "ipv4" && len(data) > c.mtu {
+		var err error
+		if fragments, err = ip.Fragment(data, c.mtu); err != nil {
+			c.log.Error("Failed fragmenting packet", zap.Int("mtu", c.mtu), zap.Error(err))
+			return err
+		}
 	}
 
-	if err := syscall.Sendto(target, data, 0, addr); err != nil {
-		errno := "<no errno>"
-		var e syscall.Errno
-		if errors.As(err, &e) {
-			errno = fmt.Sprintf("%d", int(e))
-		}
-		c.log.Error("Failed pushing packet to raw socket",
-			zap.String("errno", errno),
-			zap.ByteString("data", data),
-			zap.Error(err))
+	for _, fragment := range fragments {
+		c.recordInjected(link, fragment)
+		if err := syscall.Sendto(target, fragment, 0, addr); err != nil {
+			errno := "<no errno>"
+			var e syscall.Errno
+			if errors.As(err, &e) {
+				errno = fmt.Sprintf("%d", int(e))
+			}
+			c.log.Error("Failed pushing packet to raw socket",
+				zap.String("errno", errno),
+				zap.ByteString("data", fragment),
+				zap.Error(err))
 
-		return err
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (c *PacketHandler) routePacket(rawPkt []byte) (string, int, syscall.Sockaddr, []byte) {
+// InjectReply injects a reply relayed from a remote segment, in case it is
+// destined to a querier observed on the local segment.
+func (c *PacketHandler) InjectReply(frame []byte) error {
+	if c.replyRelay == nil {
+		return nil
+	}
+	info, ok := common.ParseFrame(frame)
+	if !ok || !c.replyRelay.Accepts(info) {
+		c.log.Debug("Dropped reply with no local querier")
+		return nil
+	}
+	return c.Inject(frame)
+}
+
+// routePacket rewrites a frame received from the dispatcher, returning the
+// network family, socket and address it must be injected through, the
+// network-layer datagram to inject, and the rewritten link-layer header it was
+// carried with. The returned socket is -1 in case the frame must be dropped.
+func (c *PacketHandler) routePacket(rawPkt []byte) (string, int, syscall.Sockaddr, []byte, []byte) {
 	pkt := gopacket.NewPacket(rawPkt, layers.LayerTypeEthernet, gopacket.Default)
 	udpLayer := pkt.Layer(layers.LayerTypeUDP)
 	if udpLayer == nil {
 		c.log.Info("Dropped packet with no UDP layer", zap.ByteString("packet", rawPkt))
-		return "", -1, nil, nil
+		return "", -1, nil, nil, nil
 	}
 
 	udp := udpLayer.(*layers.UDP)
 	err := udp.SetNetworkLayerForChecksum(pkt.NetworkLayer())
 	if err != nil {
 		c.log.Error("Failed setting network layer for checksum", zap.Error(err))
-		return "", -1, nil, nil
+		return "", -1, nil, nil, nil
+	}
+
+	// Packets are registered by the loop handler as captured, so loops
+	// must be detected before the packet is rewritten.
+	if c.loopHandler.ShouldDropPacket(packetNetwork(pkt), rawPkt[len(pkt.LinkLayer().LayerContents()):]) {
+		c.log.Debug("Dropped packet blocked by Loop Handler")
+		return "", -1, nil, nil, nil
+	}
+
+	if !c.applyTTLPolicy(pkt, udp) {
+		return "", -1, nil, nil, nil
+	}
+
+	if c.replyRelay != nil {
+		c.replyRelay.Rewrite(pkt, udp)
+	}
+
+	if c.markDSCP != 0 {
+		c.applyMark(pkt)
 	}
 
 	options := gopacket.SerializeOptions{
@@ -129,13 +312,13 @@ func (c *PacketHandler) routePacket(rawPkt []byte) (string, int, syscall.Sockadd
 	buf := gopacket.NewSerializeBuffer()
 	if err = gopacket.SerializePacket(buf, options, pkt); err != nil {
 		c.log.Error("Failed serializing packet", zap.Error(err))
-		return "", -1, nil, nil
+		return "", -1, nil, nil, nil
 	}
 
-	addr, err := extractAddress(pkt, udp)
+	addr, err := extractAddress(pkt, udp, c.ifIndex)
 	if err != nil {
 		c.log.Error("Failed extracting address", zap.Error(err))
-		return "", -1, nil, nil
+		return "", -1, nil, nil, nil
 	}
 
 	var target int
@@ -149,13 +332,63 @@ func (c *PacketHandler) routePacket(rawPkt []byte) (string, int, syscall.Sockadd
 		target = c.sock6Fd
 	}
 
-	return network, target, addr, buf.Bytes()[len(pkt.LinkLayer().LayerContents()):]
+	linkLen := len(pkt.LinkLayer().LayerContents())
+	return network, target, addr, buf.Bytes()[linkLen:], buf.Bytes()[:linkLen]
+}
+
+// packetNetwork returns the network family of a packet, as used to register
+// and look up packets in the loop handler.
+func packetNetwork(pkt gopacket.Packet) string {
+	if pkt.Layer(layers.LayerTypeIPv4) != nil {
+		return "ipv4"
+	}
+	return "ipv6"
 }
 
-func extractAddress(pkt gopacket.Packet, udp *layers.UDP) (syscall.Sockaddr, error) {
+func (c *PacketHandler) applyTTLPolicy(pkt gopacket.Packet, udp *layers.UDP) bool {
+	if ipLayer := pkt.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ipLayer := ipLayer.(*layers.IPv4)
+		policy := c.ttlRules.PolicyFor(ipLayer.DstIP, uint16(udp.DstPort))
+		ttl, ok := policy.Apply(ipLayer.TTL)
+		if !ok {
+			c.log.Debug("Dropped packet with expired TTL",
+				zap.Stringer("dst", ipLayer.DstIP),
+				zap.Stringer("policy", policy))
+			return false
+		}
+		ipLayer.TTL = ttl
+		return true
+	}
+
+	if ipLayer := pkt.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ipLayer := ipLayer.(*layers.IPv6)
+		policy := c.ttlRules.PolicyFor(ipLayer.DstIP, uint16(udp.DstPort))
+		hopLimit, ok := policy.Apply(ipLayer.HopLimit)
+		if !ok {
+			c.log.Debug("Dropped packet with expired hop limit",
+				zap.Stringer("dst", ipLayer.DstIP),
+				zap.Stringer("policy", policy))
+			return false
+		}
+		ipLayer.HopLimit = hopLimit
+		return true
+	}
+
+	return true
+}
+
+func (c *PacketHandler) applyMark(pkt gopacket.Packet) {
+	switch l := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		l.TOS = ip.WithDSCP(l.TOS, c.markDSCP)
+	case *layers.IPv6:
+		l.TrafficClass = ip.WithDSCP(l.TrafficClass, c.markDSCP)
+	}
+}
+
+func extractAddress(pkt gopacket.Packet, udp *layers.UDP, ifIndex int) (syscall.Sockaddr, error) {
 	if ipLayer := pkt.Layer(layers.LayerTypeIPv4); ipLayer != nil {
 		ipLayer := ipLayer.(*layers.IPv4)
-		ipLayer.TTL = 255
 		return &syscall.SockaddrInet4{
 			Port: int(udp.DstPort),
 			Addr: [4]byte(ipLayer.DstIP.To4()),
@@ -164,11 +397,14 @@ func extractAddress(pkt gopacket.Packet, udp *layers.UDP) (syscall.Sockaddr, err
 
 	if ipLayer := pkt.Layer(layers.LayerTypeIPv6); ipLayer != nil {
 		ipLayer, _ := ipLayer.(*layers.IPv6)
-		ipLayer.HopLimit = 128
+		zone := uint32(0)
+		if ipLayer.DstIP.IsLinkLocalUnicast() {
+			zone = uint32(ifIndex)
+		}
 		return &syscall.SockaddrInet6{
 			Port:   0,
 			Addr:   [16]byte(ipLayer.DstIP.To16()),
-			ZoneId: 0,
+			ZoneId: zone,
 		}, nil
 	}
 
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withTTL returns a copy of an Ethernet/IPv4 frame carrying the provided TTL.
+func withTTL(frame []byte, ttl uint8) []byte {
+	frame = append([]byte{}, frame...)
+	frame[14+8] = ttl
+	return frame
+}
+
+func TestPacketHandler_LoopCheckBeforeRewrite(t *testing.T) {
+	loops := NewLoopHandler(time.Minute, 128)
+	handler := &PacketHandler{
+		log:         zap.NewNop(),
+		loopHandler: loops,
+		ttlRules:    TTLRules{{Policy: TTLPolicy{Mode: TTLFixed, Value: 255}}},
+		markDSCP:    46,
+	}
+
+	// SSDP-like frame with a low TTL, captured locally and echoed back by
+	// the dispatcher through another nodelet on the same segment.
+	echoed := withTTL(makeUDPFrame(t, "239.255.255.250"), 2)
+	loops.RegisterPacket("ipv4", echoed[14:])
+	_, target, _, _, _ := handler.routePacket(echoed)
+	assert.Equal(t, -1, target, "echoes must be detected regardless of rewrites")
+
+	remote := withTTL(makeUDPFrame(t, "239.255.255.251"), 2)
+	network, target, _, data, _ := handler.routePacket(remote)
+	require.NotEqual(t, -1, target)
+	assert.Equal(t, "ipv4", network)
+	decoded := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	assert.Equal(t, uint8(255), decoded.TTL)
+}
+
+func TestTTLRules_DefaultPreserves(t *testing.T) {
+	handler := &PacketHandler{log: zap.NewNop(), loopHandler: NewLoopHandler(time.Minute, 128)}
+	_, target, _, data, _ := handler.routePacket(withTTL(makeUDPFrame(t, "239.255.255.250"), 4))
+	require.NotEqual(t, -1, target)
+	decoded := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	assert.Equal(t, uint8(4), decoded.TTL, "packets matching no rule keep their TTL")
+}
+
+func TestPacketHandler_RecordsInjectedBytes(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := common.NewRecorder(common.RecorderOptions{Dir: dir, Prefix: "inject"})
+	require.NoError(t, err)
+	// Writing to a pipe instead of a raw socket fails once the frame was
+	// recorded.
+	pr, pw, err := os.Pipe()
+	require.NoError(t, err)
+	defer func() { _, _ = pr.Close(), pw.Close() }()
+	handler := &PacketHandler{
+		log:         zap.NewNop(),
+		iface:       "eth0",
+		mtu:         1500,
+		sock4Fd:     int(pw.Fd()),
+		loopHandler: NewLoopHandler(time.Minute, 128),
+		ttlRules:    TTLRules{{Policy: TTLPolicy{Mode: TTLFixed, Value: 255}}},
+		markDSCP:    46,
+		recorder:    recorder,
+	}
+	assert.Error(t, handler.Inject(withTTL(makeUDPFrame(t, "239.255.255.250"), 2)))
+	require.NoError(t, recorder.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "inject-*.pcapng"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	f, err := os.Open(files[0])
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+	reader, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	data, _, err := reader.ReadPacketData()
+	require.NoError(t, err)
+
+	recorded := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	assert.Equal(t, uint8(255), recorded.TTL)
+	assert.Equal(t, uint8(46), recorded.TOS>>2)
+}
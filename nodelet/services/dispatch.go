@@ -14,6 +14,17 @@ import (
 type DispatchStatus string
 
 var DrainingErr = fmt.Errorf("cannot write: drain in progress")
+var OversizedErr = fmt.Errorf("cannot write: message exceeds maximum payload size")
+
+// rejectedCooldown is the time waited before reconnecting after the
+// dispatcher closed the connection due to quotas.
+const rejectedCooldown = 30 * time.Second
+
+// roleTimeout is the time a nodelet configured with a segment stands by after
+// connecting, waiting for the dispatcher to assign its role. Dispatchers not
+// supporting segment election never do, in which case the nodelet forwards
+// as active.
+const roleTimeout = 10 * time.Second
 
 const (
 	StatusConnecting    DispatchStatus = "connecting"
@@ -24,11 +35,15 @@ const (
 	StatusSwitching     DispatchStatus = "switching"
 )
 
-func NewDispatch(address string, targetNS *string) *Dispatch {
+// NewDispatch returns a Dispatch connecting to the provided address and
+// joining the provided namespaces. Frames written through Write are published
+// on all of them, and the dispatch global namespace is used in case none is
+// provided.
+func NewDispatch(address string, namespaces []string) *Dispatch {
 	return &Dispatch{
 		log:        zap.L().With(zap.String("facility", "dispatch")),
 		address:    address,
-		writeQueue: make(chan []byte, 4096),
+		writeQueue: make(chan common.ClientMessage, 4096),
 
 		enqueued:   &atomic.Int32{},
 		status:     &atomic.Value{},
@@ -37,28 +52,42 @@ func NewDispatch(address string, targetNS *string) *Dispatch {
 		draining:   &atomic.Bool{},
 		writerDone: make(chan bool),
 
-		OnConnect:    make(chan struct{}),
+		OnConnect:    make(chan struct{}, 1),
+		OnRole:       make(chan struct{}, 1),
 		OnDisconnect: make(chan struct{}),
 		OnPacket:     make(chan []byte, 4096),
+		OnGroups:     make(chan []net.IP, 16),
+		OnReply:      make(chan []byte, 256),
 		stop:         &atomic.Bool{},
 		conn:         nil,
+		rebooting:    &atomic.Bool{},
 
 		suspended:  false,
 		writerLock: &sync.Mutex{},
 		readLock:   &sync.Mutex{},
-		targetNS:   targetNS,
+		namespaces: namespaces,
+		groups:     &atomic.Pointer[[]net.IP]{},
+		role:       &atomic.Uint32{},
+		roleEpoch:  &atomic.Uint64{},
+		roleWait:   roleTimeout,
+
+		rtt:               &atomic.Int64{},
+		pongs:             &atomic.Uint64{},
+		keepaliveTimeouts: &atomic.Uint64{},
 	}
 }
 
 type Dispatcher interface {
 	notifyBroken(*dispatchConnection)
-	targetNamespace() []byte
+	notifyDead(*dispatchConnection)
+	helloPayload() []byte
+	recordPong(rtt time.Duration)
 }
 
 type Dispatch struct {
 	log        *zap.Logger
 	address    string
-	writeQueue chan []byte
+	writeQueue chan common.ClientMessage
 
 	enqueued   *atomic.Int32
 	status     *atomic.Value
@@ -67,16 +96,51 @@ type Dispatch struct {
 	draining   *atomic.Bool
 	writerDone chan bool
 
-	OnConnect    chan struct{}
+	// OnConnect is signalled once a connection is established. It holds a
+	// single pending signal, so receivers starting after the connection
+	// completed still observe it.
+	OnConnect chan struct{}
+	// OnRole is signalled once the segment role changes, holding a single
+	// pending signal. Receivers must read the current role through Role.
+	OnRole       chan struct{}
 	OnDisconnect chan struct{}
 	OnPacket     chan []byte
+	OnGroups     chan []net.IP
+	OnReply      chan []byte
 	stop         *atomic.Bool
 	conn         *dispatchConnection
+	// rebooting is set while a goroutine replaces conn, which must only be
+	// read or replaced by the goroutine holding it.
+	rebooting *atomic.Bool
 
 	suspended  bool
 	writerLock *sync.Mutex
 	readLock   *sync.Mutex
-	targetNS   *string
+	namespaces []string
+	identity   common.Hello
+	groups     *atomic.Pointer[[]net.IP]
+
+	// role holds the common.SegmentRole assigned by the dispatcher, in case
+	// a segment is configured. roleEpoch is incremented upon each connection
+	// and role assignment, so a pending roleWait fallback only applies to the
+	// connection it was started for.
+	role      *atomic.Uint32
+	roleEpoch *atomic.Uint64
+	roleWait  time.Duration
+
+	keepaliveInterval  time.Duration
+	keepaliveMaxMissed int
+	rtt                *atomic.Int64
+	pongs              *atomic.Uint64
+	keepaliveTimeouts  *atomic.Uint64
+}
+
+// KeepaliveStats contains counters describing the PING/PONG exchange with
+// the dispatcher.
+type KeepaliveStats struct {
+	RTTMicros uint64 `json:"rtt_us"`
+	Pongs     uint64 `json:"pongs"`
+	Timeouts  uint64 `json:"timeouts"`
 }
 
 type DispatchError struct {
@@ -88,11 +152,120 @@ func (d *Dispatch) Status() DispatchStatus    { return d.status.Load().(Dispatch
 func (d *Dispatch) ServerHost() *string       { return d.serverHost.Load().(*string) }
 func (d *Dispatch) LastError() *DispatchError { return d.lastError.Load().(*DispatchError) }
 
-func (d *Dispatch) targetNamespace() []byte {
-	if d.targetNS == nil {
-		return nil
+// SetKeepalive configures the Dispatch to emit a PING every interval, and to
+// reconnect once maxMissed PINGs were emitted without hearing back from the
+// dispatcher. Keepalive is disabled when interval is zero. SetKeepalive must
+// be called before Run.
+func (d *Dispatch) SetKeepalive(interval time.Duration, maxMissed int) {
+	d.keepaliveInterval = interval
+	d.keepaliveMaxMissed = maxMissed
+}
+
+// KeepaliveStats returns a snapshot of the keepalive counters, along with the
+// last measured round-trip time.
+func (d *Dispatch) KeepaliveStats() KeepaliveStats {
+	return KeepaliveStats{
+		RTTMicros: uint64(d.rtt.Load() / int64(time.Microsecond)),
+		Pongs:     d.pongs.Load(),
+		Timeouts:  d.keepaliveTimeouts.Load(),
+	}
+}
+
+func (d *Dispatch) recordPong(rtt time.Duration) {
+	d.rtt.Store(int64(rtt))
+	d.pongs.Add(1)
+}
+
+// SetIdentity configures attributes advertised to the dispatcher during the
+// handshake. SetIdentity must be called before Run.
+func (d *Dispatch) SetIdentity(node, iface, version string, labels map[string]string) {
+	d.identity = common.Hello{
+		Node:      node,
+		Interface: iface,
+		Version:   version,
+		Labels:    labels,
 	}
-	return []byte(*d.targetNS)
+}
+
+// SetDirection configures whether this nodelet publishes frames, receives
+// frames, or both. The direction is enforced by the dispatcher; frames
+// written by subscribe-only nodelets are discarded before being sent.
+// SetDirection must be called before Run.
+func (d *Dispatch) SetDirection(direction common.Direction) {
+	d.identity.Direction = direction
+}
+
+// SetSegment configures the segment this nodelet forwards traffic for.
+// Nodelets reporting the same segment elect a single active forwarder through
+// the dispatcher, others standing by until it disconnects. Standby nodelets
+// neither publish nor receive frames, and are expected to pause capture when
+// signalled through OnRole. SetSegment must be called before Run.
+func (d *Dispatch) SetSegment(segment string) {
+	d.identity.Segment = segment
+}
+
+// Role returns the role assigned to this nodelet in its segment, which is
+// SegmentRoleNone when no segment is configured.
+func (d *Dispatch) Role() common.SegmentRole {
+	return common.SegmentRole(d.role.Load())
+}
+
+// setRole records the role assigned by the dispatcher, logging and
+// signalling transitions.
+func (d *Dispatch) setRole(role common.SegmentRole) {
+	previous := common.SegmentRole(d.role.Swap(uint32(role)))
+	if previous != role {
+		d.log.Info("Segment role transitioned",
+			zap.String("segment", d.identity.Segment),
+			zap.Stringer("from", previous),
+			zap.Stringer("to", role))
+		select {
+		case d.OnRole <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// standBy stands by until the dispatcher assigns a role to this nodelet,
+// returning the epoch to be provided to awaitRole once connected.
+func (d *Dispatch) standBy() uint64 {
+	epoch := d.roleEpoch.Add(1)
+	d.setRole(common.SegmentRoleStandby)
+	return epoch
+}
+
+// awaitRole falls back to active in case the dispatcher assigns no role
+// within roleWait of the connection, and no other connection was attempted
+// meanwhile.
+func (d *Dispatch) awaitRole(epoch uint64) {
+	time.AfterFunc(d.roleWait, func() {
+		if d.roleEpoch.Load() != epoch {
+			return
+		}
+		d.log.Warn("Dispatcher did not assign a segment role. Forwarding as active",
+			zap.String("segment", d.identity.Segment),
+			zap.Duration("timeout", d.roleWait))
+		d.setRole(common.SegmentRoleActive)
+	})
+}
+
+// assignRole records a role assigned by the dispatcher, cancelling pending
+// awaitRole fallbacks.
+func (d *Dispatch) assignRole(role common.SegmentRole) {
+	d.roleEpoch.Add(1)
+	d.setRole(role)
+}
+
+// canPublish determines whether frames captured by this nodelet must be
+// published, depending on its direction and segment role.
+func (d *Dispatch) canPublish() bool {
+	return d.identity.Direction.CanPublish() && d.Role() != common.SegmentRoleStandby
+}
+
+func (d *Dispatch) helloPayload() []byte {
+	hello := d.identity
+	hello.Namespaces = d.namespaces
+	return hello.Encode()
 }
 
 func (d *Dispatch) setStatus(val DispatchStatus) {
@@ -107,48 +280,161 @@ func (d *Dispatch) setError(err error) {
 	})
 }
 
-func (d *Dispatch) synchronize(lock sync.Locker) {
-	defer lock.Unlock()
-	lock.Lock()
+// current returns the current connection, waiting for reconnections in
+// progress to complete.
+func (d *Dispatch) current() *dispatchConnection {
+	d.readLock.Lock()
+	defer d.readLock.Unlock()
+	return d.conn
 }
 
-func (d *Dispatch) makeConnection() {
+// makeConnection connects to the dispatcher, trying addresses indicated by
+// redirect first, and retrying the configured address until it succeeds.
+// previous is the address of the dispatcher emitting the redirect, if any.
+func (d *Dispatch) makeConnection(redirect common.ByeRedirect, previous net.Addr) {
 	d.setStatus(StatusConnecting)
+	var roleEpoch uint64
+	if d.identity.Segment != "" {
+		// Stand by until the new dispatcher elects a forwarder, so traffic
+		// is not forwarded twice during failovers.
+		roleEpoch = d.standBy()
+	}
+	candidates := d.redirectCandidates(redirect, previous)
 	var disp *dispatchConnection
 	for {
-		conn, err := net.Dial("tcp", d.address)
+		address := d.address
+		redirected := len(candidates) > 0
+		if redirected {
+			address, candidates = candidates[0], candidates[1:]
+		}
+		conn, err := net.Dial("tcp", address)
 		if err == nil {
 			disp, err = newDispatchConnection(d, conn)
 			if err == nil {
 				d.conn = disp
 				d.serverHost.Store(&d.conn.ServerHost)
-				d.log.Info("Now connected", zap.String("host", d.conn.ServerHost))
+				d.log.Info("Now connected", zap.String("host", d.conn.ServerHost), zap.String("address", address))
+				d.advertiseGroups()
+				if d.identity.Segment != "" {
+					d.awaitRole(roleEpoch)
+				}
+				if d.keepaliveInterval > 0 {
+					go disp.serviceKeepalive(d.keepaliveInterval, d.keepaliveMaxMissed)
+				}
 				if d.suspended {
 					d.resume()
 				}
 				d.setStatus(StatusConnected)
+				select {
+				case d.OnConnect <- struct{}{}:
+				default:
+				}
 				break
 			}
 		}
 
+		d.setError(err)
+		if redirected {
+			d.log.Warn("Connection attempt to redirected address failed", zap.String("address", address), zap.Error(err))
+			continue
+		}
 		timeout := 2 * time.Second
 		d.log.Error("Connection attempt failed", zap.Duration("cooldown", timeout), zap.Error(err))
-		d.setError(err)
 		time.Sleep(timeout)
 	}
 }
 
+// redirectCandidates returns addresses to be tried before the configured
+// address, as requested by a BYE redirect.
+func (d *Dispatch) redirectCandidates(redirect common.ByeRedirect, previous net.Addr) []string {
+	switch redirect.Kind {
+	case common.ByeRedirectAddress:
+		if redirect.Address == "" {
+			return nil
+		}
+		return []string{redirect.Address}
+	case common.ByeRedirectAnyButMe:
+		host, port, err := net.SplitHostPort(d.address)
+		if err != nil {
+			d.log.Warn("Cannot honour redirect", zap.Error(err))
+			return nil
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			d.log.Warn("Cannot honour redirect: failed resolving dispatch address", zap.Error(err))
+			return nil
+		}
+		var previousIP net.IP
+		if tcp, ok := previous.(*net.TCPAddr); ok {
+			previousIP = tcp.IP
+		}
+		var candidates []string
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && ip.Equal(previousIP) {
+				continue
+			}
+			candidates = append(candidates, net.JoinHostPort(addr, port))
+		}
+		if len(candidates) == 0 {
+			d.log.Warn("Cannot honour redirect: no other dispatch address available", zap.String("address", d.address))
+		}
+		return candidates
+	default:
+		return nil
+	}
+}
+
 func (d *Dispatch) Run() {
-	d.makeConnection()
+	d.rebooting.Store(true)
+	d.makeConnection(common.ByeRedirect{}, nil)
+	d.rebooting.Store(false)
 	d.service()
 	d.setStatus(StatusDisconnected)
 }
 
 func (d *Dispatch) Write(data []byte) error {
+	if !d.canPublish() {
+		return nil
+	}
+	return d.enqueue(common.NewClientMessage(common.ClientMessagePkt, data))
+}
+
+// WriteReply relays a unicast reply to a query injected by this nodelet
+// back to the nodelet which captured the query.
+func (d *Dispatch) WriteReply(frame []byte) error {
+	if !d.canPublish() {
+		return nil
+	}
+	return d.enqueue(common.NewClientMessage(common.ClientMessageReply, frame))
+}
+
+// SetGroups advertises multicast groups having listeners on the local
+// segment. Groups are advertised again upon reconnection.
+func (d *Dispatch) SetGroups(groups []net.IP) error {
+	d.groups.Store(&groups)
+	return d.enqueue(common.NewClientMessage(common.ClientMessageGroups, common.EncodeGroups(groups)))
+}
+
+// advertiseGroups emits the last set of groups provided to SetGroups through
+// the current connection, in case any.
+func (d *Dispatch) advertiseGroups() {
+	groups := d.groups.Load()
+	if groups == nil {
+		return
+	}
+	if err := d.conn.Write(common.NewClientMessage(common.ClientMessageGroups, common.EncodeGroups(*groups))); err != nil {
+		d.log.Error("Failed advertising groups", zap.Error(err))
+	}
+}
+
+func (d *Dispatch) enqueue(msg common.ClientMessage) error {
+	if msg == nil {
+		return OversizedErr
+	}
 	if d.draining.Load() {
 		return DrainingErr
 	}
-	d.writeQueue <- data
+	d.writeQueue <- msg
 	return nil
 }
 
@@ -185,36 +471,38 @@ func (d *Dispatch) Shutdown() {
 	d.setStatus(StatusDisconnecting)
 
 	d.drain()
-	if err := d.conn.Write(common.NewClientMessage(common.ClientMessageBye, nil)); err != nil {
+	if err := d.conn.Write(common.NewByeMessage(common.ByeReasonShutdown)); err != nil {
 		d.log.Error("Failed emitting BYE packet", zap.Error(err))
 	}
 	if err := d.conn.Shutdown(); err != nil && !errors.Is(err, net.ErrClosed) {
 		d.log.Error("Underlying connection failed to close. Check for leaked resources.", zap.Error(err))
 	}
 	close(d.OnPacket)
+	close(d.OnGroups)
+	close(d.OnReply)
 }
 
 func (d *Dispatch) serviceReads() {
 	for !d.stop.Load() {
-		d.synchronize(d.readLock)
-		pkt := d.conn.Read()
+		pkt := d.current().Read()
 		if pkt == nil {
 			continue
 		}
-		d.OnPacket <- pkt.Payload()
+		d.handlePacket(pkt)
 	}
 }
 
+// serviceWrites emits enqueued messages until writeQueue is closed by
+// drain, so messages enqueued before Shutdown are still delivered.
 func (d *Dispatch) serviceWrites() {
 	defer close(d.writerDone)
-	for !d.stop.Load() {
+	for {
 		toWrite, ok := <-d.writeQueue
 		if !ok {
 			return
 		}
 		for {
-			d.synchronize(d.readLock)
-			err := d.conn.Write(common.NewClientMessage(common.ClientMessagePkt, toWrite))
+			err := d.current().Write(toWrite)
 			if err != nil {
 				d.log.Debug("Failed writing current packet due to broken connection. Will retry after synchronization is complete.")
 				// Connection is broken, try again after resynchronize
@@ -229,9 +517,40 @@ func (d *Dispatch) handlePacket(pkt common.ClientMessage) {
 	switch pkt.Type() {
 	case common.ClientMessagePkt:
 		d.OnPacket <- pkt.Payload()
+	case common.ClientMessageNsPkt:
+		// Emitted when joining several namespaces. Frames are injected
+		// regardless of the namespace they were published on.
+		_, frame, err := common.DecodeNsPkt(pkt.Payload())
+		if err != nil {
+			d.log.Warn("Received malformed NSPKT packet from dispatcher", zap.Error(err))
+			return
+		}
+		d.OnPacket <- frame
 	case common.ClientMessageBye:
-		d.log.Info("Received disconnection request from dispatcher. Reconnecting...")
-		d.reboot()
+		reason, redirect := common.DecodeBye(pkt.Payload())
+		cooldown := time.Duration(0)
+		if reason == common.ByeReasonQuotaExceeded || reason == common.ByeReasonNamespaceFull {
+			cooldown = rejectedCooldown
+		}
+		d.log.Info("Received disconnection request from dispatcher. Reconnecting...",
+			zap.Stringer("reason", reason),
+			zap.Stringer("redirect", redirect.Kind),
+			zap.String("redirect_address", redirect.Address),
+			zap.Duration("cooldown", cooldown))
+		if d.acquireReboot(nil) {
+			d.rebootAfter(cooldown, redirect)
+		}
+	case common.ClientMessageGroups:
+		groups, err := common.DecodeGroups(pkt.Payload())
+		if err != nil {
+			d.log.Warn("Received malformed GROUPS packet from dispatcher", zap.Error(err))
+			return
+		}
+		d.OnGroups <- groups
+	case common.ClientMessageReply:
+		d.OnReply <- pkt.Payload()
+	case common.ClientMessageRole:
+		d.assignRole(common.DecodeRole(pkt.Payload()))
 	default:
 		d.log.Warn("Received unknown packet from dispatcher", zap.ByteString("data", pkt))
 	}
@@ -251,21 +570,58 @@ func (d *Dispatch) resume() {
 	d.suspended = false
 }
 
-func (d *Dispatch) reboot() {
+func (d *Dispatch) reboot() { d.rebootAfter(0, common.ByeRedirect{}) }
+
+// acquireReboot determines whether the caller may reconnect due to an issue
+// with conn, or with the current connection in case conn is nil. Returns
+// false in case another goroutine is already reconnecting, or conn was
+// already replaced. Callers obtaining true must call rebootAfter.
+func (d *Dispatch) acquireReboot(conn *dispatchConnection) bool {
+	if !d.rebooting.CompareAndSwap(false, true) {
+		return false
+	}
+	if conn != nil && d.conn != conn {
+		d.rebooting.Store(false)
+		return false
+	}
+	return true
+}
+
+// rebootAfter closes the current connection and connects again after the
+// provided cooldown, honouring the provided redirect. It must only be called
+// after acquireReboot succeeds.
+func (d *Dispatch) rebootAfter(cooldown time.Duration, redirect common.ByeRedirect) {
+	defer d.rebooting.Store(false)
 	d.log.Debug("Now switching dispatch server")
 	d.setStatus(StatusSwitching)
 	d.suspend()
+	previous := d.conn.conn.RemoteAddr()
+	// A dead peer may never drain the socket, so the BYE must not block.
+	_ = d.conn.conn.SetWriteDeadline(time.Now().Add(time.Second))
 	if err := d.conn.Write(common.NewClientMessage(common.ClientMessageBye, nil)); err != nil {
 		d.log.Warn("Failed emitting BYE packet", zap.Error(err))
 	}
 	if err := d.conn.Shutdown(); err != nil {
 		d.log.Error("Failed closing previous underlying connection. Check for leaked resources.", zap.Error(err))
 	}
-	d.makeConnection()
+	time.Sleep(cooldown)
+	d.makeConnection(redirect, previous)
+}
+
+func (d *Dispatch) notifyDead(conn *dispatchConnection) {
+	if !d.acquireReboot(conn) {
+		return
+	}
+
+	d.keepaliveTimeouts.Add(1)
+	d.log.Warn("Dispatcher stopped responding to keepalives. Will attempt to reconnect.",
+		zap.Int("missed", d.keepaliveMaxMissed),
+		zap.Duration("interval", d.keepaliveInterval))
+	d.reboot()
 }
 
 func (d *Dispatch) notifyBroken(conn *dispatchConnection) {
-	if d.conn != conn || d.suspended {
+	if !d.acquireReboot(conn) {
 		return
 	}
 
@@ -16,7 +16,9 @@ var ConnectionBrokenErr = fmt.Errorf("connection is broken. Try again")
 type dummyDispatcher struct{}
 
 func (d *dummyDispatcher) notifyBroken(connection *dispatchConnection) {}
-func (d *dummyDispatcher) targetNamespace() []byte                     { return nil }
+func (d *dummyDispatcher) notifyDead(connection *dispatchConnection)   {}
+func (d *dummyDispatcher) helloPayload() []byte                        { return nil }
+func (d *dummyDispatcher) recordPong(time.Duration)                    {}
 
 var dummyDispatch Dispatcher = &dummyDispatcher{}
 
@@ -39,6 +41,9 @@ func newDispatchConnection(parent *Dispatch, conn net.Conn) (*dispatchConnection
 
 		ch:   make(chan common.ClientMessage, 100),
 		done: make(chan bool),
+
+		missedPings: &atomic.Int32{},
+		pingSent:    &atomic.Int64{},
 	}
 
 	d.storeParent(parent)
@@ -70,6 +75,12 @@ type dispatchConnection struct {
 
 	ch   chan common.ClientMessage
 	done chan bool
+
+	// missedPings counts PINGs emitted since the last message received from
+	// the server, and pingSent holds when the last unanswered PING was
+	// emitted, in nanoseconds since the epoch.
+	missedPings *atomic.Int32
+	pingSent    *atomic.Int64
 }
 
 func (d *dispatchConnection) shouldRelayConnectionError() bool {
@@ -109,15 +120,26 @@ func (d *dispatchConnection) serviceReads() {
 				}
 
 				d.ackLock.Lock()
+				d.receivedAck = true
 				d.ackCond.Signal()
 				d.ackLock.Unlock()
-				d.receivedAck = true
 
 				if d.ackError == nil {
 					continue
 				}
 				return
 			}
+			d.missedPings.Store(0)
+			switch pkt.Type() {
+			case common.ClientMessagePing:
+				_ = d.Write(common.NewClientMessage(common.ClientMessagePong, nil))
+				continue
+			case common.ClientMessagePong:
+				if sent := d.pingSent.Swap(0); sent != 0 {
+					d.parent().recordPong(time.Since(time.Unix(0, sent)))
+				}
+				continue
+			}
 			d.ch <- pkt
 		}
 	}
@@ -127,16 +149,18 @@ func (d *dispatchConnection) handshake() error {
 	go d.serviceReads()
 	timer := time.NewTimer(3 * time.Second)
 	defer timer.Stop()
-	okChan := make(chan bool)
+	okChan := make(chan bool, 1)
 	go func() {
 		d.ackLock.Lock()
 		defer d.ackLock.Unlock()
-		d.ackCond.Wait()
+		for !d.receivedAck {
+			d.ackCond.Wait()
+		}
 		okChan <- true
 	}()
 
 	handshake := common.NewClientMessage(common.ClientMessageHello,
-		d.parent().targetNamespace())
+		d.parent().helloPayload())
 	if err := d.Write(handshake); err != nil {
 		return err
 	}
@@ -145,7 +169,7 @@ func (d *dispatchConnection) handshake() error {
 	case <-timer.C:
 		return fmt.Errorf("server did not respond to handshake in time")
 	case <-okChan:
-		return nil
+		return d.ackError
 	}
 
 }
@@ -168,8 +192,35 @@ func (d *dispatchConnection) Write(pkt common.ClientMessage) error {
 
 func (d *dispatchConnection) Read() common.ClientMessage { return <-d.ch }
 
+// serviceKeepalive emits a PING every interval, and reports the connection
+// as broken once maxMissed PINGs were emitted without receiving any message
+// from the server.
+func (d *dispatchConnection) serviceKeepalive(interval time.Duration, maxMissed int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		if int(d.missedPings.Load()) >= maxMissed {
+			d.notifyDead()
+			return
+		}
+		d.missedPings.Add(1)
+		d.pingSent.Store(time.Now().UnixNano())
+		if err := d.Write(common.NewClientMessage(common.ClientMessagePing, nil)); err != nil {
+			return
+		}
+	}
+}
+
 func (d *dispatchConnection) Shutdown() error {
-	d.running.Swap(false)
+	if !d.running.Swap(false) {
+		return net.ErrClosed // Already shut down, e.g. by a reconnection.
+	}
 	err := d.conn.Close()
 	d.storeParent(dummyDispatch)
 	close(d.done)
@@ -178,6 +229,12 @@ func (d *dispatchConnection) Shutdown() error {
 
 func (d *dispatchConnection) wait() { <-d.done }
 
+func (d *dispatchConnection) notifyDead() {
+	if parent := d.parent(); parent != nil {
+		parent.(Dispatcher).notifyDead(d)
+	}
+}
+
 func (d *dispatchConnection) notifyBroken() {
 	if parent := d.parent(); parent != nil {
 		parent.(Dispatcher).notifyBroken(d)
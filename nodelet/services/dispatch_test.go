@@ -0,0 +1,279 @@
+package services
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatch_RedirectCandidates(t *testing.T) {
+	d := NewDispatch("127.0.0.1:3030", nil)
+	previous := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3030}
+
+	t.Run("no redirect", func(t *testing.T) {
+		assert.Empty(t, d.redirectCandidates(common.ByeRedirect{}, previous))
+	})
+
+	t.Run("address", func(t *testing.T) {
+		redirect := common.ByeRedirect{Kind: common.ByeRedirectAddress, Address: "dispatch-2:3030"}
+		assert.Equal(t, []string{"dispatch-2:3030"}, d.redirectCandidates(redirect, previous))
+	})
+
+	t.Run("any but me", func(t *testing.T) {
+		redirect := common.ByeRedirect{Kind: common.ByeRedirectAnyButMe}
+		assert.Empty(t, d.redirectCandidates(redirect, previous))
+
+		other := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3030}
+		assert.Equal(t, []string{"127.0.0.1:3030"}, d.redirectCandidates(redirect, other))
+	})
+}
+
+// serveFakeDispatch accepts connections, acknowledges their handshake and
+// answers PINGs on all connections but the first one.
+func serveFakeDispatch(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	accepted := atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			silent := accepted.Add(1) == 1
+			go func() {
+				defer func() { _ = conn.Close() }()
+				asm := common.NewMessageAssembler()
+				buf := make([]byte, 1)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					msg := asm.Feed(buf[0])
+					switch {
+					case msg == nil:
+					case msg.Type() == common.ClientMessageHello:
+						_, _ = conn.Write(common.NewClientMessage(common.ClientMessageAck, []byte("fake")))
+					case msg.Type() == common.ClientMessagePing && !silent:
+						_, _ = conn.Write(common.NewClientMessage(common.ClientMessagePong, nil))
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestDispatch_Keepalive(t *testing.T) {
+	listener := serveFakeDispatch(t)
+	defer func() { _ = listener.Close() }()
+
+	d := NewDispatch(listener.Addr().String(), nil)
+	d.SetKeepalive(20*time.Millisecond, 2)
+	go d.Run()
+	defer d.Shutdown()
+
+	require.Eventually(t, func() bool {
+		stats := d.KeepaliveStats()
+		return stats.Timeouts == 1 && stats.Pongs > 0
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, StatusConnected, d.Status())
+}
+
+func TestDispatch_MultipleNamespaces(t *testing.T) {
+	d := NewDispatch("127.0.0.1:3030", []string{"a", "b"})
+	hello, err := common.DecodeHello(d.helloPayload())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, hello.Namespaces)
+	assert.Equal(t, common.DirectionBoth, hello.Direction)
+
+	d.handlePacket(common.NewNsPktMessage("b", []byte("frame")))
+	select {
+	case frame := <-d.OnPacket:
+		assert.Equal(t, []byte("frame"), frame)
+	default:
+		t.Fatal("expected frame to be delivered")
+	}
+}
+
+func TestDispatch_SubscribeOnly(t *testing.T) {
+	d := NewDispatch("127.0.0.1:3030", nil)
+	d.SetDirection(common.DirectionSubscribe)
+	hello, err := common.DecodeHello(d.helloPayload())
+	require.NoError(t, err)
+	assert.Equal(t, common.DirectionSubscribe, hello.Direction)
+
+	require.NoError(t, d.Write([]byte("frame")))
+	require.NoError(t, d.WriteReply([]byte("reply")))
+	assert.Zero(t, d.enqueued.Load())
+}
+
+func TestDispatch_Oversized(t *testing.T) {
+	d := NewDispatch("127.0.0.1:3030", nil)
+	assert.ErrorIs(t, d.Write(make([]byte, common.MaxPayloadSize+1)), OversizedErr)
+	assert.Zero(t, len(d.writeQueue))
+	require.NoError(t, d.Write(make([]byte, common.MaxPayloadSize)))
+	assert.Equal(t, 1, len(d.writeQueue))
+}
+
+func TestDispatch_SegmentRole(t *testing.T) {
+	d := NewDispatch("127.0.0.1:3030", nil)
+	d.SetSegment("10.0.1.0/24")
+	hello, err := common.DecodeHello(d.helloPayload())
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.1.0/24", hello.Segment)
+
+	d.handlePacket(common.NewRoleMessage(common.SegmentRoleStandby))
+	assert.Equal(t, common.SegmentRoleStandby, d.Role())
+	require.NoError(t, d.Write([]byte("frame")))
+	require.NoError(t, d.WriteReply([]byte("reply")))
+	assert.Zero(t, len(d.writeQueue))
+
+	d.handlePacket(common.NewRoleMessage(common.SegmentRoleActive))
+	assert.Equal(t, common.SegmentRoleActive, d.Role())
+	require.NoError(t, d.Write([]byte("frame")))
+	assert.Equal(t, 1, len(d.writeQueue))
+}
+
+func TestDispatch_RoleFallback(t *testing.T) {
+	listener := serveFakeDispatch(t)
+	defer func() { _ = listener.Close() }()
+
+	// Dispatchers not supporting segment election never assign a role.
+	d := NewDispatch(listener.Addr().String(), nil)
+	d.SetSegment("lan")
+	d.roleWait = 50 * time.Millisecond
+	go d.Run()
+	defer d.Shutdown()
+
+	require.Eventually(t, func() bool { return d.Role() == common.SegmentRoleActive }, 2*time.Second, 10*time.Millisecond)
+	select {
+	case <-d.OnRole:
+	case <-time.After(time.Second):
+		t.Fatal("expected role transition to be signalled")
+	}
+
+	// Roles assigned by the dispatcher cancel the fallback.
+	d.awaitRole(d.standBy())
+	d.handlePacket(common.NewRoleMessage(common.SegmentRoleStandby))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, common.SegmentRoleStandby, d.Role())
+}
+
+func TestDispatch_OnConnectAfterConnection(t *testing.T) {
+	listener := serveFakeDispatch(t)
+	defer func() { _ = listener.Close() }()
+
+	d := NewDispatch(listener.Addr().String(), nil)
+	go d.Run()
+	defer d.Shutdown()
+
+	// The signal must be kept for receivers arriving after the connection
+	// completed.
+	require.Eventually(t, func() bool {
+		return d.status.Load() != nil && d.Status() == StatusConnected
+	}, 2*time.Second, 10*time.Millisecond)
+	select {
+	case <-d.OnConnect:
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be signalled")
+	}
+}
+
+func TestDispatch_ShutdownDrainsBeforeBye(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	received := make(chan common.ClientMessage, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		asm := common.NewMessageAssembler()
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(received)
+				return
+			}
+			msg := asm.Feed(buf[0])
+			switch {
+			case msg == nil:
+			case msg.Type() == common.ClientMessageHello:
+				_, _ = conn.Write(common.NewClientMessage(common.ClientMessageAck, []byte("fake")))
+			default:
+				received <- msg
+			}
+		}
+	}()
+
+	d := NewDispatch(listener.Addr().String(), nil)
+	go d.Run()
+	select {
+	case <-d.OnConnect:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected connection to be signalled")
+	}
+
+	for _, frame := range []string{"one", "two", "three"} {
+		require.NoError(t, d.Write([]byte(frame)))
+	}
+	d.Shutdown()
+	assert.ErrorIs(t, d.Write([]byte("late")), DrainingErr)
+
+	var kinds []common.ClientMessageType
+	var frames []string
+	for msg := range received {
+		kinds = append(kinds, msg.Type())
+		if msg.Type() == common.ClientMessagePkt {
+			frames = append(frames, string(msg.Payload()))
+		}
+	}
+	assert.Equal(t, []string{"one", "two", "three"}, frames)
+	require.NotEmpty(t, kinds)
+	assert.Equal(t, common.ClientMessageBye, kinds[len(kinds)-1], "BYE is emitted once pending frames are written")
+}
+
+func TestDispatch_ConcurrentNotifications(t *testing.T) {
+	listener := serveFakeDispatch(t)
+	defer func() { _ = listener.Close() }()
+
+	core, logs := observer.New(zap.InfoLevel)
+	d := NewDispatch(listener.Addr().String(), nil)
+	d.log = zap.New(core)
+	go d.Run()
+	defer d.Shutdown()
+
+	require.Eventually(t, func() bool {
+		return d.status.Load() != nil && d.Status() == StatusConnected
+	}, 2*time.Second, 10*time.Millisecond)
+	conn := d.conn
+
+	// The keepalive and reader goroutines may report the same connection at
+	// once, which must only reconnect once.
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		d.notifyDead(conn)
+	}()
+	go func() {
+		defer wg.Done()
+		d.notifyBroken(conn)
+	}()
+	wg.Wait()
+
+	require.Eventually(t, func() bool { return d.Status() == StatusConnected }, 2*time.Second, 10*time.Millisecond)
+	d.notifyBroken(conn)
+	assert.Equal(t, 2, logs.FilterMessage("Now connected").Len())
+}
@@ -0,0 +1,309 @@
+package services
+
+import (
+	"fmt"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/udpfw/common"
+	"go.uber.org/zap"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// NewGroupTracker returns a GroupTracker for the provided interface. Groups
+// are forgotten in case no report refreshes them within membershipTimeout.
+func NewGroupTracker(iface string, membershipTimeout time.Duration) (*GroupTracker, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var localAddrs []net.IP
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			localAddrs = append(localAddrs, ipNet.IP)
+		}
+	}
+
+	return &GroupTracker{
+		log:        zap.L().With(zap.String("facility", "group_tracker")),
+		groups:     make(map[string]time.Time),
+		timeout:    membershipTimeout,
+		localAddrs: localAddrs,
+		stopCh:     make(chan bool),
+		Changes:    make(chan struct{}, 1),
+	}, nil
+}
+
+// GroupTracker keeps track of multicast groups with listeners on the local
+// segment by observing IGMP and MLD reports.
+type GroupTracker struct {
+	log        *zap.Logger
+	mu         sync.Mutex
+	groups     map[string]time.Time
+	timeout    time.Duration
+	localAddrs []net.IP
+	stopCh     chan bool
+
+	// Changes is signaled whenever the set of groups changes, and every
+	// common.GroupsRefreshInterval so memberships can be refreshed.
+	Changes chan struct{}
+}
+
+func (g *GroupTracker) Start() {
+	go func() {
+		tick := time.NewTicker(common.GroupsRefreshInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				g.expire(time.Now())
+				g.notify()
+			case <-g.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (g *GroupTracker) Stop() { close(g.stopCh) }
+
+// Groups returns the list of groups currently having listeners.
+func (g *GroupTracker) Groups() []net.IP {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	groups := make([]net.IP, 0, len(g.groups))
+	for k := range g.groups {
+		groups = append(groups, net.IP(k))
+	}
+	sort.Slice(groups, func(i, j int) bool { return string(groups[i]) < string(groups[j]) })
+	return groups
+}
+
+func (g *GroupTracker) notify() {
+	select {
+	case g.Changes <- struct{}{}:
+	default:
+	}
+}
+
+func (g *GroupTracker) expire(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, t := range g.groups {
+		if now.Sub(t) > g.timeout {
+			g.log.Debug("Membership expired", zap.Stringer("group", net.IP(k)))
+			delete(g.groups, k)
+		}
+	}
+}
+
+func (g *GroupTracker) isLocal(src net.IP) bool {
+	for _, a := range g.localAddrs {
+		if a.Equal(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe inspects the provided packet for IGMP or MLD reports. Returns true
+// in case the packet was a membership message, meaning it must not be
+// forwarded.
+func (g *GroupTracker) Observe(packet gopacket.Packet) bool {
+	var (
+		src    net.IP
+		joined []net.IP
+		left   []net.IP
+	)
+
+	switch l := packet.Layer(layers.LayerTypeIGMP).(type) {
+	case *layers.IGMPv1or2:
+		switch l.Type {
+		case layers.IGMPMembershipReportV1, layers.IGMPMembershipReportV2:
+			joined = append(joined, l.GroupAddress)
+		case layers.IGMPLeaveGroup:
+			left = append(left, l.GroupAddress)
+		}
+	case *layers.IGMP:
+		for _, r := range l.GroupRecords {
+			switch {
+			case r.Type == layers.IGMPIsEx || r.Type == layers.IGMPToEx:
+				joined = append(joined, r.MulticastAddress)
+			case r.Type == layers.IGMPToIn && r.NumberOfSources == 0:
+				left = append(left, r.MulticastAddress)
+			case r.NumberOfSources > 0 && (r.Type == layers.IGMPIsIn || r.Type == layers.IGMPAllow):
+				joined = append(joined, r.MulticastAddress)
+			}
+		}
+	}
+
+	if l, ok := packet.Layer(layers.LayerTypeMLDv1MulticastListenerReport).(*layers.MLDv1MulticastListenerReportMessage); ok {
+		joined = append(joined, l.MulticastAddress)
+	}
+	if l, ok := packet.Layer(layers.LayerTypeMLDv1MulticastListenerDone).(*layers.MLDv1MulticastListenerDoneMessage); ok {
+		left = append(left, l.MulticastAddress)
+	}
+	if l, ok := packet.Layer(layers.LayerTypeMLDv2MulticastListenerReport).(*layers.MLDv2MulticastListenerReportMessage); ok {
+		for _, r := range l.MulticastAddressRecords {
+			switch {
+			case r.RecordType == layers.MLDv2MulticastAddressRecordTypeModeIsExcluded ||
+				r.RecordType == layers.MLDv2MulticastAddressRecordTypeChangeToExcludeMode:
+				joined = append(joined, r.MulticastAddress)
+			case r.RecordType == layers.MLDv2MulticastAddressRecordTypeChangeToIncludeMode && r.N == 0:
+				left = append(left, r.MulticastAddress)
+			case r.N > 0 && (r.RecordType == layers.MLDv2MulticastAddressRecordTypeModeIsIncluded ||
+				r.RecordType == layers.MLDv2MulticastAddressRecordTypeAllowNewSources):
+				joined = append(joined, r.MulticastAddress)
+			}
+		}
+	}
+
+	isMembership := packet.Layer(layers.LayerTypeIGMP) != nil ||
+		packet.Layer(layers.LayerTypeMLDv1MulticastListenerQuery) != nil ||
+		packet.Layer(layers.LayerTypeMLDv2MulticastListenerQuery) != nil ||
+		len(joined) > 0 || len(left) > 0
+	if !isMembership {
+		return false
+	}
+
+	if netLayer := packet.NetworkLayer(); netLayer != nil {
+		src = net.IP(netLayer.NetworkFlow().Src().Raw())
+	}
+	if g.isLocal(src) {
+		// Reports emitted by this host are a consequence of groups joined
+		// on behalf of remote segments, and must not be advertised back.
+		return true
+	}
+
+	g.update(joined, left)
+	return true
+}
+
+func (g *GroupTracker) update(joined, left []net.IP) {
+	g.mu.Lock()
+	changed := false
+	now := time.Now()
+	for _, group := range joined {
+		if !group.IsMulticast() {
+			continue
+		}
+		key := string(group.To16())
+		if _, ok := g.groups[key]; !ok {
+			g.log.Debug("Learned membership", zap.Stringer("group", group))
+			changed = true
+		}
+		g.groups[key] = now
+	}
+	for _, group := range left {
+		key := string(group.To16())
+		if _, ok := g.groups[key]; ok {
+			g.log.Debug("Membership left", zap.Stringer("group", group))
+			delete(g.groups, key)
+			changed = true
+		}
+	}
+	g.mu.Unlock()
+
+	if changed {
+		g.notify()
+	}
+}
+
+// NewGroupJoiner returns a GroupJoiner joining groups on the provided
+// interface.
+func NewGroupJoiner(iface string) (*GroupJoiner, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupJoiner{
+		log:     zap.L().With(zap.String("facility", "group_joiner")),
+		ifIndex: netIface.Index,
+		joined:  make(map[string]int),
+	}, nil
+}
+
+// GroupJoiner joins multicast groups on an interface so switches performing
+// IGMP or MLD snooping forward traffic of those groups to this host. Each
+// group is joined through a dedicated socket, avoiding per-socket membership
+// limits imposed by the kernel.
+type GroupJoiner struct {
+	log     *zap.Logger
+	mu      sync.Mutex
+	ifIndex int
+	joined  map[string]int
+}
+
+// Sync joins groups present in the provided list, and leaves previously
+// joined groups absent from it.
+func (j *GroupJoiner) Sync(groups []net.IP) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	wanted := make(map[string]net.IP, len(groups))
+	for _, g := range groups {
+		wanted[string(g.To16())] = g
+	}
+
+	for key, fd := range j.joined {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		j.log.Debug("Leaving group", zap.Stringer("group", net.IP(key)))
+		if err := syscall.Close(fd); err != nil {
+			j.log.Error("Failed closing membership socket", zap.Stringer("group", net.IP(key)), zap.Error(err))
+		}
+		delete(j.joined, key)
+	}
+
+	for key, group := range wanted {
+		if _, ok := j.joined[key]; ok {
+			continue
+		}
+		fd, err := j.join(group)
+		if err != nil {
+			j.log.Error("Failed joining group", zap.Stringer("group", group), zap.Error(err))
+			continue
+		}
+		j.log.Debug("Joined group", zap.Stringer("group", group))
+		j.joined[key] = fd
+	}
+}
+
+// Shutdown leaves all joined groups.
+func (j *GroupJoiner) Shutdown() { j.Sync(nil) }
+
+func (j *GroupJoiner) join(group net.IP) (int, error) {
+	if v4 := group.To4(); v4 != nil {
+		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+		if err != nil {
+			return -1, err
+		}
+		mreq := &syscall.IPMreqn{Multiaddr: [4]byte(v4), Ifindex: int32(j.ifIndex)}
+		if err = syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq); err != nil {
+			_ = syscall.Close(fd)
+			return -1, fmt.Errorf("IP_ADD_MEMBERSHIP: %w", err)
+		}
+		return fd, nil
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return -1, err
+	}
+	mreq := &syscall.IPv6Mreq{Multiaddr: [16]byte(group.To16()), Interface: uint32(j.ifIndex)}
+	if err = syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq); err != nil {
+		_ = syscall.Close(fd)
+		return -1, fmt.Errorf("IPV6_JOIN_GROUP: %w", err)
+	}
+	return fd, nil
+}
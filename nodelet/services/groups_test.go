@@ -0,0 +1,224 @@
+package services
+
+import (
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestGroupTracker(timeout time.Duration, localAddrs ...net.IP) *GroupTracker {
+	return &GroupTracker{
+		log:        zap.NewNop(),
+		groups:     make(map[string]time.Time),
+		timeout:    timeout,
+		localAddrs: localAddrs,
+		stopCh:     make(chan bool),
+		Changes:    make(chan struct{}, 1),
+	}
+}
+
+func igmpPacket(t *testing.T, src string, body []byte) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x01, 0, 0x5e, 0, 0, 0x16},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      1,
+		Protocol: layers.IPProtocolIGMP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP("224.0.0.22"),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		eth, ip, gopacket.Payload(body)))
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func mldPacket(t *testing.T, src string, body []byte) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0, 0, 0, 0x16},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   1,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      net.ParseIP(src),
+		DstIP:      net.ParseIP("ff02::16"),
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeMLDv2MulticastListenerReportMessageV2, 0),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		eth, ip, icmp, gopacket.Payload(body)))
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// igmpv3Record encodes an IGMPv3 group record with the provided sources.
+func igmpv3Record(kind byte, group string, sources ...string) []byte {
+	record := append([]byte{kind, 0, 0, byte(len(sources))}, net.ParseIP(group).To4()...)
+	for _, s := range sources {
+		record = append(record, net.ParseIP(s).To4()...)
+	}
+	return record
+}
+
+// mldv2Record encodes a MLDv2 multicast address record with the provided
+// sources.
+func mldv2Record(kind byte, group string, sources ...string) []byte {
+	record := append([]byte{kind, 0, 0, byte(len(sources))}, net.ParseIP(group).To16()...)
+	for _, s := range sources {
+		record = append(record, net.ParseIP(s).To16()...)
+	}
+	return record
+}
+
+func TestGroupTracker_Observe(t *testing.T) {
+	local := net.ParseIP("192.168.0.1")
+	tests := []struct {
+		name       string
+		initial    []string
+		packet     gopacket.Packet
+		membership bool
+		want       []string
+	}{
+		{
+			name:       "IGMPv2 report",
+			packet:     igmpPacket(t, "192.168.0.10", []byte{0x16, 0, 0, 0, 239, 1, 1, 1}),
+			membership: true,
+			want:       []string{"239.1.1.1"},
+		},
+		{
+			name:       "IGMPv2 leave",
+			initial:    []string{"239.1.1.1", "239.1.1.2"},
+			packet:     igmpPacket(t, "192.168.0.10", []byte{0x17, 0, 0, 0, 239, 1, 1, 1}),
+			membership: true,
+			want:       []string{"239.1.1.2"},
+		},
+		{
+			name:       "IGMPv2 query",
+			initial:    []string{"239.1.1.1"},
+			packet:     igmpPacket(t, "192.168.0.10", []byte{0x11, 100, 0, 0, 0, 0, 0, 0}),
+			membership: true,
+			want:       []string{"239.1.1.1"},
+		},
+		{
+			name:    "IGMPv3 report",
+			initial: []string{"239.1.1.1", "239.1.1.4"},
+			packet: igmpPacket(t, "192.168.0.10", concat(
+				[]byte{0x22, 0, 0, 0, 0, 0, 0, 4},
+				igmpv3Record(byte(layers.IGMPIsEx), "239.1.1.2"),
+				igmpv3Record(byte(layers.IGMPToIn), "239.1.1.1"),
+				igmpv3Record(byte(layers.IGMPAllow), "239.1.1.3", "192.168.0.20"),
+				igmpv3Record(byte(layers.IGMPIsIn), "239.1.1.5"),
+			)),
+			membership: true,
+			want:       []string{"239.1.1.2", "239.1.1.3", "239.1.1.4"},
+		},
+		{
+			name:    "MLDv2 report",
+			initial: []string{"ff05::2", "ff05::4"},
+			packet: mldPacket(t, "fe80::10", concat(
+				[]byte{0, 0, 0, 4},
+				mldv2Record(byte(layers.MLDv2MulticastAddressRecordTypeModeIsExcluded), "ff05::1"),
+				mldv2Record(byte(layers.MLDv2MulticastAddressRecordTypeChangeToIncludeMode), "ff05::2"),
+				mldv2Record(byte(layers.MLDv2MulticastAddressRecordTypeAllowNewSources), "ff05::3", "fe80::20"),
+				mldv2Record(byte(layers.MLDv2MulticastAddressRecordTypeModeIsIncluded), "ff05::5"),
+			)),
+			membership: true,
+			want:       []string{"ff05::1", "ff05::3", "ff05::4"},
+		},
+		{
+			name:       "non-multicast group",
+			packet:     igmpPacket(t, "192.168.0.10", []byte{0x16, 0, 0, 0, 10, 0, 0, 1}),
+			membership: true,
+		},
+		{
+			name:       "local report",
+			packet:     igmpPacket(t, local.String(), []byte{0x16, 0, 0, 0, 239, 1, 1, 1}),
+			membership: true,
+		},
+		{
+			name:   "UDP datagram",
+			packet: gopacket.NewPacket(makeUDPFrame(t, "239.1.1.1"), layers.LayerTypeEthernet, gopacket.Default),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGroupTracker(time.Minute, local)
+			var initial []net.IP
+			for _, group := range tt.initial {
+				initial = append(initial, net.ParseIP(group))
+			}
+			g.update(initial, nil)
+
+			assert.Equal(t, tt.membership, g.Observe(tt.packet))
+			var got []string
+			for _, group := range g.Groups() {
+				got = append(got, group.String())
+			}
+			assert.ElementsMatch(t, tt.want, got)
+		})
+	}
+}
+
+func TestGroupTracker_Expire(t *testing.T) {
+	g := newTestGroupTracker(time.Minute)
+	assert.True(t, g.Observe(igmpPacket(t, "192.168.0.10", []byte{0x16, 0, 0, 0, 239, 1, 1, 1})))
+	select {
+	case <-g.Changes:
+	default:
+		t.Fatal("expected new membership to be signalled")
+	}
+
+	// Refreshing a known membership is not a change.
+	assert.True(t, g.Observe(igmpPacket(t, "192.168.0.10", []byte{0x16, 0, 0, 0, 239, 1, 1, 1})))
+	assert.Empty(t, g.Changes)
+
+	g.expire(time.Now().Add(30 * time.Second))
+	assert.Len(t, g.Groups(), 1)
+	g.expire(time.Now().Add(2 * time.Minute))
+	assert.Empty(t, g.Groups())
+}
+
+func TestGroupJoiner_Sync(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil || lo.Flags&net.FlagMulticast == 0 {
+		t.Skip("loopback interface does not support multicast")
+	}
+	j := &GroupJoiner{log: zap.NewNop(), ifIndex: lo.Index, joined: make(map[string]int)}
+	defer j.Shutdown()
+
+	a, b := net.ParseIP("239.255.0.1"), net.ParseIP("239.255.0.2")
+	j.Sync([]net.IP{a, b})
+	if len(j.joined) == 0 {
+		t.Skip("joining groups is not permitted")
+	}
+	require.Len(t, j.joined, 2)
+	fd := j.joined[string(a.To16())]
+
+	j.Sync([]net.IP{a})
+	assert.Len(t, j.joined, 1)
+	assert.Equal(t, fd, j.joined[string(a.To16())], "kept groups are not joined again")
+
+	j.Sync(nil)
+	assert.Empty(t, j.joined)
+}
+
+func concat(parts ...[]byte) []byte {
+	var result []byte
+	for _, p := range parts {
+		result = append(result, p...)
+	}
+	return result
+}
@@ -1,72 +1,239 @@
 package services
 
 import (
-	"hash"
-	"hash/fnv"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func NewLoopHandler() *LoopHandler {
-	return &LoopHandler{
-		messages:  make(map[string]time.Time),
-		messageMu: sync.Mutex{},
-		hashFn:    fnv.New64a(),
-		stopCh:    make(chan bool),
-		ticker:    nil,
+const (
+	// loopShards determines how many independently locked shards compose
+	// the loop cache.
+	loopShards = 16
+
+	// loopBuckets determines how many time buckets cover a shard's window.
+	// Entries are kept for at least the window, and at most the window plus
+	// the duration of a single bucket.
+	loopBuckets = 8
+
+	// MinLoopWindow is the shortest window accepted by NewLoopHandler, as
+	// expired entries are released every window divided by loopBuckets.
+	MinLoopWindow = 100 * time.Millisecond
+)
+
+// LoopStats contains counters describing the operation of a LoopHandler.
+type LoopStats struct {
+	Registered  uint64 `json:"registered"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Entries     int64  `json:"entries"`
+}
+
+// NewLoopHandler returns a LoopHandler remembering captured packets for the
+// provided window, holding at most capacity packets at any given time. The
+// window must be at least MinLoopWindow, and capacity must be positive.
+func NewLoopHandler(window time.Duration, capacity int) *LoopHandler {
+	shardCapacity := capacity / loopShards
+	if shardCapacity < 1 {
+		shardCapacity = 1
+	}
+
+	l := &LoopHandler{
+		seed:          maphash.MakeSeed(),
+		bucketWidth:   window / loopBuckets,
+		shardCapacity: shardCapacity,
+		stopCh:        make(chan bool),
+		now:           time.Now,
+	}
+	if l.bucketWidth <= 0 {
+		l.bucketWidth = 1
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make([]map[uint64]struct{}, loopBuckets+1)
+		for j := range l.shards[i].buckets {
+			l.shards[i].buckets[j] = make(map[uint64]struct{})
+		}
 	}
+	return l
 }
 
+// LoopHandler remembers packets captured on the local segment so they are
+// not injected back into it, preventing forwarding loops. Packets are
+// identified by their hash, and kept in sharded, time-bucketed sets.
 type LoopHandler struct {
-	messages  map[string]time.Time
-	messageMu sync.Mutex
-	hashFn    hash.Hash64
-	stopCh    chan bool
-	ticker    *time.Ticker
+	seed          maphash.Seed
+	bucketWidth   time.Duration
+	shardCapacity int
+	shards        [loopShards]loopShard
+	stopCh        chan bool
+	now           func() time.Time
+
+	registered  atomic.Uint64
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+	entries     atomic.Int64
+}
+
+type loopShard struct {
+	mu sync.Mutex
+
+	// buckets is a ring of sets, with head pointing to the bucket receiving
+	// new entries, and older buckets following it.
+	buckets []map[uint64]struct{}
+	head    int
+	epoch   int64
+	size    int
 }
 
 func (l *LoopHandler) Stop() { close(l.stopCh) }
 
+// Start periodically releases expired entries, even if no packets are
+// registered or looked up.
 func (l *LoopHandler) Start() {
-	l.ticker = time.NewTicker(10 * time.Second)
 	go func() {
-	loop:
+		ticker := time.NewTicker(l.bucketWidth)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-l.ticker.C:
-				l.messageMu.Lock()
-				for h, t := range l.messages {
-					if time.Now().Sub(t) > 2*time.Second {
-						delete(l.messages, h)
-					}
+			case <-ticker.C:
+				epoch := l.epoch()
+				for i := range l.shards {
+					s := &l.shards[i]
+					s.mu.Lock()
+					l.rotate(s, epoch)
+					s.mu.Unlock()
 				}
-				l.messageMu.Unlock()
 			case <-l.stopCh:
-				break loop
+				return
 			}
 		}
-		l.ticker.Stop()
 	}()
 }
 
-func (l *LoopHandler) hashPacket(network string, pkt []byte) string {
-	defer l.hashFn.Reset()
-	_, _ = l.hashFn.Write(pkt)
-	return network + "-" + string(l.hashFn.Sum(nil))
+// Stats returns a snapshot of the handler's counters.
+func (l *LoopHandler) Stats() LoopStats {
+	return LoopStats{
+		Registered:  l.registered.Load(),
+		Hits:        l.hits.Load(),
+		Misses:      l.misses.Load(),
+		Evictions:   l.evictions.Load(),
+		Expirations: l.expirations.Load(),
+		Entries:     l.entries.Load(),
+	}
+}
+
+func (l *LoopHandler) epoch() int64 { return l.now().UnixNano() / int64(l.bucketWidth) }
+
+func (l *LoopHandler) hashPacket(network string, pkt []byte) uint64 {
+	var h maphash.Hash
+	h.SetSeed(l.seed)
+	_, _ = h.WriteString(network)
+	_ = h.WriteByte(0)
+	_, _ = h.Write(pkt)
+	return h.Sum64()
+}
+
+func (l *LoopHandler) shardFor(digest uint64) *loopShard {
+	return &l.shards[digest%loopShards]
+}
+
+// rotate advances the shard's ring up to the provided epoch, dropping
+// buckets that fell out of the window. Must be called with the shard's lock
+// held.
+func (l *LoopHandler) rotate(s *loopShard, epoch int64) {
+	steps := epoch - s.epoch
+	if steps <= 0 {
+		return
+	}
+	if steps > int64(len(s.buckets)) {
+		steps = int64(len(s.buckets))
+	}
+	for i := int64(0); i < steps; i++ {
+		s.head = (s.head + len(s.buckets) - 1) % len(s.buckets)
+		if n := len(s.buckets[s.head]); n > 0 {
+			l.expirations.Add(uint64(n))
+			l.entries.Add(int64(-n))
+			s.size -= n
+			s.buckets[s.head] = make(map[uint64]struct{})
+		}
+	}
+	s.epoch = epoch
+}
+
+// evictOldest drops the oldest non-empty bucket of the shard. Must be called
+// with the shard's lock held.
+func (l *LoopHandler) evictOldest(s *loopShard) {
+	for i := len(s.buckets) - 1; i > 0; i-- {
+		idx := (s.head + i) % len(s.buckets)
+		if n := len(s.buckets[idx]); n > 0 {
+			l.evictions.Add(uint64(n))
+			l.entries.Add(int64(-n))
+			s.size -= n
+			s.buckets[idx] = make(map[uint64]struct{})
+			return
+		}
+	}
+
+	// Only the current bucket holds entries; drop a single arbitrary one.
+	for k := range s.buckets[s.head] {
+		delete(s.buckets[s.head], k)
+		l.evictions.Add(1)
+		l.entries.Add(-1)
+		s.size--
+		return
+	}
 }
 
 func (l *LoopHandler) RegisterPacket(network string, pkt []byte) {
 	digest := l.hashPacket(network, pkt)
-	l.messageMu.Lock()
-	defer l.messageMu.Unlock()
-	l.messages[digest] = time.Now()
+	s := l.shardFor(digest)
+	epoch := l.epoch()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l.rotate(s, epoch)
+	l.registered.Add(1)
+
+	for i, b := range s.buckets {
+		if _, ok := b[digest]; ok {
+			if i == s.head {
+				return
+			}
+			// Refresh the entry by moving it to the current bucket.
+			delete(b, digest)
+			s.buckets[s.head][digest] = struct{}{}
+			return
+		}
+	}
+
+	if s.size >= l.shardCapacity {
+		l.evictOldest(s)
+	}
+	s.buckets[s.head][digest] = struct{}{}
+	s.size++
+	l.entries.Add(1)
 }
 
 func (l *LoopHandler) ShouldDropPacket(network string, pkt []byte) bool {
 	digest := l.hashPacket(network, pkt)
-	l.messageMu.Lock()
-	defer l.messageMu.Unlock()
+	s := l.shardFor(digest)
+	epoch := l.epoch()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l.rotate(s, epoch)
 
-	t, ok := l.messages[digest]
-	return ok && time.Now().Sub(t) < 2*time.Second
+	for _, b := range s.buckets {
+		if _, ok := b[digest]; ok {
+			l.hits.Add(1)
+			return true
+		}
+	}
+	l.misses.Add(1)
+	return false
 }
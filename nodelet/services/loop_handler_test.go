@@ -0,0 +1,97 @@
+package services
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestLoopHandler(window time.Duration, capacity int) (*LoopHandler, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l := NewLoopHandler(window, capacity)
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestLoopHandler_Window(t *testing.T) {
+	l, clock := newTestLoopHandler(2*time.Second, 1024)
+	pkt := []byte("packet")
+
+	assert.False(t, l.ShouldDropPacket("ipv4", pkt))
+	l.RegisterPacket("ipv4", pkt)
+	assert.True(t, l.ShouldDropPacket("ipv4", pkt))
+	assert.False(t, l.ShouldDropPacket("ipv6", pkt))
+
+	clock.Advance(1900 * time.Millisecond)
+	assert.True(t, l.ShouldDropPacket("ipv4", pkt))
+
+	clock.Advance(time.Second)
+	assert.False(t, l.ShouldDropPacket("ipv4", pkt))
+
+	stats := l.Stats()
+	assert.Equal(t, uint64(1), stats.Registered)
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(3), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Expirations)
+	assert.Zero(t, stats.Entries)
+}
+
+func TestLoopHandler_Capacity(t *testing.T) {
+	l, clock := newTestLoopHandler(2*time.Second, loopShards*4)
+	for i := 0; i < loopShards*16; i++ {
+		l.RegisterPacket("ipv4", []byte(fmt.Sprintf("packet-%d", i)))
+		clock.Advance(time.Millisecond)
+	}
+
+	stats := l.Stats()
+	assert.LessOrEqual(t, stats.Entries, int64(loopShards*4))
+	assert.Equal(t, uint64(loopShards*16), stats.Evictions+uint64(stats.Entries))
+}
+
+func TestLoopHandler_Concurrent(t *testing.T) {
+	l := NewLoopHandler(time.Second, 4096)
+	l.Start()
+	defer l.Stop()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				l.RegisterPacket("ipv4", []byte(fmt.Sprintf("%d-%d", i, j)))
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				l.ShouldDropPacket("ipv4", []byte(fmt.Sprintf("%d-%d", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := l.Stats()
+	assert.Equal(t, uint64(8000), stats.Registered)
+	assert.Equal(t, uint64(8000), stats.Hits+stats.Misses)
+	assert.LessOrEqual(t, stats.Entries, int64(4096))
+}
@@ -0,0 +1,17 @@
+package services
+
+import (
+	"expvar"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// ServeMetrics exposes variables published through expvar on the provided
+// address, under /debug/vars. This function blocks until the server fails.
+func ServeMetrics(bind string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	zap.L().With(zap.String("facility", "metrics")).
+		Info("Serving metrics", zap.String("address", bind))
+	return http.ListenAndServe(bind, mux)
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/udpfw/common"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"time"
+)
+
+var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// NewReplayer returns a Replayer reading frames from the pcap or pcapng file
+// at the provided path. Frames are emitted with their original timing divided
+// by speed, or as fast as possible in case speed is zero.
+func NewReplayer(path string, speed float64) (*Replayer, error) {
+	if speed < 0 {
+		return nil, fmt.Errorf("speed must not be negative")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed reading %s: %w", path, err)
+	}
+
+	var source packetSource
+	if bytes.Equal(magic, pcapngMagic) {
+		source, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	} else {
+		source, err = pcapgo.NewReader(r)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if source.LinkType() != layers.LinkTypeEthernet {
+		_ = f.Close()
+		return nil, fmt.Errorf("unsupported link type %s", source.LinkType())
+	}
+
+	return &Replayer{
+		log:    zap.L().With(zap.String("facility", "replay")),
+		file:   f,
+		source: source,
+		speed:  speed,
+		sleep:  time.Sleep,
+	}, nil
+}
+
+// Replayer emits UDP multicast frames read from a capture file.
+type Replayer struct {
+	log    *zap.Logger
+	file   *os.File
+	source packetSource
+	speed  float64
+	sleep  func(time.Duration)
+}
+
+// Run emits all UDP multicast frames through write, returning the amount of
+// frames emitted. Other frames are skipped.
+func (r *Replayer) Run(write func([]byte) error) (int, error) {
+	defer func() { _ = r.file.Close() }()
+
+	var (
+		first   time.Time
+		started time.Time
+		emitted int
+	)
+	for {
+		data, ci, err := r.source.ReadPacketData()
+		if err == io.EOF {
+			return emitted, nil
+		} else if err != nil {
+			return emitted, err
+		}
+
+		info, ok := common.ParseFrame(data)
+		if !ok || info.Protocol != uint8(layers.IPProtocolUDP) || !info.Dst.IsMulticast() {
+			continue
+		}
+
+		if first.IsZero() {
+			first, started = ci.Timestamp, time.Now()
+		} else if r.speed > 0 {
+			offset := time.Duration(float64(ci.Timestamp.Sub(first)) / r.speed)
+			if wait := offset - time.Since(started); wait > 0 {
+				r.sleep(wait)
+			}
+		}
+
+		if err = write(data); err != nil {
+			return emitted, err
+		}
+		emitted++
+		r.log.Debug("Emitted frame", zap.Stringer("dst", info.Dst), zap.Uint16("port", info.DstPort))
+	}
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func makeUDPFrame(t *testing.T, dst string) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x01, 0, 0x5e, 0, 0, 0xfb},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      255,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("192.168.0.10"),
+		DstIP:    net.ParseIP(dst),
+	}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 5353}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf,
+		gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		eth, ip, udp, gopacket.Payload("payload")))
+	return buf.Bytes()
+}
+
+type captureWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+func writeCapture(t *testing.T, w captureWriter, frames [][]byte, start time.Time) {
+	for i, f := range frames {
+		require.NoError(t, w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     start.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(f),
+			Length:        len(f),
+		}, f))
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	frames := [][]byte{
+		makeUDPFrame(t, "224.0.0.251"),
+		makeUDPFrame(t, "192.168.0.20"),
+		makeUDPFrame(t, "239.255.255.250"),
+	}
+	start := time.Now().Add(-time.Hour)
+
+	pcapPath := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(pcapPath)
+	require.NoError(t, err)
+	w := pcapgo.NewWriter(f)
+	require.NoError(t, w.WriteFileHeader(65535, layers.LinkTypeEthernet))
+	writeCapture(t, w, frames, start)
+	require.NoError(t, f.Close())
+
+	ngPath := filepath.Join(t.TempDir(), "capture.pcapng")
+	f, err = os.Create(ngPath)
+	require.NoError(t, err)
+	ngw, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	writeCapture(t, ngw, frames, start)
+	require.NoError(t, ngw.Flush())
+	require.NoError(t, f.Close())
+
+	for _, path := range []string{pcapPath, ngPath} {
+		r, err := NewReplayer(path, 2)
+		require.NoError(t, err)
+		var slept []time.Duration
+		r.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+		var emitted [][]byte
+		n, err := r.Run(func(data []byte) error {
+			emitted = append(emitted, data)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, n, path)
+		assert.Equal(t, [][]byte{frames[0], frames[2]}, emitted, path)
+		require.Len(t, slept, 1, path)
+		assert.InDelta(t, time.Second, slept[0], float64(100*time.Millisecond), path)
+	}
+}
@@ -0,0 +1,387 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/udpfw/common"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxReplyFlows bounds the amount of queries awaiting unicast replies
+	// at any given time. Queries exceeding this limit are injected
+	// unchanged.
+	maxReplyFlows = 256
+
+	// maxReplyQueriers bounds the amount of local queriers awaiting replies
+	// from remote segments. Queries exceeding this limit are forwarded, but
+	// replies to them are not accepted.
+	maxReplyQueriers = 1024
+)
+
+var ssdpSearchPrefix = []byte("M-SEARCH")
+
+// isUnicastQuery determines whether the provided datagram is a query whose
+// replies are sent through unicast to the querier, namely mDNS QU or legacy
+// unicast questions, and SSDP M-SEARCH requests.
+func isUnicastQuery(udp *layers.UDP) bool {
+	switch udp.DstPort {
+	case 5353:
+		dns := &layers.DNS{}
+		if err := dns.DecodeFromBytes(udp.Payload, gopacket.NilDecodeFeedback); err != nil || dns.QR {
+			return false
+		}
+		if udp.SrcPort != 5353 {
+			return true
+		}
+		for _, q := range dns.Questions {
+			if q.Class&0x8000 != 0 {
+				return true
+			}
+		}
+		return false
+	case 1900:
+		return bytes.HasPrefix(udp.Payload, ssdpSearchPrefix)
+	default:
+		return false
+	}
+}
+
+type replyFlow struct {
+	querier *net.UDPAddr
+	conn    *net.UDPConn
+	expires time.Time
+}
+
+// NewReplyRelay returns a ReplyRelay rewriting injected queries to
+// addresses of the provided interface. Flows are kept for the provided
+// timeout after the last query is injected.
+func NewReplyRelay(iface string, timeout time.Duration) (*ReplyRelay, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReplyRelay{
+		log:     zap.L().With(zap.String("facility", "reply_relay")),
+		iface:   netIface,
+		timeout: timeout,
+		flows:   make(map[string]*replyFlow),
+		ports:   make(map[int]*replyFlow),
+		queries: make(map[string]time.Time),
+		Replies: make(chan []byte, 256),
+	}
+
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if v4 := ipNet.IP.To4(); v4 != nil {
+			if r.addr4 == nil {
+				r.addr4 = v4
+			}
+		} else if ipNet.IP.IsLinkLocalUnicast() && r.addr6 == nil {
+			r.addr6 = ipNet.IP
+		}
+	}
+
+	if r.addr4 == nil && r.addr6 == nil {
+		return nil, fmt.Errorf("interface %s has no usable addresses", iface)
+	}
+
+	return r, nil
+}
+
+// ReplyRelay completes query/reply exchanges in which replies are sent
+// through unicast to the querier. Injected queries have their source
+// rewritten to this host, so replies can be received and relayed back to the
+// nodelet that captured the query, which then delivers it to the querier.
+type ReplyRelay struct {
+	log     *zap.Logger
+	mu      sync.Mutex
+	iface   *net.Interface
+	addr4   net.IP
+	addr6   net.IP
+	timeout time.Duration
+
+	// flows holds queries injected by this nodelet, indexed by their
+	// original querier and by local port. Once closed, no further flows are
+	// created.
+	flows  map[string]*replyFlow
+	ports  map[int]*replyFlow
+	closed bool
+	wg     sync.WaitGroup
+
+	// queries holds queriers on the local segment awaiting replies from
+	// remote segments. Expired queriers are pruned once per timeout.
+	queries   map[string]time.Time
+	lastPrune time.Time
+
+	// Replies receives Ethernet frames containing replies to injected
+	// queries, which must be relayed to the Dispatch service. It is closed
+	// by Close.
+	Replies chan []byte
+}
+
+// Close stops relaying replies, closing sockets of all flows and waiting for
+// them to stop.
+func (r *ReplyRelay) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	for _, flow := range r.flows {
+		_ = flow.conn.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	close(r.Replies)
+}
+
+func (r *ReplyRelay) localAddr(remote net.IP) net.IP {
+	if remote.To4() != nil {
+		return r.addr4
+	}
+	return r.addr6
+}
+
+// ObserveCaptured inspects packets captured on the interface, recording
+// queriers awaiting unicast replies. Returns true in case the packet is a
+// query previously injected by the relay, which must not be forwarded.
+func (r *ReplyRelay) ObserveCaptured(packet gopacket.Packet) bool {
+	netLayer := packet.NetworkLayer()
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if netLayer == nil || !ok {
+		return false
+	}
+
+	src := net.IP(netLayer.NetworkFlow().Src().Raw())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if local := r.localAddr(src); local != nil && local.Equal(src) {
+		if _, ok := r.ports[int(udp.SrcPort)]; ok {
+			return true
+		}
+	}
+
+	if isUnicastQuery(udp) {
+		r.recordQuerier(&net.UDPAddr{IP: src, Port: int(udp.SrcPort)}, time.Now())
+	}
+	return false
+}
+
+// recordQuerier registers a local querier awaiting replies. mu must be held.
+func (r *ReplyRelay) recordQuerier(querier *net.UDPAddr, now time.Time) {
+	if now.Sub(r.lastPrune) >= r.timeout {
+		for k, exp := range r.queries {
+			if now.After(exp) {
+				delete(r.queries, k)
+			}
+		}
+		r.lastPrune = now
+	}
+
+	key := querier.String()
+	if _, ok := r.queries[key]; !ok && len(r.queries) >= maxReplyQueriers {
+		r.log.Debug("Not tracking querier, too many queriers awaiting replies", zap.Stringer("querier", querier))
+		return
+	}
+	r.queries[key] = now.Add(r.timeout)
+}
+
+// Accepts determines whether the provided reply is destined to a querier on
+// the local segment.
+func (r *ReplyRelay) Accepts(info common.FrameInfo) bool {
+	dst := &net.UDPAddr{IP: info.Dst, Port: int(info.DstPort)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	exp, ok := r.queries[dst.String()]
+	return ok && !time.Now().After(exp)
+}
+
+// Rewrite replaces the source address of the provided packet by an address
+// of this host in case it is a query expecting unicast replies. Replies
+// received for it are emitted through Replies.
+func (r *ReplyRelay) Rewrite(pkt gopacket.Packet, udp *layers.UDP) {
+	if !isUnicastQuery(udp) {
+		return
+	}
+
+	var src net.IP
+	switch l := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src = l.SrcIP
+	case *layers.IPv6:
+		src = l.SrcIP
+	default:
+		return
+	}
+
+	querier := &net.UDPAddr{IP: src, Port: int(udp.SrcPort)}
+	flow, err := r.flowFor(querier)
+	if err != nil {
+		r.log.Warn("Injecting query without rewriting its source",
+			zap.Stringer("querier", querier),
+			zap.Error(err))
+		return
+	}
+
+	local := flow.conn.LocalAddr().(*net.UDPAddr)
+	switch l := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		l.SrcIP = local.IP
+	case *layers.IPv6:
+		l.SrcIP = local.IP
+	}
+	udp.SrcPort = layers.UDPPort(local.Port)
+}
+
+func (r *ReplyRelay) flowFor(querier *net.UDPAddr) (*replyFlow, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, fmt.Errorf("reply relay is closed")
+	}
+
+	key := querier.String()
+	if flow, ok := r.flows[key]; ok {
+		flow.expires = time.Now().Add(r.timeout)
+		return flow, nil
+	}
+
+	if len(r.flows) >= maxReplyFlows {
+		return nil, fmt.Errorf("too many flows awaiting replies")
+	}
+
+	local := r.localAddr(querier.IP)
+	if local == nil {
+		return nil, fmt.Errorf("no local address for querier's family")
+	}
+
+	network, zone := "udp4", ""
+	if local.To4() == nil {
+		network, zone = "udp6", r.iface.Name
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: local, Zone: zone})
+	if err != nil {
+		return nil, err
+	}
+
+	flow := &replyFlow{
+		querier: querier,
+		conn:    conn,
+		expires: time.Now().Add(r.timeout),
+	}
+	r.flows[key] = flow
+	r.ports[conn.LocalAddr().(*net.UDPAddr).Port] = flow
+	r.wg.Add(1)
+	go r.serviceFlow(flow)
+	return flow, nil
+}
+
+func (r *ReplyRelay) serviceFlow(flow *replyFlow) {
+	defer r.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		r.mu.Lock()
+		expires := flow.expires
+		r.mu.Unlock()
+		if time.Now().After(expires) {
+			break
+		}
+
+		_ = flow.conn.SetReadDeadline(expires)
+		n, responder, err := flow.conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				break // Closed by Close
+			}
+			r.log.Error("Failed reading reply", zap.Stringer("querier", flow.querier), zap.Error(err))
+			break
+		}
+
+		frame, err := r.buildReplyFrame(responder, flow.querier, buf[:n])
+		if err != nil {
+			r.log.Error("Failed building reply frame", zap.Error(err))
+			continue
+		}
+		r.log.Debug("Relaying reply",
+			zap.Stringer("responder", responder),
+			zap.Stringer("querier", flow.querier))
+		r.Replies <- frame
+	}
+
+	r.mu.Lock()
+	delete(r.flows, flow.querier.String())
+	delete(r.ports, flow.conn.LocalAddr().(*net.UDPAddr).Port)
+	r.mu.Unlock()
+	_ = flow.conn.Close()
+}
+
+func (r *ReplyRelay) buildReplyFrame(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	// Interfaces such as loopback or tunnels have no hardware address, in
+	// which case the frame is emitted with a zeroed one.
+	srcMAC := r.iface.HardwareAddr
+	if len(srcMAC) != 6 {
+		srcMAC = make(net.HardwareAddr, 6)
+	}
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: make(net.HardwareAddr, 6)}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port), DstPort: layers.UDPPort(dst.Port)}
+
+	var netLayer gopacket.NetworkLayer
+	if src.IP.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		netLayer = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    src.IP.To4(),
+			DstIP:    dst.IP.To4(),
+		}
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		netLayer = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      src.IP,
+			DstIP:      dst.IP,
+		}
+	}
+	if err := udp.SetNetworkLayerForChecksum(netLayer); err != nil {
+		return nil, err
+	}
+
+	options := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, options,
+		eth, netLayer.(gopacket.SerializableLayer), udp, gopacket.Payload(payload))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
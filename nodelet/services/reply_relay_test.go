@@ -0,0 +1,211 @@
+package services
+
+import (
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/udpfw/common"
+	"net"
+	"testing"
+	"time"
+)
+
+func makeMDNSQuery(t *testing.T, srcPort layers.UDPPort, class layers.DNSClass, response bool) *layers.UDP {
+	dns := &layers.DNS{
+		QR: response,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("_http._tcp.local"), Type: layers.DNSTypePTR, Class: class},
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}))
+	return &layers.UDP{
+		BaseLayer: layers.BaseLayer{Payload: buf.Bytes()},
+		SrcPort:   srcPort,
+		DstPort:   5353,
+	}
+}
+
+func TestIsUnicastQuery(t *testing.T) {
+	assert.False(t, isUnicastQuery(makeMDNSQuery(t, 5353, layers.DNSClassIN, false)))
+	assert.True(t, isUnicastQuery(makeMDNSQuery(t, 5353, layers.DNSClassIN|0x8000, false)))
+	assert.True(t, isUnicastQuery(makeMDNSQuery(t, 40000, layers.DNSClassIN, false)))
+	assert.False(t, isUnicastQuery(makeMDNSQuery(t, 40000, layers.DNSClassIN, true)))
+
+	search := &layers.UDP{
+		BaseLayer: layers.BaseLayer{Payload: []byte("M-SEARCH * HTTP/1.1\r\n\r\n")},
+		SrcPort:   40000,
+		DstPort:   1900,
+	}
+	assert.True(t, isUnicastQuery(search))
+
+	notify := &layers.UDP{
+		BaseLayer: layers.BaseLayer{Payload: []byte("NOTIFY * HTTP/1.1\r\n\r\n")},
+		SrcPort:   1900,
+		DstPort:   1900,
+	}
+	assert.False(t, isUnicastQuery(notify))
+}
+
+func makeQueryPacket(t *testing.T, src string, srcPort layers.UDPPort) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x01, 0, 0x5e, 0, 0, 0xfb},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      255,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP("224.0.0.251"),
+	}
+	udp := makeMDNSQuery(t, srcPort, layers.DNSClassIN, false)
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf,
+		gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		eth, ip, udp, gopacket.Payload(udp.Payload)))
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func newLoopbackReplyRelay(t *testing.T, timeout time.Duration) *ReplyRelay {
+	r, err := NewReplyRelay("lo", timeout)
+	if err != nil {
+		t.Skipf("loopback interface unavailable: %s", err)
+	}
+	require.NotNil(t, r.addr4)
+	return r
+}
+
+func TestReplyRelay_ObserveCaptured(t *testing.T) {
+	r := newLoopbackReplyRelay(t, time.Minute)
+	querier := common.FrameInfo{Dst: net.ParseIP("192.168.0.10"), DstPort: 40000}
+
+	assert.False(t, r.ObserveCaptured(makeQueryPacket(t, "192.168.0.10", 5353)), "multicast query")
+	assert.False(t, r.Accepts(common.FrameInfo{Dst: net.ParseIP("192.168.0.10"), DstPort: 5353}))
+
+	assert.False(t, r.ObserveCaptured(makeQueryPacket(t, "192.168.0.10", 40000)))
+	assert.True(t, r.Accepts(querier))
+	assert.False(t, r.Accepts(common.FrameInfo{Dst: net.ParseIP("192.168.0.10"), DstPort: 40001}))
+	assert.False(t, r.Accepts(common.FrameInfo{Dst: net.ParseIP("192.168.0.11"), DstPort: 40000}))
+
+	r.mu.Lock()
+	for k := range r.queries {
+		r.queries[k] = time.Now().Add(-time.Second)
+	}
+	r.mu.Unlock()
+	assert.False(t, r.Accepts(querier), "expired querier")
+}
+
+func TestReplyRelay_BoundsQueriers(t *testing.T) {
+	r := newLoopbackReplyRelay(t, time.Minute)
+	now := time.Now()
+	for i := 0; i < maxReplyQueriers; i++ {
+		r.recordQuerier(&net.UDPAddr{IP: net.ParseIP("192.168.0.10"), Port: 1024 + i}, now)
+	}
+	late := &net.UDPAddr{IP: net.ParseIP("192.168.0.11"), Port: 40000}
+	r.recordQuerier(late, now)
+	assert.Len(t, r.queries, maxReplyQueriers)
+	assert.False(t, r.Accepts(common.FrameInfo{Dst: late.IP, DstPort: uint16(late.Port)}))
+
+	// Expired queriers are pruned upon insertion once per timeout.
+	later := now.Add(2 * time.Minute)
+	r.recordQuerier(late, later)
+	assert.Len(t, r.queries, 1)
+	assert.True(t, r.Accepts(common.FrameInfo{Dst: late.IP, DstPort: uint16(late.Port)}))
+}
+
+func TestReplyRelay_Rewrite(t *testing.T) {
+	r := newLoopbackReplyRelay(t, 500*time.Millisecond)
+
+	pkt := makeQueryPacket(t, "192.168.0.10", 40000)
+	ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	r.Rewrite(pkt, udp)
+	assert.True(t, ip.SrcIP.Equal(r.addr4))
+	assert.NotEqual(t, layers.UDPPort(40000), udp.SrcPort)
+
+	// Further queries from the same querier reuse its flow.
+	again := makeQueryPacket(t, "192.168.0.10", 40000)
+	againUDP := again.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	r.Rewrite(again, againUDP)
+	assert.Equal(t, udp.SrcPort, againUDP.SrcPort)
+
+	// Injected queries captured back from the interface are not forwarded.
+	assert.True(t, r.ObserveCaptured(makeQueryPacket(t, r.addr4.String(), udp.SrcPort)))
+
+	// Datagrams other than queries are left untouched.
+	other := gopacket.NewPacket(makeUDPFrame(t, "224.0.0.251"), layers.LayerTypeEthernet, gopacket.Default)
+	otherUDP := other.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	r.Rewrite(other, otherUDP)
+	assert.Equal(t, "192.168.0.10", other.Layer(layers.LayerTypeIPv4).(*layers.IPv4).SrcIP.String())
+	assert.Equal(t, layers.UDPPort(5353), otherUDP.SrcPort)
+
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: r.addr4})
+	require.NoError(t, err)
+	defer func() { _ = responder.Close() }()
+	_, err = responder.WriteToUDP([]byte("reply"), &net.UDPAddr{IP: r.addr4, Port: int(udp.SrcPort)})
+	require.NoError(t, err)
+
+	select {
+	case frame := <-r.Replies:
+		reply := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		replyIP, ok := reply.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		require.True(t, ok)
+		replyUDP, ok := reply.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		require.True(t, ok)
+		assert.True(t, replyIP.SrcIP.Equal(r.addr4))
+		assert.Equal(t, layers.UDPPort(responder.LocalAddr().(*net.UDPAddr).Port), replyUDP.SrcPort)
+		assert.Equal(t, "192.168.0.10", replyIP.DstIP.String())
+		assert.Equal(t, layers.UDPPort(40000), replyUDP.DstPort)
+		assert.Equal(t, []byte("reply"), replyUDP.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("reply was not relayed")
+	}
+
+	// Flows are discarded once they expire.
+	require.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.flows) == 0 && len(r.ports) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.False(t, r.ObserveCaptured(makeQueryPacket(t, r.addr4.String(), udp.SrcPort)))
+}
+
+func TestReplyRelay_Close(t *testing.T) {
+	r := newLoopbackReplyRelay(t, time.Minute)
+
+	pkt := makeQueryPacket(t, "192.168.0.10", 40000)
+	r.Rewrite(pkt, pkt.Layer(layers.LayerTypeUDP).(*layers.UDP))
+	require.Len(t, r.flows, 1)
+	var conn *net.UDPConn
+	for _, flow := range r.flows {
+		conn = flow.conn
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flows did not stop")
+	}
+	assert.Empty(t, r.flows)
+	assert.Empty(t, r.ports)
+	_, ok := <-r.Replies
+	assert.False(t, ok, "replies are closed")
+	_, err := conn.WriteToUDP([]byte("late"), conn.LocalAddr().(*net.UDPAddr))
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	// Queries injected once closed are left untouched.
+	late := makeQueryPacket(t, "192.168.0.10", 40001)
+	lateUDP := late.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	r.Rewrite(late, lateUDP)
+	assert.Equal(t, layers.UDPPort(40001), lateUDP.SrcPort)
+	r.Close()
+}
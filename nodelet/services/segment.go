@@ -0,0 +1,33 @@
+package services
+
+import (
+	"fmt"
+	"net"
+)
+
+// SegmentSubnet is the segment identifier requesting the segment to be
+// derived from the IPv4 network of the capture interface.
+const SegmentSubnet = "subnet"
+
+// InterfaceSegment returns the IPv4 network the provided interface is
+// attached to, in CIDR notation, so nodelets capturing on the same subnet
+// report the same segment.
+func InterfaceSegment(iface string) (string, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		network := net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+		return network.String(), nil
+	}
+	return "", fmt.Errorf("interface %s has no IPv4 address", iface)
+}
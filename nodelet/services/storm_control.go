@@ -0,0 +1,245 @@
+package services
+
+import (
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// stormIdleTimeout determines after how long per-source and per-group
+	// buckets are released once they stop receiving packets.
+	stormIdleTimeout = time.Minute
+
+	// stormLogInterval bounds how often drops are logged for a single
+	// source, group, or the global limit.
+	stormLogInterval = 10 * time.Second
+
+	// stormMaxBuckets bounds the amount of tracked sources and groups, so
+	// floods of spoofed addresses cannot grow them until the next sweep.
+	// Packets from further sources or to further groups share a single
+	// overflow bucket.
+	stormMaxBuckets = 4096
+)
+
+// tokenBucket implements a token bucket refilled at rate tokens per second,
+// holding at most burst tokens.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	dropped    uint64
+	lastLogged time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// bucketMap holds token buckets indexed by address, tracking at most
+// stormMaxBuckets of them.
+type bucketMap struct {
+	buckets  map[string]*tokenBucket
+	overflow *tokenBucket
+}
+
+// get returns the bucket for the provided address, creating it if needed.
+// The returned boolean is false in case the address is not tracked and the
+// shared overflow bucket was returned instead.
+func (m *bucketMap) get(ip net.IP, rate int, now time.Time) (*tokenBucket, bool) {
+	key := string(ip.To16())
+	if b, ok := m.buckets[key]; ok {
+		return b, true
+	}
+	if len(m.buckets) < stormMaxBuckets {
+		b := newTokenBucket(rate, now)
+		m.buckets[key] = b
+		return b, true
+	}
+	if m.overflow == nil {
+		m.overflow = newTokenBucket(rate, now)
+	}
+	return m.overflow, false
+}
+
+func (m *bucketMap) sweep(now time.Time) {
+	for k, b := range m.buckets {
+		if now.Sub(b.last) > stormIdleTimeout {
+			delete(m.buckets, k)
+		}
+	}
+	if m.overflow != nil && now.Sub(m.overflow.last) > stormIdleTimeout {
+		m.overflow = nil
+	}
+}
+
+// StormControlOptions configures limits applied by StormControl, in packets
+// per second. Each limit allows bursts of up to one second worth of packets,
+// and is disabled when zero.
+type StormControlOptions struct {
+	GlobalRate int
+	SourceRate int
+	GroupRate  int
+}
+
+// StormStats contains counters describing packets dropped by StormControl.
+type StormStats struct {
+	Allowed        uint64 `json:"allowed"`
+	DroppedGlobal  uint64 `json:"dropped_global"`
+	DroppedSource  uint64 `json:"dropped_source"`
+	DroppedGroup   uint64 `json:"dropped_group"`
+	OverflowSource uint64 `json:"overflow_source"`
+	OverflowGroup  uint64 `json:"overflow_group"`
+	TrackedSources int    `json:"tracked_sources"`
+	TrackedGroups  int    `json:"tracked_groups"`
+}
+
+// NewStormControl returns a StormControl enforcing the provided limits.
+func NewStormControl(opts StormControlOptions) *StormControl {
+	s := &StormControl{
+		log:     zap.L().With(zap.String("facility", "storm_control")),
+		opts:    opts,
+		sources: bucketMap{buckets: make(map[string]*tokenBucket)},
+		groups:  bucketMap{buckets: make(map[string]*tokenBucket)},
+		now:     time.Now,
+	}
+	if opts.GlobalRate > 0 {
+		s.global = newTokenBucket(opts.GlobalRate, s.now())
+	}
+	return s
+}
+
+// StormControl limits the rate of captured packets forwarded to the Dispatch
+// service, globally, per source address, and per destination group, so a
+// single misbehaving device cannot flood remote segments.
+type StormControl struct {
+	log       *zap.Logger
+	mu        sync.Mutex
+	opts      StormControlOptions
+	global    *tokenBucket
+	sources   bucketMap
+	groups    bucketMap
+	lastSweep time.Time
+	now       func() time.Time
+
+	allowed       atomic.Uint64
+	droppedGlobal atomic.Uint64
+	droppedSource atomic.Uint64
+	droppedGroup  atomic.Uint64
+
+	// overflowSource and overflowGroup count packets accounted against the
+	// shared overflow buckets, as their source or group was not tracked.
+	overflowSource atomic.Uint64
+	overflowGroup  atomic.Uint64
+}
+
+// Enabled indicates whether any limit is configured.
+func (s *StormControl) Enabled() bool {
+	return s.opts.GlobalRate > 0 || s.opts.SourceRate > 0 || s.opts.GroupRate > 0
+}
+
+// Stats returns a snapshot of the storm control counters.
+func (s *StormControl) Stats() StormStats {
+	s.mu.Lock()
+	sources, groups := len(s.sources.buckets), len(s.groups.buckets)
+	s.mu.Unlock()
+	return StormStats{
+		Allowed:        s.allowed.Load(),
+		DroppedGlobal:  s.droppedGlobal.Load(),
+		DroppedSource:  s.droppedSource.Load(),
+		DroppedGroup:   s.droppedGroup.Load(),
+		OverflowSource: s.overflowSource.Load(),
+		OverflowGroup:  s.overflowGroup.Load(),
+		TrackedSources: sources,
+		TrackedGroups:  groups,
+	}
+}
+
+// Allow determines whether a packet from src destined to group may be
+// forwarded. Source limits are checked first, so a flooding source does not
+// consume tokens of its destination group or of the global limit.
+func (s *StormControl) Allow(src, group net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= stormIdleTimeout {
+		s.sweep(now)
+		s.lastSweep = now
+	}
+
+	if s.opts.SourceRate > 0 {
+		b := s.bucketFor(&s.sources, &s.overflowSource, src, s.opts.SourceRate, now)
+		if !b.take(now) {
+			s.droppedSource.Add(1)
+			s.logDrop(b, now, "Dropping packets from source exceeding rate limit", src, group)
+			return false
+		}
+	}
+
+	if s.opts.GroupRate > 0 {
+		b := s.bucketFor(&s.groups, &s.overflowGroup, group, s.opts.GroupRate, now)
+		if !b.take(now) {
+			s.droppedGroup.Add(1)
+			s.logDrop(b, now, "Dropping packets to group exceeding rate limit", src, group)
+			return false
+		}
+	}
+
+	if s.global != nil && !s.global.take(now) {
+		s.droppedGlobal.Add(1)
+		s.logDrop(s.global, now, "Dropping packets exceeding global rate limit", src, group)
+		return false
+	}
+
+	s.allowed.Add(1)
+	return true
+}
+
+func (s *StormControl) bucketFor(m *bucketMap, overflow *atomic.Uint64, ip net.IP, rate int, now time.Time) *tokenBucket {
+	b, tracked := m.get(ip, rate, now)
+	if !tracked {
+		overflow.Add(1)
+	}
+	return b
+}
+
+func (s *StormControl) logDrop(b *tokenBucket, now time.Time, msg string, src, group net.IP) {
+	b.dropped++
+	if now.Sub(b.lastLogged) < stormLogInterval {
+		return
+	}
+	s.log.Warn(msg,
+		zap.Stringer("source", src),
+		zap.Stringer("group", group),
+		zap.Uint64("dropped", b.dropped))
+	b.dropped = 0
+	b.lastLogged = now
+}
+
+func (s *StormControl) sweep(now time.Time) {
+	s.sources.sweep(now)
+	s.groups.sweep(now)
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestStormControl(opts StormControlOptions) (*StormControl, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	s := NewStormControl(opts)
+	s.now = clock.Now
+	if s.global != nil {
+		s.global.last = clock.Now()
+	}
+	return s, clock
+}
+
+func TestStormControl_SourceLimit(t *testing.T) {
+	s, clock := newTestStormControl(StormControlOptions{SourceRate: 10})
+	flooder := net.ParseIP("192.168.0.10")
+	other := net.ParseIP("192.168.0.11")
+	group := net.ParseIP("239.255.255.250")
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, s.Allow(flooder, group))
+	}
+	assert.False(t, s.Allow(flooder, group))
+	assert.True(t, s.Allow(other, group))
+
+	clock.Advance(500 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		assert.True(t, s.Allow(flooder, group))
+	}
+	assert.False(t, s.Allow(flooder, group))
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(16), stats.Allowed)
+	assert.Equal(t, uint64(2), stats.DroppedSource)
+	assert.Equal(t, 2, stats.TrackedSources)
+}
+
+func TestStormControl_GroupAndGlobalLimits(t *testing.T) {
+	s, _ := newTestStormControl(StormControlOptions{GroupRate: 2, GlobalRate: 3})
+	src := net.ParseIP("192.168.0.10")
+	groupA := net.ParseIP("239.0.0.1")
+	groupB := net.ParseIP("239.0.0.2")
+
+	assert.True(t, s.Allow(src, groupA))
+	assert.True(t, s.Allow(src, groupA))
+	assert.False(t, s.Allow(src, groupA))
+	assert.True(t, s.Allow(src, groupB))
+	assert.False(t, s.Allow(src, groupB))
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(1), stats.DroppedGroup)
+	assert.Equal(t, uint64(1), stats.DroppedGlobal)
+}
+
+func TestStormControl_SweepsIdleBuckets(t *testing.T) {
+	s, clock := newTestStormControl(StormControlOptions{SourceRate: 10})
+	group := net.ParseIP("239.0.0.1")
+	s.Allow(net.ParseIP("192.168.0.10"), group)
+	clock.Advance(2 * stormIdleTimeout)
+	s.Allow(net.ParseIP("192.168.0.11"), group)
+
+	assert.Equal(t, 1, s.Stats().TrackedSources)
+}
+
+func TestStormControl_BoundsTrackedSources(t *testing.T) {
+	s, clock := newTestStormControl(StormControlOptions{SourceRate: 2})
+	group := net.ParseIP("239.0.0.1")
+	source := func(i int) net.IP {
+		return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	}
+	for i := 0; i < stormMaxBuckets; i++ {
+		assert.True(t, s.Allow(source(i), group))
+	}
+
+	// Further sources share a single bucket.
+	assert.True(t, s.Allow(source(stormMaxBuckets), group))
+	assert.True(t, s.Allow(source(stormMaxBuckets+1), group))
+	assert.False(t, s.Allow(source(stormMaxBuckets+2), group))
+	assert.True(t, s.Allow(source(0), group), "tracked sources keep their bucket")
+
+	stats := s.Stats()
+	assert.Equal(t, stormMaxBuckets, stats.TrackedSources)
+	assert.Equal(t, uint64(3), stats.OverflowSource)
+	assert.Equal(t, uint64(1), stats.DroppedSource)
+
+	clock.Advance(2 * stormIdleTimeout)
+	assert.True(t, s.Allow(source(stormMaxBuckets+2), group))
+	stats = s.Stats()
+	assert.Equal(t, 1, stats.TrackedSources)
+	assert.Equal(t, uint64(3), stats.OverflowSource)
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type TTLMode int
+
+const (
+	TTLFixed TTLMode = iota
+	TTLPreserve
+	TTLDecrement
+)
+
+var ttlModeToString = map[TTLMode]string{
+	TTLFixed:     "fixed",
+	TTLPreserve:  "preserve",
+	TTLDecrement: "decrement",
+}
+
+func (m TTLMode) String() string { return ttlModeToString[m] }
+
+// TTLPolicy determines how the IPv4 TTL or IPv6 HopLimit of a packet is
+// rewritten before it is injected.
+type TTLPolicy struct {
+	Mode  TTLMode
+	Value uint8
+}
+
+// Packets not matching any rule keep their original TTL or HopLimit, as
+// protocols such as SSDP rely on small values to stay within their scope.
+var (
+	defaultIPv4TTLPolicy      = TTLPolicy{Mode: TTLPreserve}
+	defaultIPv6HopLimitPolicy = TTLPolicy{Mode: TTLPreserve}
+)
+
+// Apply returns the new TTL for a packet currently carrying the provided
+// value. The returned boolean is false when the packet must be dropped, which
+// happens when decrementing would cause it to expire.
+func (p TTLPolicy) Apply(current uint8) (uint8, bool) {
+	switch p.Mode {
+	case TTLPreserve:
+		return current, true
+	case TTLDecrement:
+		if current <= 1 {
+			return 0, false
+		}
+		return current - 1, true
+	default:
+		return p.Value, true
+	}
+}
+
+func (p TTLPolicy) String() string {
+	if p.Mode == TTLFixed {
+		return fmt.Sprintf("%s:%d", p.Mode, p.Value)
+	}
+	return p.Mode.String()
+}
+
+// TTLRule associates a TTLPolicy to packets destined to a given group and/or
+// port. A nil Group matches any group, and a zero Port matches any port.
+type TTLRule struct {
+	Group  net.IP
+	Port   uint16
+	Policy TTLPolicy
+}
+
+func (r TTLRule) Matches(dst net.IP, port uint16) bool {
+	if r.Group != nil && !r.Group.Equal(dst) {
+		return false
+	}
+	return r.Port == 0 || r.Port == port
+}
+
+type TTLRules []TTLRule
+
+// PolicyFor returns the policy of the first rule matching the provided
+// destination, falling back to the default policy for the packet's family.
+func (r TTLRules) PolicyFor(dst net.IP, port uint16) TTLPolicy {
+	for _, rule := range r {
+		if rule.Matches(dst, port) {
+			return rule.Policy
+		}
+	}
+	if dst.To4() != nil {
+		return defaultIPv4TTLPolicy
+	}
+	return defaultIPv6HopLimitPolicy
+}
+
+// ParseTTLRules parses a list of rules in the format
+// [group][:port]=preserve|decrement|fixed:N. Rules lacking a match (e.g.
+// "preserve") apply to all packets. IPv6 groups must be enclosed in brackets
+// when a port is also provided (e.g. "[ff02::fb]:5353=preserve").
+func ParseTTLRules(values []string) (TTLRules, error) {
+	rules := make(TTLRules, 0, len(values))
+	for _, v := range values {
+		rule, err := parseTTLRule(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL policy %q: %w", v, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseTTLRule(value string) (TTLRule, error) {
+	var rule TTLRule
+	match, policy := "", value
+	if idx := strings.LastIndex(value, "="); idx != -1 {
+		match, policy = value[:idx], value[idx+1:]
+	}
+
+	p, err := parseTTLPolicy(policy)
+	if err != nil {
+		return rule, err
+	}
+	rule.Policy = p
+
+	if match == "" {
+		return rule, nil
+	}
+
+	if group := net.ParseIP(match); group != nil {
+		rule.Group = group
+		return rule, nil
+	}
+
+	host, rawPort, err := net.SplitHostPort(match)
+	if err != nil {
+		return rule, err
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil || port == 0 {
+		return rule, fmt.Errorf("invalid port %q", rawPort)
+	}
+	rule.Port = uint16(port)
+
+	if host != "" {
+		if rule.Group = net.ParseIP(host); rule.Group == nil {
+			return rule, fmt.Errorf("invalid group address %q", host)
+		}
+	}
+
+	return rule, nil
+}
+
+func parseTTLPolicy(value string) (TTLPolicy, error) {
+	mode, rawValue, hasValue := strings.Cut(value, ":")
+	switch mode {
+	case "preserve":
+		return TTLPolicy{Mode: TTLPreserve}, nil
+	case "decrement":
+		return TTLPolicy{Mode: TTLDecrement}, nil
+	case "fixed":
+		if !hasValue {
+			return TTLPolicy{}, fmt.Errorf("fixed policy requires a value (e.g. fixed:255)")
+		}
+		v, err := strconv.ParseUint(rawValue, 10, 8)
+		if err != nil || v == 0 {
+			return TTLPolicy{}, fmt.Errorf("invalid fixed TTL %q", rawValue)
+		}
+		return TTLPolicy{Mode: TTLFixed, Value: uint8(v)}, nil
+	default:
+		return TTLPolicy{}, fmt.Errorf("unknown policy %q", mode)
+	}
+}
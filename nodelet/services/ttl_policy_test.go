@@ -0,0 +1,68 @@
+package services
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestParseTTLRules(t *testing.T) {
+	rules, err := ParseTTLRules([]string{
+		"224.0.0.251:5353=fixed:255",
+		"[ff02::fb]:5353=preserve",
+		"239.255.255.250=decrement",
+		":1900=preserve",
+	})
+	require.NoError(t, err)
+	require.Len(t, rules, 4)
+
+	assert.True(t, rules[0].Group.Equal(net.ParseIP("224.0.0.251")))
+	assert.Equal(t, uint16(5353), rules[0].Port)
+	assert.Equal(t, TTLPolicy{Mode: TTLFixed, Value: 255}, rules[0].Policy)
+
+	assert.True(t, rules[1].Group.Equal(net.ParseIP("ff02::fb")))
+	assert.Equal(t, uint16(5353), rules[1].Port)
+	assert.Equal(t, TTLPreserve, rules[1].Policy.Mode)
+
+	assert.Equal(t, uint16(0), rules[2].Port)
+	assert.Equal(t, TTLDecrement, rules[2].Policy.Mode)
+
+	assert.Nil(t, rules[3].Group)
+	assert.Equal(t, uint16(1900), rules[3].Port)
+
+	t.Run("invalid policies", func(t *testing.T) {
+		for _, v := range []string{"fixed", "fixed:0", "fixed:256", "foo", "bar=preserve", ":0=preserve"} {
+			_, err := ParseTTLRules([]string{v})
+			assert.Error(t, err, v)
+		}
+	})
+}
+
+func TestTTLRules_PolicyFor(t *testing.T) {
+	rules, err := ParseTTLRules([]string{"224.0.0.251=preserve", "decrement"})
+	require.NoError(t, err)
+
+	assert.Equal(t, TTLPreserve, rules.PolicyFor(net.ParseIP("224.0.0.251"), 5353).Mode)
+	assert.Equal(t, TTLDecrement, rules.PolicyFor(net.ParseIP("239.255.255.250"), 1900).Mode)
+
+	assert.Equal(t, defaultIPv4TTLPolicy, TTLRules{}.PolicyFor(net.ParseIP("224.0.0.251"), 5353))
+	assert.Equal(t, defaultIPv6HopLimitPolicy, TTLRules{}.PolicyFor(net.ParseIP("ff02::fb"), 5353))
+}
+
+func TestTTLPolicy_Apply(t *testing.T) {
+	ttl, ok := TTLPolicy{Mode: TTLPreserve}.Apply(12)
+	assert.True(t, ok)
+	assert.Equal(t, uint8(12), ttl)
+
+	ttl, ok = TTLPolicy{Mode: TTLDecrement}.Apply(12)
+	assert.True(t, ok)
+	assert.Equal(t, uint8(11), ttl)
+
+	_, ok = TTLPolicy{Mode: TTLDecrement}.Apply(1)
+	assert.False(t, ok)
+
+	ttl, ok = TTLPolicy{Mode: TTLFixed, Value: 255}.Apply(1)
+	assert.True(t, ok)
+	assert.Equal(t, uint8(255), ttl)
+}
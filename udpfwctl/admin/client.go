@@ -0,0 +1,212 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ClientInfo describes a client connected to a dispatch instance.
+type ClientInfo struct {
+	ID             string            `json:"id"`
+	Address        string            `json:"address"`
+	Namespaces     []string          `json:"namespaces,omitempty"`
+	Node           string            `json:"node,omitempty"`
+	Interface      string            `json:"iface,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Direction      string            `json:"direction"`
+	Segment        string            `json:"segment,omitempty"`
+	Role           string            `json:"role,omitempty"`
+	ConnectedSince time.Time         `json:"connected_since"`
+	QueueDepth     int               `json:"queue_depth"`
+	RxMessages     uint64            `json:"rx_messages"`
+	RxBytes        uint64            `json:"rx_bytes"`
+	TxMessages     uint64            `json:"tx_messages"`
+	TxBytes        uint64            `json:"tx_bytes"`
+	RTTMicros      int64             `json:"rtt_us"`
+}
+
+// NamespaceInfo describes a namespace known to a dispatch instance.
+type NamespaceInfo struct {
+	Name       string   `json:"name"`
+	Clients    []string `json:"clients"`
+	Paused     bool     `json:"paused"`
+	RxMessages uint64   `json:"rx_messages"`
+	RxBytes    uint64   `json:"rx_bytes"`
+	TxMessages uint64   `json:"tx_messages"`
+	TxBytes    uint64   `json:"tx_bytes"`
+}
+
+// ClusterClientInfo describes a client connected to any dispatch instance of
+// the cluster.
+type ClusterClientInfo struct {
+	Instance string `json:"instance"`
+	Host     string `json:"host"`
+	ClientInfo
+}
+
+// ClusterNamespaceInfo describes a namespace joined by clients across the
+// cluster.
+type ClusterNamespaceInfo struct {
+	Name         string   `json:"name"`
+	Clients      []string `json:"clients"`
+	Instances    []string `json:"instances"`
+	SingleMember bool     `json:"single_member"`
+}
+
+// Route bridges namespaces on a dispatch instance.
+type Route struct {
+	From   string   `json:"from"`
+	To     []string `json:"to"`
+	Filter struct {
+		Ports  []uint16 `json:"ports,omitempty"`
+		Groups []string `json:"groups,omitempty"`
+	} `json:"filter"`
+}
+
+// Frame is a frame forwarded on a namespace, as streamed by the tail
+// endpoint.
+type Frame struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Client    string    `json:"client"`
+	Reply     bool      `json:"reply,omitempty"`
+	Frame     []byte    `json:"frame"`
+}
+
+// NewClient returns a Client for the admin API exposed at the provided
+// address, either as a bare host:port or as an URL. Requests carry token as a
+// bearer token, unless it is empty.
+func NewClient(address, token string) *Client {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return &Client{
+		base:  strings.TrimRight(address, "/"),
+		token: token,
+		http:  &http.Client{},
+	}
+}
+
+// Client interacts with the admin API of a dispatch instance.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func (c *Client) Clients(ctx context.Context) ([]ClientInfo, error) {
+	var clients []ClientInfo
+	return clients, c.do(ctx, http.MethodGet, "/clients", nil, &clients)
+}
+
+func (c *Client) Namespaces(ctx context.Context) ([]NamespaceInfo, error) {
+	var namespaces []NamespaceInfo
+	return namespaces, c.do(ctx, http.MethodGet, "/namespaces", nil, &namespaces)
+}
+
+// ClusterClients returns clients connected to any dispatch instance of the
+// cluster, as known to the queried instance.
+func (c *Client) ClusterClients(ctx context.Context) ([]ClusterClientInfo, error) {
+	var clients []ClusterClientInfo
+	return clients, c.do(ctx, http.MethodGet, "/cluster/clients", nil, &clients)
+}
+
+// ClusterNamespaces returns namespaces joined by clients across the cluster.
+func (c *Client) ClusterNamespaces(ctx context.Context) ([]ClusterNamespaceInfo, error) {
+	var namespaces []ClusterNamespaceInfo
+	return namespaces, c.do(ctx, http.MethodGet, "/cluster/namespaces", nil, &namespaces)
+}
+
+// Routes returns the routing table applied by the dispatch.
+func (c *Client) Routes(ctx context.Context) ([]Route, error) {
+	var table struct {
+		Routes []Route `json:"routes"`
+	}
+	return table.Routes, c.do(ctx, http.MethodGet, "/routes", nil, &table)
+}
+
+// Disconnect asks the dispatch to disconnect a client.
+func (c *Client) Disconnect(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/clients/disconnect", url.Values{"id": {id}}, nil)
+}
+
+// Drain asks the dispatch to disconnect all clients and shut down.
+func (c *Client) Drain(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/drain", nil, nil)
+}
+
+// Tail streams frames forwarded on a namespace to fn until ctx is cancelled,
+// the stream ends, or fn returns an error.
+func (c *Client) Tail(ctx context.Context, ns string, fn func(Frame) error) error {
+	res, err := c.request(ctx, http.MethodGet, "/namespaces/tail", url.Values{"namespace": {ns}})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var f Frame
+		if err = json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			return fmt.Errorf("malformed frame: %w", err)
+		}
+		if err = fn(f); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, out any) error {
+	res, err := c.request(ctx, method, path, query)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *Client) request(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer func() { _ = res.Body.Close() }()
+		var body struct {
+			Error string `json:"error"`
+		}
+		data, _ := io.ReadAll(res.Body)
+		if json.Unmarshal(data, &body) == nil && body.Error != "" {
+			return nil, fmt.Errorf("%s %s: %s", method, path, body.Error)
+		}
+		return nil, fmt.Errorf("%s %s: unexpected status %s", method, path, res.Status)
+	}
+	return res, nil
+}
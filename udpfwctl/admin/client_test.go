@@ -0,0 +1,196 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Responses below were produced by the dispatch admin API, and must be kept
+// in sync with it.
+const (
+	clientsResponse = `[{"id":"Ckz5eYhwTkPiWAbBmr3dFA","address":"10.0.0.5:41234","namespaces":["site-a","site-b"],"node":"edge-1","iface":"eth0","version":"1.4.0","labels":{"rack":"r1"},"direction":"both","segment":"lan","role":"active","connected_since":"2024-03-01T12:00:00Z","queue_depth":3,"rx_messages":10,"rx_bytes":1200,"tx_messages":20,"tx_bytes":2400,"rtt_us":350}]
+`
+	tailResponse = `{"time":"2024-03-01T12:00:00Z","namespace":"site-a","client":"Ckz5eYhwTkPiWAbBmr3dFA","frame":"ZnJhbWUtMQ=="}
+{"time":"2024-03-01T12:00:01Z","namespace":"site-a","client":"Ckz5eYhwTkPiWAbBmr3dFA","reply":true,"frame":"ZnJhbWUtMg=="}
+`
+)
+
+func serveAdmin(t *testing.T, handler http.HandlerFunc) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL, "secret")
+}
+
+func TestClient_Clients(t *testing.T) {
+	c := serveAdmin(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/clients", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(clientsResponse))
+	})
+
+	clients, err := c.Clients(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ClientInfo{{
+		ID:             "Ckz5eYhwTkPiWAbBmr3dFA",
+		Address:        "10.0.0.5:41234",
+		Namespaces:     []string{"site-a", "site-b"},
+		Node:           "edge-1",
+		Interface:      "eth0",
+		Version:        "1.4.0",
+		Labels:         map[string]string{"rack": "r1"},
+		Direction:      "both",
+		Segment:        "lan",
+		Role:           "active",
+		ConnectedSince: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		QueueDepth:     3,
+		RxMessages:     10,
+		RxBytes:        1200,
+		TxMessages:     20,
+		TxBytes:        2400,
+		RTTMicros:      350,
+	}}, clients)
+
+	// Every field emitted by the dispatch must be known to ClientInfo.
+	dec := json.NewDecoder(strings.NewReader(clientsResponse))
+	dec.DisallowUnknownFields()
+	assert.NoError(t, dec.Decode(&[]ClientInfo{}))
+}
+
+func TestClient_Tail(t *testing.T) {
+	c := serveAdmin(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/namespaces/tail", r.URL.Path)
+		assert.Equal(t, "site-a", r.URL.Query().Get("namespace"))
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_, _ = w.Write([]byte(tailResponse))
+	})
+
+	var frames []Frame
+	err := c.Tail(context.Background(), "site-a", func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	})
+	require.NoError(t, err)
+	since := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, []Frame{
+		{Time: since, Namespace: "site-a", Client: "Ckz5eYhwTkPiWAbBmr3dFA", Frame: []byte("frame-1")},
+		{Time: since.Add(time.Second), Namespace: "site-a", Client: "Ckz5eYhwTkPiWAbBmr3dFA", Reply: true, Frame: []byte("frame-2")},
+	}, frames)
+
+	for _, line := range strings.Split(strings.TrimSpace(tailResponse), "\n") {
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.DisallowUnknownFields()
+		assert.NoError(t, dec.Decode(&Frame{}))
+	}
+
+	// Errors returned by the callback stop the stream.
+	stop := errors.New("stop")
+	calls := 0
+	err = c.Tail(context.Background(), "site-a", func(f Frame) error {
+		calls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+}
+
+func TestClient_TailCancelled(t *testing.T) {
+	c := serveAdmin(t, func(w http.ResponseWriter, r *http.Request) {
+		line, _, _ := strings.Cut(tailResponse, "\n")
+		_, _ = w.Write([]byte(line + "\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := c.Tail(ctx, "site-a", func(f Frame) error {
+		cancel()
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestClient_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		call   func(c *Client) error
+		want   string
+	}{
+		{
+			name:   "API error",
+			status: http.StatusNotFound,
+			body:   `{"error":"unknown client"}`,
+			call:   func(c *Client) error { return c.Disconnect(context.Background(), "missing") },
+			want:   "POST /clients/disconnect: unknown client",
+		},
+		{
+			name:   "unexpected status",
+			status: http.StatusBadGateway,
+			body:   "bad gateway",
+			call: func(c *Client) error {
+				_, err := c.Namespaces(context.Background())
+				return err
+			},
+			want: "GET /namespaces: unexpected status 502 Bad Gateway",
+		},
+		{
+			name:   "tail error",
+			status: http.StatusBadRequest,
+			body:   `{"error":"missing parameter namespace"}`,
+			call: func(c *Client) error {
+				return c.Tail(context.Background(), "", func(Frame) error { return nil })
+			},
+			want: "GET /namespaces/tail: missing parameter namespace",
+		},
+		{
+			name:   "malformed frame",
+			status: http.StatusOK,
+			body:   "{\"time\":\n",
+			call: func(c *Client) error {
+				return c.Tail(context.Background(), "site-a", func(Frame) error { return nil })
+			},
+			want: "malformed frame",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := serveAdmin(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+			err := tt.call(c)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	// Bare host:port addresses default to HTTP, and no token is sent when
+	// none is configured.
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://")+"/", "")
+	require.NoError(t, c.Drain(context.Background()))
+	assert.Equal(t, []string{""}, auth)
+	assert.False(t, strings.HasSuffix(c.base, "/"))
+}
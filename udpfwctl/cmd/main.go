@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/udpfw/udpfwctl/admin"
+	"github.com/udpfw/udpfwctl/decode"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	app := cli.App{
+		Name:            "udpfwctl",
+		Usage:           "Inspects and operates udpfw dispatch instances through their admin API",
+		HideHelpCommand: true,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "address",
+				Aliases: []string{"a"},
+				Usage:   "Address of the dispatch admin API, as set through its --admin-bind option",
+				EnvVars: []string{"UDPFWCTL_ADDRESS"},
+				Value:   "localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:    "token",
+				Usage:   "Bearer token of the dispatch admin API, as set through its --admin-token option",
+				EnvVars: []string{"UDPFWCTL_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "Output format, either table or json",
+				EnvVars: []string{"UDPFWCTL_OUTPUT"},
+				Value:   "table",
+			},
+		},
+		Before: func(ctx *cli.Context) error {
+			if o := ctx.String("output"); o != "table" && o != "json" {
+				return cli.Exit(fmt.Sprintf("invalid output format %q: expected table or json", o), 1)
+			}
+			return nil
+		},
+		Commands: []*cli.Command{
+			{
+				Name:   "clients",
+				Usage:  "Lists connected clients",
+				Action: listClients,
+			},
+			{
+				Name:   "namespaces",
+				Usage:  "Lists namespaces and their clients",
+				Action: listNamespaces,
+			},
+			{
+				Name:  "cluster",
+				Usage: "Inspects clients connected across all dispatch instances sharing the pubsub",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "clients",
+						Usage:  "Lists clients connected to any dispatch instance",
+						Action: listClusterClients,
+					},
+					{
+						Name:  "namespaces",
+						Usage: "Lists namespaces joined across the cluster",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "single-member",
+								Usage: "Only lists namespaces joined by a single client",
+							},
+						},
+						Action: listClusterNamespaces,
+					},
+				},
+			},
+			{
+				Name:   "traffic",
+				Usage:  "Shows traffic exchanged by clients of each namespace",
+				Action: showTraffic,
+			},
+			{
+				Name:   "routes",
+				Usage:  "Lists routing rules bridging namespaces",
+				Action: listRoutes,
+			},
+			{
+				Name:      "tail",
+				Usage:     "Streams frames forwarded on a namespace or wildcard pattern, such as site-a.>, decoding mDNS and SSDP payloads",
+				ArgsUsage: "NAMESPACE",
+				Action:    tail,
+			},
+			{
+				Name:      "kick",
+				Usage:     "Disconnects a client",
+				ArgsUsage: "CLIENT-ID",
+				Action:    kick,
+			},
+			{
+				Name:   "drain",
+				Usage:  "Disconnects all clients and shuts the dispatch instance down",
+				Action: drain,
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func clientFrom(ctx *cli.Context) *admin.Client {
+	return admin.NewClient(ctx.String("address"), ctx.String("token"))
+}
+
+func jsonOutput(ctx *cli.Context) bool { return ctx.String("output") == "json" }
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeTable(w io.Writer, header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, r := range rows {
+		_, _ = fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	return tw.Flush()
+}
+
+func requireArg(ctx *cli.Context, name string) (string, error) {
+	if ctx.NArg() != 1 {
+		return "", cli.Exit(fmt.Sprintf("expected a single %s argument", name), 1)
+	}
+	return ctx.Args().First(), nil
+}
+
+func listClients(ctx *cli.Context) error {
+	clients, err := clientFrom(ctx).Clients(ctx.Context)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ConnectedSince.Before(clients[j].ConnectedSince) })
+	if jsonOutput(ctx) {
+		return writeJSON(ctx.App.Writer, clients)
+	}
+
+	rows := make([][]string, 0, len(clients))
+	for _, c := range clients {
+		rows = append(rows, []string{
+			c.ID,
+			c.Address,
+			strings.Join(c.Namespaces, ","),
+			c.Node,
+			c.Interface,
+			c.Version,
+			c.Direction,
+			c.Segment,
+			c.Role,
+			time.Since(c.ConnectedSince).Round(time.Second).String(),
+			fmt.Sprint(c.QueueDepth),
+			fmt.Sprint(c.RxMessages),
+			fmt.Sprint(c.TxMessages),
+			(time.Duration(c.RTTMicros) * time.Microsecond).String(),
+		})
+	}
+	return writeTable(ctx.App.Writer,
+		[]string{"ID", "ADDRESS", "NAMESPACES", "NODE", "IFACE", "VERSION", "DIRECTION", "SEGMENT", "ROLE", "AGE", "QUEUE", "RX", "TX", "RTT"},
+		rows)
+}
+
+func listClusterClients(ctx *cli.Context) error {
+	clients, err := clientFrom(ctx).ClusterClients(ctx.Context)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ConnectedSince.Before(clients[j].ConnectedSince) })
+	if jsonOutput(ctx) {
+		return writeJSON(ctx.App.Writer, clients)
+	}
+
+	rows := make([][]string, 0, len(clients))
+	for _, c := range clients {
+		rows = append(rows, []string{
+			c.ID,
+			c.Host,
+			c.Instance,
+			c.Address,
+			strings.Join(c.Namespaces, ","),
+			c.Node,
+			c.Interface,
+			c.Version,
+			time.Since(c.ConnectedSince).Round(time.Second).String(),
+		})
+	}
+	return writeTable(ctx.App.Writer,
+		[]string{"ID", "DISPATCH", "INSTANCE", "ADDRESS", "NAMESPACES", "NODE", "IFACE", "VERSION", "AGE"},
+		rows)
+}
+
+func listClusterNamespaces(ctx *cli.Context) error {
+	namespaces, err := clientFrom(ctx).ClusterNamespaces(ctx.Context)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if ctx.Bool("single-member") {
+		filtered := namespaces[:0]
+		for _, ns := range namespaces {
+			if ns.SingleMember {
+				filtered = append(filtered, ns)
+			}
+		}
+		namespaces = filtered
+	}
+	if jsonOutput(ctx) {
+		return writeJSON(ctx.App.Writer, namespaces)
+	}
+
+	rows := make([][]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		rows = append(rows, []string{
+			ns.Name,
+			fmt.Sprint(len(ns.Clients)),
+			fmt.Sprint(len(ns.Instances)),
+			fmt.Sprint(ns.SingleMember),
+			strings.Join(ns.Clients, ","),
+		})
+	}
+	return writeTable(ctx.App.Writer, []string{"NAMESPACE", "CLIENTS", "INSTANCES", "SINGLE MEMBER", "CLIENT IDS"}, rows)
+}
+
+func listNamespaces(ctx *cli.Context) error {
+	namespaces, err := clientFrom(ctx).Namespaces(ctx.Context)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if jsonOutput(ctx) {
+		return writeJSON(ctx.App.Writer, namespaces)
+	}
+
+	rows := make([][]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		rows = append(rows, []string{
+			ns.Name,
+			fmt.Sprint(len(ns.Clients)),
+			fmt.Sprint(ns.Paused),
+			strings.Join(ns.Clients, ","),
+		})
+	}
+	return writeTable(ctx.App.Writer, []string{"NAMESPACE", "CLIENTS", "PAUSED", "CLIENT IDS"}, rows)
+}
+
+func listRoutes(ctx *cli.Context) error {
+	routes, err := clientFrom(ctx).Routes(ctx.Context)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if jsonOutput(ctx) {
+		return writeJSON(ctx.App.Writer, routes)
+	}
+
+	rows := make([][]string, 0, len(routes))
+	for _, r := range routes {
+		ports := make([]string, 0, len(r.Filter.Ports))
+		for _, p := range r.Filter.Ports {
+			ports = append(ports, fmt.Sprint(p))
+		}
+		rows = append(rows, []string{
+			r.From,
+			strings.Join(r.To, ","),
+			strings.Join(ports, ","),
+			strings.Join(r.Filter.Groups, ","),
+		})
+	}
+	return writeTable(ctx.App.Writer, []string{"FROM", "TO", "PORTS", "GROUPS"}, rows)
+}
+
+func showTraffic(ctx *cli.Context) error {
+	namespaces, err := clientFrom(ctx).Namespaces(ctx.Context)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	type traffic struct {
+		Namespace  string `json:"namespace"`
+		RxMessages uint64 `json:"rx_messages"`
+		RxBytes    uint64 `json:"rx_bytes"`
+		TxMessages uint64 `json:"tx_messages"`
+		TxBytes    uint64 `json:"tx_bytes"`
+	}
+	result := make([]traffic, 0, len(namespaces))
+	for _, ns := range namespaces {
+		result = append(result, traffic{ns.Name, ns.RxMessages, ns.RxBytes, ns.TxMessages, ns.TxBytes})
+	}
+	if jsonOutput(ctx) {
+		return writeJSON(ctx.App.Writer, result)
+	}
+
+	rows := make([][]string, 0, len(result))
+	for _, t := range result {
+		rows = append(rows, []string{
+			t.Namespace,
+			fmt.Sprint(t.RxMessages),
+			fmt.Sprint(t.RxBytes),
+			fmt.Sprint(t.TxMessages),
+			fmt.Sprint(t.TxBytes),
+		})
+	}
+	return writeTable(ctx.App.Writer, []string{"NAMESPACE", "RX MSGS", "RX BYTES", "TX MSGS", "TX BYTES"}, rows)
+}
+
+func tail(ctx *cli.Context) error {
+	ns, err := requireArg(ctx, "NAMESPACE")
+	if err != nil {
+		return err
+	}
+
+	sigCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	type entry struct {
+		Time      time.Time `json:"time"`
+		Namespace string    `json:"namespace"`
+		Client    string    `json:"client"`
+		Reply     bool      `json:"reply,omitempty"`
+		decode.Summary
+	}
+	enc := json.NewEncoder(ctx.App.Writer)
+	err = clientFrom(ctx).Tail(sigCtx, ns, func(f admin.Frame) error {
+		e := entry{Time: f.Time, Namespace: f.Namespace, Client: f.Client, Reply: f.Reply, Summary: decode.Describe(f.Frame)}
+		if jsonOutput(ctx) {
+			return enc.Encode(e)
+		}
+		_, err := fmt.Fprintf(ctx.App.Writer, "%s %s %s %s > %s %s %s\n",
+			e.Time.Local().Format("15:04:05.000"), e.Namespace, e.Client, e.Src, e.Dst, strings.ToUpper(e.Protocol), e.Info)
+		return err
+	})
+	if err != nil && sigCtx.Err() == nil {
+		return cli.Exit(err, 1)
+	}
+	return nil
+}
+
+func kick(ctx *cli.Context) error {
+	id, err := requireArg(ctx, "CLIENT-ID")
+	if err != nil {
+		return err
+	}
+	if err = clientFrom(ctx).Disconnect(ctx.Context, id); err != nil {
+		return cli.Exit(err, 1)
+	}
+	_, _ = fmt.Fprintf(ctx.App.Writer, "Client %s disconnected\n", id)
+	return nil
+}
+
+func drain(ctx *cli.Context) error {
+	if err := clientFrom(ctx).Drain(ctx.Context); err != nil {
+		return cli.Exit(err, 1)
+	}
+	_, _ = fmt.Fprintln(ctx.App.Writer, "Drain started")
+	return nil
+}
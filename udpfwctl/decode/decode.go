@@ -0,0 +1,133 @@
+package decode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/udpfw/common"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	mdnsPort = 5353
+	ssdpPort = 1900
+)
+
+// Summary describes a frame forwarded through the dispatch.
+type Summary struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	Protocol string `json:"protocol"`
+	Info     string `json:"info"`
+}
+
+// Describe summarizes an Ethernet frame, decoding mDNS and SSDP payloads.
+func Describe(frame []byte) Summary {
+	info, ok := common.ParseFrame(frame)
+	if !ok {
+		return Summary{Protocol: "unknown", Info: fmt.Sprintf("%d bytes", len(frame))}
+	}
+
+	s := Summary{
+		Src:      hostPort(info.Src, info.SrcPort),
+		Dst:      hostPort(info.Dst, info.DstPort),
+		Protocol: "udp",
+		Info:     fmt.Sprintf("%d bytes", len(info.Payload)),
+	}
+	if info.Protocol != 17 {
+		s.Protocol = "ip/" + strconv.Itoa(int(info.Protocol))
+		s.Info = fmt.Sprintf("%d bytes", len(info.Network))
+		return s
+	}
+
+	switch {
+	case info.SrcPort == mdnsPort || info.DstPort == mdnsPort:
+		s.Protocol = "mdns"
+		s.Info = describeDNS(info.Payload)
+	case info.DstPort == ssdpPort || info.SrcPort == ssdpPort:
+		s.Protocol = "ssdp"
+		s.Info = describeSSDP(info.Payload)
+	}
+	return s
+}
+
+func hostPort(ip net.IP, port uint16) string {
+	if port == 0 {
+		return ip.String()
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+func describeDNS(payload []byte) string {
+	var p dnsmessage.Parser
+	header, err := p.Start(payload)
+	if err != nil {
+		return "malformed: " + err.Error()
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return "malformed: " + err.Error()
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return "malformed: " + err.Error()
+	}
+
+	var parts []string
+	if header.Response {
+		parts = append(parts, "response")
+	} else {
+		parts = append(parts, "query")
+	}
+	for _, q := range questions {
+		parts = append(parts, fmt.Sprintf("? %s %s", q.Name, typeName(q.Type)))
+	}
+	for _, a := range answers {
+		parts = append(parts, fmt.Sprintf("%s %s %s", a.Header.Name, typeName(a.Header.Type), resourceValue(a.Body)))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func typeName(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+func resourceValue(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%s:%d", b.Target, b.Port)
+	case *dnsmessage.TXTResource:
+		return strings.Join(b.TXT, ",")
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	default:
+		return ""
+	}
+}
+
+func describeSSDP(payload []byte) string {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(payload)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return "malformed: " + err.Error()
+	}
+	headers, _ := r.ReadMIMEHeader()
+
+	parts := []string{line}
+	for _, h := range []string{"St", "Nt", "Nts", "Usn", "Location"} {
+		if v := headers.Get(h); v != "" {
+			parts = append(parts, strings.ToUpper(h)+"="+v)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,68 @@
+package decode
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"testing"
+)
+
+func udpFrame(srcPort, dstPort uint16, dst [4]byte, payload []byte) []byte {
+	frame := []byte{
+		0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB, 0x02, 0x42,
+		0xAC, 0x11, 0x00, 0x02, 0x08, 0x00,
+	}
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+8+len(payload)))
+	ip[8] = 255
+	ip[9] = 17
+	copy(ip[12:], []byte{192, 168, 0, 10})
+	copy(ip[16:], dst[:])
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	frame = append(frame, ip...)
+	frame = append(frame, udp...)
+	return append(frame, payload...)
+}
+
+func TestDescribe_MDNS(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	require.NoError(t, b.StartQuestions())
+	require.NoError(t, b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("_http._tcp.local."),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}))
+	payload, err := b.Finish()
+	require.NoError(t, err)
+
+	s := Describe(udpFrame(5353, 5353, [4]byte{224, 0, 0, 251}, payload))
+	assert.Equal(t, "mdns", s.Protocol)
+	assert.Equal(t, "192.168.0.10:5353", s.Src)
+	assert.Equal(t, "224.0.0.251:5353", s.Dst)
+	assert.Equal(t, "query; ? _http._tcp.local. PTR", s.Info)
+}
+
+func TestDescribe_SSDP(t *testing.T) {
+	payload := []byte("M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"ST: ssdp:all\r\n\r\n")
+
+	s := Describe(udpFrame(50000, 1900, [4]byte{239, 255, 255, 250}, payload))
+	assert.Equal(t, "ssdp", s.Protocol)
+	assert.Equal(t, "M-SEARCH * HTTP/1.1; ST=ssdp:all", s.Info)
+}
+
+func TestDescribe_Other(t *testing.T) {
+	s := Describe(udpFrame(1000, 2000, [4]byte{239, 0, 0, 1}, []byte("data")))
+	assert.Equal(t, "udp", s.Protocol)
+	assert.Equal(t, "4 bytes", s.Info)
+
+	s = Describe([]byte{0x00})
+	assert.Equal(t, "unknown", s.Protocol)
+}